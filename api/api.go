@@ -10,76 +10,243 @@ import (
 	"net"
 	"strings"
 
-	"github.com/jamiealquiza/polymur/output"
 	"github.com/jamiealquiza/polymur/pool"
 )
 
 // Available API commands.
 var (
 	commands = map[string]func(r Request) string{
-		"getdest": getdest,
-		"putdest": putdest,
-		"deldest": deldest,
+		"getdest":     getdest,
+		"putdest":     putdest,
+		"deldest":     deldest,
+		"draindest":   draindest,
+		"getdrains":   getdrains,
+		"getclusters": getclusters,
+		"getsources":  getsources,
 	}
 )
 
 // Request holds API request parameters.
+// The cluster parameter is optional; if omitted,
+// requests reference the default cluster.
 type Request struct {
 	pool    *pool.Pool
 	command string
 	param   string
+	cluster string
 }
 
-// getdest returns registered destinations from the pool.
+// getdest returns registered destinations from a cluster.
+// Usage: getdest [cluster]
 func getdest(r Request) string {
+	// getdest takes the cluster as
+	// its only parameter.
+	c, err := r.pool.Cluster(r.param)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
 	dests := make(map[string]interface{})
+
+	c.RLock()
 	// Get all registered destinations.
-	dests["registered"] = r.pool.Registered
+	registered := make(map[string]interface{})
+	for k, v := range c.Registered {
+		registered[k] = v
+	}
+	dests["registered"] = registered
 
 	// Get all active.
 	active := []string{}
-	for k := range r.pool.Conns {
+	for k := range c.Conns {
 		active = append(active, k)
 	}
 	dests["active"] = active
 
+	// Get any broadcast filters.
+	filters := make(map[string]string)
+	for k, f := range c.Filters {
+		filters[k] = f.String()
+	}
+	dests["filters"] = filters
+
+	// Get the size of any spilled messages.
+	spilled := make(map[string]int64)
+	for k, spill := range c.Spills {
+		spilled[k] = spill.Size()
+	}
+	dests["spilled-bytes"] = spilled
+
+	// Get failed destinations held on the
+	// ring and those with hints to replay.
+	down := []string{}
+	for k := range c.Down {
+		down = append(down, k)
+	}
+	dests["down"] = down
+
+	hinted := []string{}
+	for k := range c.Hints {
+		hinted = append(hinted, k)
+	}
+	dests["hinted"] = hinted
+	c.RUnlock()
+
+	// Get retry queue stats.
+	dests["retry"] = map[string]interface{}{
+		"queue-length": len(c.RetryQueue),
+		"stats":        c.RetryStats(),
+	}
+
+	// Get each destination's circuit breaker
+	// and connection status from its writer.
+	breakers := make(map[string]pool.BreakerStatus)
+	connections := make(map[string]pool.ConnStatus)
+	for name, w := range c.WriterList() {
+		// Writers register their
+		// destination once started.
+		health := w.Health()
+		if health.State == "" {
+			continue
+		}
+		breakers[name] = health
+		connections[name] = w.Stats()
+	}
+	dests["breakers"] = breakers
+	dests["connections"] = connections
+
+	// Get the key space share
+	// of each active destination.
+	dests["ring-share"] = c.RingShares()
+
 	// Json.
 	response, _ := json.MarshalIndent(dests, "", " ")
 	return fmt.Sprintf("%s\n", response)
 }
 
-// putdest registers a destination with the pool.
+// getclusters returns the pool's clusters
+// and their configuration.
+func getclusters(r Request) string {
+	clusters := make(map[string]interface{})
+
+	for _, c := range r.pool.ClusterList() {
+		c.RLock()
+		clusters[c.Name] = map[string]interface{}{
+			"distribution": c.Distribution,
+			"queue-cap":    c.QueueCap,
+			"active":       len(c.Conns),
+			"registered":   len(c.Registered),
+		}
+		c.RUnlock()
+	}
+
+	response, _ := json.MarshalIndent(clusters, "", " ")
+	return fmt.Sprintf("%s\n", response)
+}
+
+// getsources returns where each registered
+// destination in a cluster was registered from.
+// Usage: getsources [cluster]
+func getsources(r Request) string {
+	c, err := r.pool.Cluster(r.param)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
+	sources := make(map[string]string)
+
+	c.RLock()
+	for k, v := range c.Sources {
+		sources[k] = v
+	}
+	c.RUnlock()
+
+	response, _ := json.MarshalIndent(sources, "", " ")
+	return fmt.Sprintf("%s\n", response)
+}
+
+// putdest registers a destination with a cluster.
+// Usage: putdest destination [cluster]
 func putdest(r Request) string {
 	if r.param == "" {
 		return fmt.Sprintf("Must provide destination\n")
 	}
 
+	c, err := r.pool.Cluster(r.cluster)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
 	dest, err := pool.ParseDestination(r.param)
 	if err != nil {
 		return fmt.Sprintln(err)
 	}
+	dest.Source = pool.SourceAPI
 
-	// TODO replace this func with an
-	// add destination method on the pool.
-	go output.DestinationWriter(r.pool, dest)
+	if err := c.AddDestination(dest); err != nil {
+		return fmt.Sprintln(err)
+	}
 
-	return fmt.Sprintf("Registered destination: %s\n", r.param)
+	return fmt.Sprintf("Registered destination: %s%s\n", r.param, c.LogSuffix())
 }
 
-// deldest unregisters a destination with the pool.
+// deldest unregisters a destination with a cluster.
+// Usage: deldest destination [cluster]
 func deldest(r Request) string {
 	if r.param == "" {
 		return fmt.Sprintf("Must provide destination\n")
 	}
 
+	c, err := r.pool.Cluster(r.cluster)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
+	dest, err := pool.ParseDestination(r.param)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
+	c.Unregister(dest)
+
+	return fmt.Sprintf("Unregistered destination: %s%s\n", r.param, c.LogSuffix())
+}
+
+// draindest removes a destination from a cluster's
+// routing and unregisters it once its in-flight
+// messages are written.
+// Usage: draindest destination [cluster]
+func draindest(r Request) string {
+	if r.param == "" {
+		return fmt.Sprintf("Must provide destination\n")
+	}
+
+	c, err := r.pool.Cluster(r.cluster)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
 	dest, err := pool.ParseDestination(r.param)
 	if err != nil {
 		return fmt.Sprintln(err)
 	}
 
-	r.pool.Unregister(dest)
+	c.Drain(dest, c.DrainTimeout)
 
-	return fmt.Sprintf("Unregistered destination: %s\n", r.param)
+	return fmt.Sprintf("Draining destination: %s%s\n", r.param, c.LogSuffix())
+}
+
+// getdrains returns the progress of
+// destination drains in a cluster.
+// Usage: getdrains [cluster]
+func getdrains(r Request) string {
+	c, err := r.pool.Cluster(r.param)
+	if err != nil {
+		return fmt.Sprintln(err)
+	}
+
+	response, _ := json.MarshalIndent(c.DrainStatus(), "", " ")
+	return fmt.Sprintf("%s\n", response)
 }
 
 // API is a simple TCP listener that
@@ -118,6 +285,9 @@ func apiHandler(p *pool.Pool, conn net.Conn) {
 	if len(input) > 1 {
 		request.param = input[1]
 	}
+	if len(input) > 2 {
+		request.cluster = input[2]
+	}
 
 	request.pool = p
 
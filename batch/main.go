@@ -0,0 +1,139 @@
+// Package batch implements pooled, reference
+// counted batches of datapoints. A batch holds its
+// datapoints LF delimited in a single byte buffer,
+// so that passing datapoints through Polymur and
+// writing them to a destination doesn't allocate
+// per datapoint.
+package batch
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// Initial buffer capacity of a new batch.
+	initialSize   = 16 << 10
+	initialPoints = 128
+	// Batches that have grown beyond maxPooledSize
+	// aren't recycled.
+	maxPooledSize = 1 << 20
+)
+
+var batches = sync.Pool{
+	New: func() interface{} {
+		return &Batch{
+			buf:  make([]byte, 0, initialSize),
+			ends: make([]int, 0, initialPoints),
+		}
+	},
+}
+
+// Batch is a batch of datapoints. A batch obtained
+// with Get holds one reference; each holder sharing the
+// batch takes a reference with Retain and drops it with
+// Release. The batch is recycled when the last reference
+// is released, so datapoints must not be referenced after
+// releasing the batch. A batch must not be appended to
+// once it's shared.
+type Batch struct {
+	buf []byte
+	// ends is the buffer offset of the LF
+	// terminating each datapoint.
+	ends []int
+	refs int32
+}
+
+// Get returns an empty batch from the pool.
+func Get() *Batch {
+	b := batches.Get().(*Batch)
+	b.refs = 1
+
+	return b
+}
+
+// New returns a batch of the datapoints dps.
+func New(dps ...string) *Batch {
+	b := Get()
+	for _, dp := range dps {
+		b.AppendString(dp)
+	}
+
+	return b
+}
+
+// Append copies the datapoint dp, which
+// must not contain a LF, to the batch.
+func (b *Batch) Append(dp []byte) {
+	b.buf = append(b.buf, dp...)
+	b.ends = append(b.ends, len(b.buf))
+	b.buf = append(b.buf, '\n')
+}
+
+// AppendString copies the datapoint dp,
+// which must not contain a LF, to the batch.
+func (b *Batch) AppendString(dp string) {
+	b.buf = append(b.buf, dp...)
+	b.ends = append(b.ends, len(b.buf))
+	b.buf = append(b.buf, '\n')
+}
+
+// Len returns the number of datapoints in the batch.
+func (b *Batch) Len() int {
+	return len(b.ends)
+}
+
+// Size returns the size of the
+// batch in bytes, including LFs.
+func (b *Batch) Size() int {
+	return len(b.buf)
+}
+
+// Point returns datapoint i, without the LF.
+func (b *Batch) Point(i int) []byte {
+	start := 0
+	if i > 0 {
+		start = b.ends[i-1] + 1
+	}
+
+	return b.buf[start:b.ends[i]]
+}
+
+// Bytes returns the LF delimited datapoints.
+func (b *Batch) Bytes() []byte {
+	return b.buf
+}
+
+// Retain takes a reference to
+// the batch and returns it.
+func (b *Batch) Retain() *Batch {
+	atomic.AddInt32(&b.refs, 1)
+	return b
+}
+
+// Release drops a reference to the batch,
+// recycling it if it was the last reference.
+func (b *Batch) Release() {
+	if atomic.AddInt32(&b.refs, -1) != 0 {
+		return
+	}
+
+	if cap(b.buf) > maxPooledSize {
+		return
+	}
+
+	b.buf, b.ends = b.buf[:0], b.ends[:0]
+	batches.Put(b)
+}
+
+// Name returns the metric name
+// of the datapoint dp.
+func Name(dp []byte) []byte {
+	dp = bytes.TrimLeft(dp, " \t")
+	if i := bytes.IndexAny(dp, " \t"); i >= 0 {
+		return dp[:i]
+	}
+
+	return dp
+}
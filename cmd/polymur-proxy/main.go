@@ -3,30 +3,37 @@ package main
 import (
 	"flag"
 	"log"
+	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
+	"github.com/jamiealquiza/polymur/batch"
 	"github.com/jamiealquiza/polymur/listener"
 	"github.com/jamiealquiza/polymur/output"
+	"github.com/jamiealquiza/polymur/pool"
 	"github.com/jamiealquiza/polymur/statstracker"
-	"github.com/jamiealquiza/runstats"
 
 	"github.com/jamiealquiza/envy"
 )
 
 var (
 	options struct {
-		cert         string
-		apiKey       string
-		gateway      string
-		addr         string
-		statAddr     string
-		queuecap     int
-		workers      int
-		console      bool
-		metricsFlush int
-		verbose      bool
+		cert             string
+		apiKey           string
+		gateway          string
+		addr             string
+		statAddr         string
+		queuecap         int
+		outgoingQueuecap int
+		workers          int
+		console          bool
+		metricsFlush     int
+		shutdownTimeout  int
+		verbose          bool
 	}
 
 	sigChan = make(chan os.Signal)
@@ -39,46 +46,77 @@ func init() {
 	flag.StringVar(&options.addr, "listen-addr", "0.0.0.0:2003", "Polymur-proxy listen address")
 	flag.StringVar(&options.statAddr, "stat-addr", "localhost:2020", "runstats listen address")
 	flag.IntVar(&options.queuecap, "queue-cap", 32768, "In-flight message queue capacity (number of data point batches [100 points max per batch])")
+	flag.IntVar(&options.outgoingQueuecap, "outgoing-queue-cap", 65536, "In-flight gateway message queue capacity (number of data points)")
 	flag.IntVar(&options.workers, "workers", 3, "HTTP output workers")
 	flag.BoolVar(&options.console, "console-out", false, "Dump output to console")
 	flag.IntVar(&options.metricsFlush, "metrics-flush", 0, "Graphite flush interval for runtime metrics (0 is disabled)")
-	flag.BoolVar(&options.verbose, "verbose", true, "Log verbosity")
+	flag.IntVar(&options.shutdownTimeout, "shutdown-timeout", 5, "Max time to write buffered data points at shutdown (seconds)")
+	flag.BoolVar(&options.verbose, "verbose", true, "Log verbosity (deprecated; gateway errors are always logged)")
 
 	envy.Parse("POLYMUR_PROXY")
 	flag.Parse()
 }
 
 // Handles signal events.
-func runControl() {
+func runControl(p *pool.Pool) {
 	signal.Notify(sigChan, syscall.SIGINT)
 	<-sigChan
 	log.Printf("Shutting down")
+	p.Shutdown(time.Duration(options.shutdownTimeout) * time.Second)
 	os.Exit(0)
 }
 
+// gatewayDestination returns the gateway destination
+// (see output.NewWriter): the gateway address with the
+// API key, the CA certificate and a connection per worker.
+func gatewayDestination() string {
+	if !strings.HasPrefix(options.gateway, "https://") {
+		log.Fatalf("Gateway must be an https:// address: %s\n", options.gateway)
+	}
+
+	params := url.Values{}
+	params.Set("api-key", options.apiKey)
+	params.Set("connections", strconv.Itoa(options.workers))
+	if options.cert != "" {
+		params.Set("tls-ca", options.cert)
+	}
+
+	return strings.TrimSuffix(options.gateway, "/") + "?" + params.Encode()
+}
+
 func main() {
 	log.Println("::: Polymur-proxy :::")
 	ready := make(chan bool, 1)
 
-	incomingQueue := make(chan []*string, options.queuecap)
+	incomingQueue := make(chan *batch.Batch, options.queuecap)
 
 	// Output writer.
-	if options.console {
-		go output.Console(incomingQueue)
-		ready <- true
-	} else {
-		go output.HTTPWriter(
-			&output.HTTPWriterConfig{
-				Cert:          options.cert,
-				APIKey:        options.apiKey,
-				Gateway:       options.gateway,
-				Workers:       options.workers,
-				IncomingQueue: incomingQueue,
-				Verbose:       options.verbose,
-			},
-			ready)
+	destination := "console://"
+	if !options.console {
+		destination = gatewayDestination()
+
+		// Exit if the gateway can't be
+		// reached or rejects the API key.
+		if err := output.CheckGateway(destination, 10*time.Second); err != nil {
+			log.Fatalf("Gateway %s: %s\n", options.gateway, err)
+		}
+		log.Printf("Connection to gateway %s successful\n", options.gateway)
 	}
 
+	p := pool.NewPool()
+	go output.TCPWriter(
+		p,
+		&output.TCPWriterConfig{
+			Destinations:  destination,
+			Distribution:  "broadcast",
+			IncomingQueue: incomingQueue,
+			QueueCap:      options.outgoingQueuecap,
+			// A slow gateway blocks the listener
+			// rather than dropping data points.
+			Backpressure: true,
+		},
+		ready)
+
 	<-ready
 
 	// Stat counters.
@@ -96,11 +134,11 @@ func main() {
 
 	// Polymur stats writer.
 	if options.metricsFlush > 0 {
-		go runstats.WriteGraphite(incomingQueue, options.metricsFlush, sentCntr)
+		go statstracker.WriteGraphite(incomingQueue, options.metricsFlush, sentCntr)
 	}
 
 	// Runtime stats listener.
-	go runstats.Start(options.statAddr)
+	go statstracker.Start(options.statAddr)
 
-	runControl()
+	runControl(p)
 }
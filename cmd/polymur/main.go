@@ -6,13 +6,14 @@ import (
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
 	"github.com/jamiealquiza/polymur/api"
+	"github.com/jamiealquiza/polymur/batch"
 	"github.com/jamiealquiza/polymur/listener"
 	"github.com/jamiealquiza/polymur/output"
 	"github.com/jamiealquiza/polymur/pool"
 	"github.com/jamiealquiza/polymur/statstracker"
-	"github.com/jamiealquiza/runstats"
 
 	"github.com/jamiealquiza/envy"
 )
@@ -28,6 +29,39 @@ var (
 		destinations     string
 		metricsFlush     int
 		distribution     string
+		hashAlgorithm    string
+		clusters         string
+		spillDir         string
+		spillMaxSize     int
+		spillMaxAge      int
+		failover         string
+		retryMaxAttempts int
+		retryTTL         int
+		retryMaxBackoff  int
+		retryDeadLetter  string
+		dropLogRate      int
+		memoryBudget     int
+		memoryPolicy     string
+		stateFile        string
+		discovery        string
+		drainTimeout     int
+		shutdownTimeout  int
+		writeTimeout     int
+		udpMTU           int
+		metricTemplates  string
+		breakerFailures  int
+		breakerWindow    int
+		breakerTimeout   int
+		healthInterval   int
+		slowChecks       int
+		slowQueueFill    int
+		dialTimeout      int
+		reconnectBackoff int
+		reconnectMax     int
+		reconnectFails   int
+		workers          int
+		writeBufferSize  int
+		flushInterval    int
 	}
 
 	sigChan = make(chan os.Signal)
@@ -42,17 +76,62 @@ func init() {
 	flag.BoolVar(&options.console, "console-out", false, "Dump output to console")
 	flag.StringVar(&options.destinations, "destinations", "", "Comma-delimited list of ip:port destinations")
 	flag.IntVar(&options.metricsFlush, "metrics-flush", 0, "Graphite flush interval for runtime metrics (0 is disabled)")
-	flag.StringVar(&options.distribution, "distribution", "broadcast", "Destination distribution methods: broadcast, hash-route")
+	flag.StringVar(&options.distribution, "distribution", "broadcast", "Destination distribution methods: broadcast, hash-route, round-robin, least-queue")
+	flag.IntVar(&options.workers, "distribution-workers", 1, "Number of goroutines distributing data points to destinations")
+	flag.IntVar(&options.writeBufferSize, "write-buffer-size", 64, "Destination write buffer size (KB)")
+	flag.IntVar(&options.flushInterval, "write-flush-interval", 100, "Max time data points are held in a destination write buffer (ms)")
+	flag.StringVar(&options.hashAlgorithm, "hash-algorithm", "carbon_ch", "hash-route algorithm: carbon_ch, fnv1a_ch, jump_fnv1a_ch")
+	flag.StringVar(&options.spillDir, "spill-dir", "", "Directory for on-disk destination queue overflow (disabled if empty)")
+	flag.IntVar(&options.spillMaxSize, "spill-max-size", 1024, "Max on-disk queue size per destination (MB)")
+	flag.IntVar(&options.spillMaxAge, "spill-max-age", 86400, "Max age of on-disk queued data points (seconds)")
+	flag.StringVar(&options.failover, "failover", "redistribute", "hash-route failed destination policy: redistribute, hinted-handoff")
+	flag.IntVar(&options.retryMaxAttempts, "retry-max-attempts", 10, "Max redistribution attempts for a failed data point (0 is unlimited)")
+	flag.IntVar(&options.retryTTL, "retry-ttl", 300, "Max time to retry a failed data point (seconds, 0 is unlimited)")
+	flag.IntVar(&options.retryMaxBackoff, "retry-max-backoff", 30, "Max retry backoff when no destinations are available (seconds)")
+	flag.StringVar(&options.retryDeadLetter, "retry-dead-letter", "", "File to write data points that exhaust retries to (disabled if empty)")
+	flag.IntVar(&options.dropLogRate, "drop-log-rate", 0, "Max dropped data points to log per minute (0 is disabled)")
+	flag.IntVar(&options.memoryBudget, "memory-budget", 0, "Max data point memory across incoming, destination and retry queues (MB, 0 is unlimited)")
+	flag.StringVar(&options.discovery, "discovery", "", "Semicolon-delimited list of destination discovery providers: provider:target[?cluster=name&interval=s&resolver=ip:port] (providers: file, dns-srv, dns-a, consul)")
+	flag.IntVar(&options.drainTimeout, "drain-timeout", 60, "Max time to write in-flight data points to a drained destination (seconds)")
+	flag.IntVar(&options.shutdownTimeout, "shutdown-timeout", 5, "Max time to write buffered destination data points at shutdown (seconds)")
+	flag.IntVar(&options.writeTimeout, "write-timeout", 10, "Max time for a destination write to complete (seconds, 0 is disabled)")
+	flag.IntVar(&options.udpMTU, "udp-mtu", 1472, "Max UDP destination datagram size (bytes)")
+	flag.StringVar(&options.metricTemplates, "metric-templates", "", "Semicolon-delimited list of templates mapping Graphite paths for InfluxDB and Prometheus destinations: [filter] template [tag=value,...]")
+	flag.IntVar(&options.breakerFailures, "breaker-failures", 3, "Destination write failures within -breaker-failure-window that open its circuit breaker")
+	flag.IntVar(&options.breakerWindow, "breaker-failure-window", 60, "Window over which destination write failures are counted (seconds)")
+	flag.IntVar(&options.breakerTimeout, "breaker-open-timeout", 30, "Time a destination's circuit breaker is open before the destination is probed (seconds)")
+	flag.IntVar(&options.healthInterval, "health-check-interval", 5, "Destination health check interval (seconds)")
+	flag.IntVar(&options.slowChecks, "slow-checks", 3, "Consecutive health checks a destination queue grows over before its circuit breaker opens (0 is disabled)")
+	flag.IntVar(&options.slowQueueFill, "slow-queue-fill", 50, "Min destination queue fill for slow destination detection (percent)")
+	flag.IntVar(&options.dialTimeout, "dial-timeout", 3, "Destination connection timeout (seconds)")
+	flag.IntVar(&options.reconnectBackoff, "reconnect-backoff", 1000, "Min destination reconnect backoff (ms)")
+	flag.IntVar(&options.reconnectMax, "reconnect-max-backoff", 30, "Max destination reconnect backoff (seconds)")
+	flag.IntVar(&options.reconnectFails, "reconnect-failures", 3, "Consecutive failed reconnects before a destination's circuit breaker opens")
+	flag.StringVar(&options.stateFile, "state-file", "", "File to persist destinations added and removed with the API to (disabled if empty)")
+	flag.StringVar(&options.memoryPolicy, "memory-policy", "drop", "Policy when the memory budget is reached: drop, backpressure")
+	flag.StringVar(&options.clusters, "clusters", "", "Semicolon-delimited list of additional destination clusters: name[?distribution=method&queue-cap=n&hash-algorithm=algo&failover=policy]@ip:port,ip:port")
 
 	envy.Parse("POLYMUR")
 	flag.Parse()
+
+	// A zero backoff would retry in a tight loop.
+	for name, v := range map[string]int{
+		"reconnect-backoff":     options.reconnectBackoff,
+		"reconnect-max-backoff": options.reconnectMax,
+		"retry-max-backoff":     options.retryMaxBackoff,
+	} {
+		if v < 1 {
+			log.Fatalf("-%s must be a positive integer", name)
+		}
+	}
 }
 
 // Handles signal events.
-func runControl() {
+func runControl(p *pool.Pool) {
 	signal.Notify(sigChan, syscall.SIGINT)
 	<-sigChan
 	log.Printf("Shutting down")
+	p.Shutdown(time.Duration(options.shutdownTimeout) * time.Second)
 	os.Exit(0)
 }
 
@@ -60,26 +139,79 @@ func main() {
 	log.Println("::: Polymur :::")
 	ready := make(chan bool, 1)
 
-	incomingQueue := make(chan []*string, options.incomingQueuecap)
+	incomingQueue := make(chan *batch.Batch, options.incomingQueuecap)
+
+	// Failed data point retry settings.
+	retry := pool.DefaultRetryConfig()
+	retry.MaxAttempts = options.retryMaxAttempts
+	retry.TTL = time.Duration(options.retryTTL) * time.Second
+	retry.MaxBackoff = time.Duration(options.retryMaxBackoff) * time.Second
+	retry.DeadLetter = options.retryDeadLetter
+
+	// Destination health check settings.
+	health := pool.HealthConfig{
+		WriteTimeout:  time.Duration(options.writeTimeout) * time.Second,
+		MaxFailures:   options.breakerFailures,
+		FailureWindow: time.Duration(options.breakerWindow) * time.Second,
+		OpenTimeout:   time.Duration(options.breakerTimeout) * time.Second,
+		CheckInterval: time.Duration(options.healthInterval) * time.Second,
+		SlowChecks:    options.slowChecks,
+		SlowFill:      float64(options.slowQueueFill) / 100,
+	}
+
+	// Destination reconnect settings.
+	reconnect := pool.ReconnectConfig{
+		DialTimeout: time.Duration(options.dialTimeout) * time.Second,
+		MinBackoff:  time.Duration(options.reconnectBackoff) * time.Millisecond,
+		MaxBackoff:  time.Duration(options.reconnectMax) * time.Second,
+		MaxFailures: options.reconnectFails,
+	}
+
+	// Dropped data point sampling.
+	pool.Drops.SetSampling(options.dropLogRate, time.Minute)
+
+	// Queue memory budget.
+	if err := pool.Memory.SetLimit(int64(options.memoryBudget)<<20, options.memoryPolicy); err != nil {
+		log.Fatal(err)
+	}
 
 	pool := pool.NewPool()
 
-	// Output writer.
+	// Console output replaces the
+	// default cluster destinations.
+	destinations := options.destinations
 	if options.console {
-		go output.Console(incomingQueue)
-		ready <- true
-	} else {
-		go output.TCPWriter(
-			pool,
-			&output.TCPWriterConfig{
-				Destinations:  options.destinations,
-				Distribution:  options.distribution,
-				IncomingQueue: incomingQueue,
-				QueueCap:      options.outgoingQueuecap,
-			},
-			ready)
+		destinations = "console://"
 	}
 
+	// Output writer.
+	go output.TCPWriter(
+		pool,
+		&output.TCPWriterConfig{
+			Destinations:    destinations,
+			Distribution:    options.distribution,
+			HashAlgorithm:   options.hashAlgorithm,
+			Clusters:        options.clusters,
+			SpillDir:        options.spillDir,
+			SpillMaxSize:    options.spillMaxSize,
+			SpillMaxAge:     options.spillMaxAge,
+			Failover:        options.failover,
+			Retry:           retry,
+			Health:          health,
+			Reconnect:       reconnect,
+			Workers:         options.workers,
+			WriteBufferSize: options.writeBufferSize << 10,
+			FlushInterval:   time.Duration(options.flushInterval) * time.Millisecond,
+			StateFile:       options.stateFile,
+			Discovery:       options.discovery,
+			DrainTimeout:    time.Duration(options.drainTimeout) * time.Second,
+			UDPMTU:          options.udpMTU,
+			Templates:       options.metricTemplates,
+			IncomingQueue:   incomingQueue,
+			QueueCap:        options.outgoingQueuecap,
+		},
+		ready)
+
 	<-ready
 
 	// Stat counters.
@@ -100,11 +232,11 @@ func main() {
 
 	// Polymur stats writer.
 	if options.metricsFlush > 0 {
-		go runstats.WriteGraphiteWithBackendMetrics(pool, incomingQueue, options.incomingQueuecap, options.metricsFlush, sentCntr)
+		go statstracker.WriteGraphiteWithBackendMetrics(pool, incomingQueue, options.incomingQueuecap, options.metricsFlush, sentCntr)
 	}
 
 	// Runtime stats listener.
-	go runstats.Start(options.statAddr)
+	go statstracker.Start(options.statAddr)
 
-	runControl()
+	runControl(pool)
 }
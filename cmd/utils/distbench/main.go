@@ -0,0 +1,202 @@
+// distbench measures pool distribution throughput
+// for a range of distribution worker counts.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/output"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+var options struct {
+	workers      string
+	destinations int
+	distribution string
+	batches      int
+	batchSize    int
+	series       int
+	write        bool
+}
+
+func init() {
+	flag.StringVar(&options.workers, "workers", "1,2,4,8", "Comma-delimited list of distribution worker counts to run")
+	flag.IntVar(&options.destinations, "destinations", 4, "Number of destinations")
+	flag.StringVar(&options.distribution, "distribution", "hash-route", "Destination distribution method")
+	flag.IntVar(&options.batches, "batches", 200000, "Number of data point batches per run")
+	flag.IntVar(&options.batchSize, "batch-size", 100, "Data points per batch")
+	flag.IntVar(&options.series, "series", 100000, "Number of distinct series")
+	flag.BoolVar(&options.write, "write", false, "Write to local TCP destinations rather than discarding destination queues")
+	flag.Parse()
+}
+
+func main() {
+	batches := makeBatches()
+
+	fmt.Printf("GOMAXPROCS %d, %d destinations, %s\n", runtime.GOMAXPROCS(0), options.destinations, options.distribution)
+	fmt.Printf("%-8s %-12s %-14s %s\n", "workers", "elapsed", "data points", "data points/s")
+
+	for _, w := range strings.Split(options.workers, ",") {
+		workers, err := strconv.Atoi(w)
+		if err != nil || workers < 1 {
+			log.Fatalf("Invalid worker count: %s\n", w)
+		}
+
+		elapsed, points := run(workers, batches)
+		rate := float64(points) / elapsed.Seconds()
+		fmt.Printf("%-8d %-12s %-14d %.0f\n", workers, elapsed.Round(time.Millisecond), points, rate)
+	}
+}
+
+// makeBatches returns a set of batches that is
+// cycled through for each run. The batches are never
+// released, so each distribution takes a reference.
+func makeBatches() []*batch.Batch {
+	batches := make([]*batch.Batch, 1024)
+	n := 0
+	for i := range batches {
+		b := batch.Get()
+		for j := 0; j < options.batchSize; j++ {
+			b.AppendString(fmt.Sprintf("distbench.series.%d 1 1500000000", n%options.series))
+			n++
+		}
+		batches[i] = b
+	}
+
+	return batches
+}
+
+// run distributes the configured number of batches
+// with workers goroutines and returns the elapsed time
+// and number of data points handled. Destination queues
+// are drained by discarding writers or, in write mode,
+// written to local TCP destinations; in write mode the
+// elapsed time runs until the last data point is received.
+func run(workers int, batches []*batch.Batch) (time.Duration, int64) {
+	p := pool.NewPool()
+	p.SetWriter(output.NewWriter)
+	c, err := p.AddCluster(pool.ClusterConfig{
+		Name:         pool.DefaultCluster,
+		Distribution: options.distribution,
+		QueueCap:     4096,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var received, last int64
+
+	for i := 0; i < options.destinations; i++ {
+		if options.write {
+			dest, _ := pool.ParseDestination(sink(&received, &last))
+			if err := c.AddDestination(dest); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+
+		dest, _ := pool.ParseDestination(fmt.Sprintf("127.0.0.1:%d", 2003+i))
+		c.Register(dest)
+		c.AddConn(dest)
+
+		c.RLock()
+		q := c.Conns[dest.Name]
+		c.RUnlock()
+
+		go func() {
+			for b := range q.C {
+				q.Done(b)
+				b.Release()
+			}
+		}()
+	}
+
+	// Wait for writers to connect.
+	for options.write && len(c.RingShares()) < options.destinations {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	incoming := make(chan *batch.Batch, 32768)
+	var wg sync.WaitGroup
+
+	start := time.Now()
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range incoming {
+				p.Distribute(b)
+				b.Release()
+			}
+		}()
+	}
+
+	for i := 0; i < options.batches; i++ {
+		incoming <- batches[i%len(batches)].Retain()
+	}
+	close(incoming)
+
+	wg.Wait()
+
+	if !options.write {
+		return time.Since(start), int64(options.batches * options.batchSize)
+	}
+
+	// Wait for destinations to stop receiving.
+	for {
+		n := atomic.LoadInt64(&received)
+		time.Sleep(time.Second)
+		if atomic.LoadInt64(&received) == n {
+			break
+		}
+	}
+
+	return time.Duration(atomic.LoadInt64(&last) - start.UnixNano()), atomic.LoadInt64(&received)
+}
+
+// sink starts a TCP listener that counts received data
+// points and the time of the last receive. It returns
+// the listener address.
+func sink(received, last *int64) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				buf := make([]byte, 64<<10)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						atomic.AddInt64(received, int64(bytes.Count(buf[:n], []byte{'\n'})))
+						atomic.StoreInt64(last, time.Now().UnixNano())
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
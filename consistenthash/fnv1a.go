@@ -0,0 +1,61 @@
+// Package consistenthash fnv1a.go implements
+// the carbon-c-relay fnv1a_ch hash functions.
+package consistenthash
+
+import "fmt"
+
+// FNV-1a parameters.
+const (
+	fnv32Offset = 2166136261
+	fnv32Prime  = 16777619
+	fnv64Offset = 14695981039346656037
+	fnv64Prime  = 1099511628211
+)
+
+// FNV1a32 returns the 32 bit FNV-1a hash of s
+// without allocating. Bytes are sign-extended before
+// being mixed in, as carbon-c-relay does on platforms
+// with a signed char (e.g. x86); this only changes the
+// hash of keys with bytes >= 0x80, such as UTF-8
+// metric names.
+func FNV1a32(s []byte) uint32 {
+	h := uint32(fnv32Offset)
+	for _, c := range s {
+		h ^= uint32(int8(c))
+		h *= fnv32Prime
+	}
+
+	return h
+}
+
+// fnv1a64 returns the 64 bit FNV-1a hash of s,
+// sign-extending bytes like FNV1a32.
+func fnv1a64(s []byte) uint64 {
+	h := uint64(fnv64Offset)
+	for _, c := range s {
+		h ^= uint64(int8(c))
+		h *= fnv64Prime
+	}
+
+	return h
+}
+
+// fnv1aHashPos returns the ring position for s
+// as computed by carbon-c-relay: the 32 bit
+// FNV-1a hash folded into 16 bits.
+func fnv1aHashPos(s []byte) int {
+	sum := FNV1a32(s)
+
+	return int((sum >> 16) ^ (sum & 0xFFFF))
+}
+
+// fnv1aNodeKey returns the vnode key used by
+// carbon-c-relay for fnv1a_ch rings. Unlike carbon_ch,
+// the port is taken into account when no instance
+// is set, e.g. "0-127.0.0.1:2003" or "0-a".
+func fnv1aNodeKey(n Node, i int) string {
+	if n.Instance == "" {
+		return fmt.Sprintf("%d-%s:%s", i, n.IP, n.Port)
+	}
+	return fmt.Sprintf("%d-%s", i, n.Instance)
+}
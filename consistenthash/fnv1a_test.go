@@ -0,0 +1,68 @@
+package consistenthash
+
+import "testing"
+
+// Expected positions are the published 32 bit
+// FNV-1a vectors, folded into 16 bits:
+// "a" is 0xe40c292c, "foobar" is 0xbf9cf968.
+func TestFNV1aHashPos(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0x811c ^ 0x9dc5},
+		{"a", 0xe40c ^ 0x292c},
+		{"foobar", 0xbf9c ^ 0xf968},
+	}
+
+	for _, tt := range tests {
+		if got := fnv1aHashPos([]byte(tt.in)); got != tt.want {
+			t.Errorf("fnv1aHashPos(%q) = %#x, want %#x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFNV1aNodeKey(t *testing.T) {
+	tests := []struct {
+		n    Node
+		i    int
+		want string
+	}{
+		{Node{IP: "127.0.0.1", Port: "2003"}, 0, "0-127.0.0.1:2003"},
+		{Node{IP: "127.0.0.1", Port: "2003", Instance: "a"}, 3, "3-a"},
+	}
+
+	for _, tt := range tests {
+		if got := fnv1aNodeKey(tt.n, tt.i); got != tt.want {
+			t.Errorf("fnv1aNodeKey(%+v, %d) = %q, want %q", tt.n, tt.i, got, tt.want)
+		}
+	}
+}
+
+func TestFNV1aSignExtend(t *testing.T) {
+	// carbon-c-relay hashes "é" (0xc3 0xa9) as the
+	// sign-extended 0xffffffc3 and 0xffffffa9.
+	h := uint32(fnv32Offset)
+	for _, c := range []uint32{0xffffffc3, 0xffffffa9} {
+		h = (h ^ c) * fnv32Prime
+	}
+	if got := FNV1a32([]byte("é")); got != h {
+		t.Errorf("FNV1a32(\"é\") = %#x, want %#x", got, h)
+	}
+
+	h64 := uint64(fnv64Offset)
+	for _, c := range []uint64{0xffffffffffffffc3, 0xffffffffffffffa9} {
+		h64 = (h64 ^ c) * fnv64Prime
+	}
+	if got := fnv1a64([]byte("é")); got != h64 {
+		t.Errorf("fnv1a64(\"é\") = %#x, want %#x", got, h64)
+	}
+}
+
+func TestFNV1a32Allocs(t *testing.T) {
+	key := []byte("servers.web01.cpu.load")
+
+	if allocs := testing.AllocsPerRun(100, func() { FNV1a32(key) }); allocs != 0 {
+		t.Errorf("FNV1a32 allocated %g times", allocs)
+	}
+}
@@ -0,0 +1,105 @@
+// Package consistenthash jump.go implements
+// the carbon-c-relay jump_fnv1a_ch algorithm.
+package consistenthash
+
+import (
+	"errors"
+	"sort"
+)
+
+// JumpRing implements the jump consistent hash
+// (Lamping & Veach) over the 64 bit FNV-1a hash
+// of a key. Nodes are used as buckets ordered
+// by instance name, falling back to ip:port if the
+// node has no instance; this is the ordering used by
+// carbon-c-relay, so all relays must be configured with
+// the same set of destinations to agree on placement.
+// A weighted node occupies as many adjacent buckets as
+// its weight.
+type JumpRing struct {
+	buckets jumpBuckets
+}
+
+// jumpBucket is a JumpRing member. The sort
+// key is the instance name or ip:port.
+type jumpBucket struct {
+	key  string
+	name string
+}
+
+type jumpBuckets []*jumpBucket
+
+func (b jumpBuckets) Len() int {
+	return len(b)
+}
+
+func (b jumpBuckets) Less(i, j int) bool {
+	return b[i].key < b[j].key
+}
+
+func (b jumpBuckets) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+// AddNode adds n as a bucket.
+func (r *JumpRing) AddNode(n Node) {
+	key := n.Instance
+	if key == "" {
+		key = n.IP + ":" + n.Port
+	}
+
+	for i := 0; i < n.replicas(); i++ {
+		r.buckets = append(r.buckets, &jumpBucket{key: key, name: n.Name})
+	}
+	sort.Stable(r.buckets)
+}
+
+// RemoveNode drops a node from the ring.
+func (r *JumpRing) RemoveNode(name string) {
+	newBuckets := jumpBuckets{}
+	for _, b := range r.buckets {
+		if b.name != name {
+			newBuckets = append(newBuckets, b)
+		}
+	}
+
+	r.buckets = newBuckets
+}
+
+// GetNode takes a key and returns the
+// destination node name.
+func (r *JumpRing) GetNode(k []byte) (string, error) {
+	if len(r.buckets) == 0 {
+		return "", errors.New("Hash ring is empty")
+	}
+
+	return r.buckets[jumpHash(fnv1a64(k), len(r.buckets))].name, nil
+}
+
+// Shares returns the fraction of
+// buckets owned by each node.
+func (r *JumpRing) Shares() map[string]float64 {
+	shares := make(map[string]float64)
+	for _, b := range r.buckets {
+		shares[b.name] += 1 / float64(len(r.buckets))
+	}
+
+	return shares
+}
+
+// jumpHash returns the bucket for key
+// in the range [0, buckets). This follows the
+// reference implementation from "A Fast, Minimal
+// Memory, Consistent Hash Algorithm" (Lamping, Veach),
+// including its use of floating point division.
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+
+	return int(b)
+}
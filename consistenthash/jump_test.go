@@ -0,0 +1,68 @@
+package consistenthash
+
+import "testing"
+
+// Vectors from the reference implementation
+// in "A Fast, Minimal Memory, Consistent Hash
+// Algorithm" (Lamping, Veach).
+func TestJumpHash(t *testing.T) {
+	tests := []struct {
+		key     uint64
+		buckets int
+		want    int
+	}{
+		{1, 1, 0},
+		{42, 57, 43},
+		{0xDEAD10CC, 1, 0},
+		{0xDEAD10CC, 666, 361},
+		{256, 1024, 520},
+	}
+
+	for _, tt := range tests {
+		if got := jumpHash(tt.key, tt.buckets); got != tt.want {
+			t.Errorf("jumpHash(%#x, %d) = %d, want %d", tt.key, tt.buckets, got, tt.want)
+		}
+	}
+}
+
+func TestJumpRingOrder(t *testing.T) {
+	// Buckets are ordered by instance, not by
+	// the order nodes are added.
+	a, b := &JumpRing{}, &JumpRing{}
+	for _, inst := range []string{"c", "a", "b"} {
+		a.AddNode(Node{IP: "127.0.0.1", Port: "2003", Instance: inst, Name: inst})
+	}
+	for _, inst := range []string{"a", "b", "c"} {
+		b.AddNode(Node{IP: "127.0.0.1", Port: "2003", Instance: inst, Name: inst})
+	}
+
+	for _, k := range []string{"a.b.c", "servers.web01.cpu", "x"} {
+		na, _ := a.GetNode([]byte(k))
+		nb, _ := b.GetNode([]byte(k))
+		if na != nb {
+			t.Errorf("GetNode(%q): %s != %s", k, na, nb)
+		}
+	}
+}
+
+func TestJumpRingEmpty(t *testing.T) {
+	r := &JumpRing{}
+	if _, err := r.GetNode([]byte("a")); err == nil {
+		t.Error("expected an error from an empty ring")
+	}
+}
+
+func TestJumpRingFNV1a(t *testing.T) {
+	// Keys are hashed with 64 bit FNV-1a;
+	// "foobar" is 0x85944171f73967e8.
+	names := []string{"a", "b", "c", "d", "e"}
+	r := &JumpRing{}
+	for _, n := range names {
+		r.AddNode(Node{Instance: n, Name: n})
+	}
+
+	want := names[jumpHash(0x85944171f73967e8, len(names))]
+	if got, _ := r.GetNode([]byte("foobar")); got != want {
+		t.Errorf("GetNode(\"foobar\") = %s, want %s", got, want)
+	}
+}
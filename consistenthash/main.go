@@ -3,6 +3,10 @@
 // algorithm. Givn the same settings (e.g. vnodes),
 // consistenthash will yield the same node by name
 // for a given key as you'd observe in carbon-relay.
+//
+// The carbon-c-relay fnv1a_ch and jump_fnv1a_ch
+// algorithms are also implemented so that Polymur
+// can be dropped into a carbon-c-relay tier.
 package consistenthash
 
 import (
@@ -10,17 +14,92 @@ import (
 	"errors"
 	"fmt"
 	"sort"
-	"strconv"
-	"sync"
 )
 
+// Supported hashing algorithms.
+const (
+	CarbonCH    = "carbon_ch"
+	FNV1aCH     = "fnv1a_ch"
+	JumpFNV1aCH = "jump_fnv1a_ch"
+)
+
+// Ring is a consistent-hash ring that maps
+// keys (metric names) to node names. Rings aren't
+// safe for concurrent modification; GetNode and
+// Shares are safe for concurrent use on a ring that
+// is no longer modified.
+type Ring interface {
+	// AddNode inserts a node into the ring.
+	AddNode(n Node)
+	// RemoveNode drops a node from the ring by name.
+	RemoveNode(name string)
+	// GetNode returns the node name responsible for key k.
+	GetNode(k []byte) (string, error)
+	// Shares returns the fraction of the key space
+	// owned by each node, by node name.
+	Shares() map[string]float64
+}
+
+// Node is a ring member. IP, Port and Instance
+// are used to build the node's ring key in the
+// same fashion as the reference implementation
+// for the respective algorithm. Name references
+// the node's string name in a polymur connection pool.
+// Weight scales the node's share of the ring; a weight
+// of 0 is treated as 1.
+type Node struct {
+	IP       string
+	Port     string
+	Instance string
+	Name     string
+	Weight   int
+}
+
+// replicas returns the node's weight
+// as a multiplier.
+func (n Node) replicas() int {
+	if n.Weight < 1 {
+		return 1
+	}
+	return n.Weight
+}
+
+// New returns a Ring implementing
+// the named algorithm.
+func New(algorithm string, vnodes int) (Ring, error) {
+	switch algorithm {
+	case CarbonCH, "":
+		return &HashRing{Vnodes: vnodes}, nil
+	case FNV1aCH:
+		return &HashRing{
+			Vnodes:  vnodes,
+			hashPos: fnv1aHashPos,
+			nodeKey: fnv1aNodeKey,
+		}, nil
+	case JumpFNV1aCH:
+		return &JumpRing{}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown hash algorithm: %s", algorithm)
+}
+
+// ringSize is the number of positions on
+// a HashRing; hash keys are 16 bit values.
+const ringSize = 1 << 16
+
 // HashRing implmenents a consistent-hash
 // ring with a configurable number of vnodes
 // that are mapped to a list of real nodes.
+// The zero value hashes with carbon_ch; rings
+// for other algorithms are initialized with New.
 type HashRing struct {
-	sync.RWMutex
 	Vnodes int
 	nodes  nodeList
+	// hashPos returns the ring position for a key.
+	hashPos func([]byte) int
+	// nodeKey returns the string hashed
+	// for vnode i of a Node.
+	nodeKey func(Node, int) string
 }
 
 // node is used to reference a nodeName
@@ -52,31 +131,23 @@ func (n nodeList) Swap(i, j int) {
 
 // Hash ring operations.
 
-// AddNode takes a node keyname and name.
-// The name will populate the node.nodeName field,
-// but we pass an explicit keyname value so that
-// the hashing function is using the same naming convention
-// as the consistent hashing implementation in Graphite.
-// The Graphite project hashes nodes using the
-// following format: "('127.0.0.1', 'a'):0".
-func (h *HashRing) AddNode(keyname, name string) {
-	h.Lock()
-
-	for i := 0; i < h.Vnodes; i++ {
-		nodeName := fmt.Sprintf("%s:%d", keyname, i)
-		key := getHashKey(nodeName)
-		h.nodes = append(h.nodes, &node{nodeID: key, nodeName: name})
+// AddNode adds Vnodes positions (multiplied by the
+// node weight) for the node n. Each vnode position is
+// the hash of the node key and the vnode index. For
+// carbon_ch, the node key follows the Graphite project's
+// format: "('127.0.0.1', 'a'):0". Nodes with a weight of 1
+// are placed exactly as the reference implementations would.
+func (h *HashRing) AddNode(n Node) {
+	for i := 0; i < h.Vnodes*n.replicas(); i++ {
+		key := h.position([]byte(h.vnodeKey(n, i)))
+		h.nodes = append(h.nodes, &node{nodeID: key, nodeName: n.Name})
 	}
 
 	sort.Sort(h.nodes)
-
-	h.Unlock()
 }
 
 // RemoveNode drops a node from the hash ring.
 func (h *HashRing) RemoveNode(name string) {
-	h.Lock()
-
 	newNodes := []*node{}
 	for _, n := range h.nodes {
 		if n.nodeName != name {
@@ -85,39 +156,73 @@ func (h *HashRing) RemoveNode(name string) {
 	}
 
 	h.nodes = newNodes
-
-	h.Unlock()
 }
 
 // GetNode takes a key and returns the
 // destination nodeName from the ring.
-func (h *HashRing) GetNode(k string) (string, error) {
+func (h *HashRing) GetNode(k []byte) (string, error) {
 	if len(h.nodes) == 0 {
 		return "", errors.New("Hash ring is empty")
 	}
 
-	h.RLock()
-
 	// Hash the reference key.
-	hk := getHashKey(k)
+	hk := h.position(k)
 
 	// Get index in the ring.
 	i := sort.Search(len(h.nodes), func(i int) bool { return h.nodes[i].nodeID >= hk }) % len(h.nodes)
 
-	node := h.nodes[i].nodeName
+	return h.nodes[i].nodeName, nil
+}
+
+// Shares returns the fraction of the ring
+// owned by each node. A vnode owns the arc between
+// the preceding vnode position and its own.
+func (h *HashRing) Shares() map[string]float64 {
+	shares := make(map[string]float64)
+	if len(h.nodes) == 0 {
+		return shares
+	}
 
-	h.RUnlock()
+	prev := h.nodes[len(h.nodes)-1].nodeID - ringSize
+	for _, n := range h.nodes {
+		shares[n.nodeName] += float64(n.nodeID-prev) / ringSize
+		prev = n.nodeID
+	}
 
-	return node, nil
+	return shares
 }
 
-// getKey takes an input string (e.g. a metric or node name)
-// and returns a hash key.
-func getHashKey(s string) int {
-	bigHash := md5.Sum([]byte(s))
-	smallHash := fmt.Sprintf("%x", bigHash[:2])
+// position returns the ring position for s
+// using the ring's hash function.
+func (h *HashRing) position(s []byte) int {
+	if h.hashPos == nil {
+		return getHashKey(s)
+	}
+	return h.hashPos(s)
+}
+
+// vnodeKey returns the string hashed
+// for vnode i of node n.
+func (h *HashRing) vnodeKey(n Node, i int) string {
+	if h.nodeKey == nil {
+		return carbonNodeKey(n, i)
+	}
+	return h.nodeKey(n, i)
+}
+
+// carbonNodeKey replicates the destination key setup in
+// the carbon-cache implementation. It's a string composed of the
+// (destination IP, instance) tuple and the vnode index.
+// E.g. "('127.0.0.1', 'a'):0"
+func carbonNodeKey(n Node, i int) string {
+	return fmt.Sprintf("('%s', '%s'):%d", n.IP, n.Instance, i)
+}
 
-	k, _ := strconv.ParseInt(smallHash, 16, 32)
+// getKey takes an input string (e.g. a metric or node name)
+// and returns a hash key: the first two bytes of its MD5
+// sum as a big-endian integer.
+func getHashKey(s []byte) int {
+	bigHash := md5.Sum(s)
 
-	return int(k)
+	return int(bigHash[0])<<8 | int(bigHash[1])
 }
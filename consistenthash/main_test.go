@@ -0,0 +1,88 @@
+package consistenthash
+
+import "testing"
+
+// Expected positions are the first two bytes of
+// the published MD5 vectors: "" is d41d8cd9...,
+// "a" is 0cc175b9... and "abc" is 90015098....
+func TestGetHashKey(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0xd41d},
+		{"a", 0x0cc1},
+		{"abc", 0x9001},
+	}
+
+	for _, tt := range tests {
+		if got := getHashKey([]byte(tt.in)); got != tt.want {
+			t.Errorf("getHashKey(%q) = %#x, want %#x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestGetNodeAllocs(t *testing.T) {
+	key := []byte("servers.web01.cpu.load")
+
+	for _, algorithm := range []string{CarbonCH, FNV1aCH, JumpFNV1aCH} {
+		r, _ := New(algorithm, 100)
+		r.AddNode(Node{IP: "127.0.0.1", Port: "2003", Instance: "a", Name: "a"})
+		r.AddNode(Node{IP: "127.0.0.1", Port: "2004", Instance: "b", Name: "b"})
+
+		allocs := testing.AllocsPerRun(100, func() {
+			r.GetNode(key)
+		})
+		if allocs != 0 {
+			t.Errorf("%s: GetNode allocated %g times", algorithm, allocs)
+		}
+	}
+}
+
+// Placement vectors were generated with a C transcription
+// of the fnv1a_hashpos, fnv1a_hash64 and jump_bucketpos
+// routines and the ring setup from carbon-c-relay's
+// consistent-hash.c, built with gcc on x86_64 (signed char),
+// using 100 replicas. Keys with bytes >= 0x80 catch a
+// divergence in how bytes are extended before hashing.
+func TestPlacement(t *testing.T) {
+	nodes := []Node{
+		{IP: "10.0.0.1", Port: "2003", Name: "10.0.0.1:2003"},
+		{IP: "10.0.0.2", Port: "2003", Name: "10.0.0.2:2003"},
+		{IP: "10.0.0.3", Port: "2004", Name: "10.0.0.3:2004"},
+		{IP: "10.0.0.4", Port: "2003", Instance: "d", Name: "10.0.0.4:2003:d"},
+	}
+
+	tests := []struct {
+		key   string
+		fnv1a int
+		jump  int
+	}{
+		{"servers.web01.cpu.load", 2, 0},
+		{"servers.web02.cpu.load", 2, 2},
+		{"stats.api.requests", 0, 3},
+		{"collectd.db01.memory.used", 1, 2},
+		{"a", 0, 2},
+		{"carbon.agents.relay01.metricsReceived", 1, 1},
+		{"sérvers.café.load", 2, 1},
+		{"métrique.€", 0, 3},
+	}
+
+	for _, algorithm := range []string{FNV1aCH, JumpFNV1aCH} {
+		r, _ := New(algorithm, 100)
+		for _, n := range nodes {
+			r.AddNode(n)
+		}
+
+		for _, tt := range tests {
+			want := nodes[tt.fnv1a].Name
+			if algorithm == JumpFNV1aCH {
+				want = nodes[tt.jump].Name
+			}
+
+			if got, _ := r.GetNode([]byte(tt.key)); got != want {
+				t.Errorf("%s: GetNode(%q) = %s, want %s", algorithm, tt.key, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+// Package discovery consul.go implements
+// Consul service destination discovery.
+package discovery
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jamiealquiza/consul/api"
+)
+
+// consulWait is the max time a
+// blocking query waits for changes.
+const consulWait = 5 * time.Minute
+
+// Consul discovers destinations from the healthy
+// instances of a Consul service. Each call blocks
+// until the service instances change (or consulWait
+// elapses). The carbon instance of each service instance
+// is read from the service meta key instanceMeta, so that
+// destinations take the form ip:port:instance.
+type Consul struct {
+	service      string
+	tag          string
+	instanceMeta string
+	health       *api.Health
+	opts         api.QueryOptions
+	index        uint64
+}
+
+// NewConsul initializes a *Consul provider for the
+// service instances with tag (if set) in datacenter (if
+// set), using the Consul agent at address (if set, otherwise
+// the Consul client default). If instanceMeta is empty,
+// the "instance" meta key is used.
+func NewConsul(service, tag, datacenter, address, instanceMeta string) (*Consul, error) {
+	config := api.DefaultConfig()
+	if address != "" {
+		config.Address = address
+	}
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if instanceMeta == "" {
+		instanceMeta = "instance"
+	}
+
+	return &Consul{
+		service:      service,
+		tag:          tag,
+		instanceMeta: instanceMeta,
+		health:       client.Health(),
+		opts: api.QueryOptions{
+			Datacenter: datacenter,
+			WaitTime:   consulWait,
+		},
+	}, nil
+}
+
+// Source returns the provider source name.
+func (c *Consul) Source() string {
+	return "consul:" + c.service
+}
+
+// Destinations returns the destinations of the
+// service instances passing their health checks.
+func (c *Consul) Destinations() ([]string, error) {
+	opts := c.opts
+	opts.WaitIndex = c.index
+
+	entries, meta, err := c.health.Service(c.service, c.tag, true, &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// The index is reset if it goes backwards,
+	// e.g. following a Consul server restore.
+	if meta.LastIndex < c.index {
+		c.index = 0
+	} else {
+		c.index = meta.LastIndex
+	}
+
+	dests := []string{}
+	for _, e := range entries {
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+
+		dest := net.JoinHostPort(addr, strconv.Itoa(e.Service.Port))
+		if instance := e.Service.Meta[c.instanceMeta]; instance != "" {
+			dest += ":" + instance
+		}
+
+		dests = append(dests, dest)
+	}
+
+	return dests, nil
+}
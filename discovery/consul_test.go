@@ -0,0 +1,200 @@
+package discovery
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/consul/api"
+)
+
+// fakeConsul serves the health service endpoint of
+// a Consul agent. Blocking queries with the current
+// index wait until the service changes.
+type fakeConsul struct {
+	sync.Mutex
+	index   uint64
+	entries []*api.ServiceEntry
+	changed chan struct{}
+	// queries holds the query
+	// string of each request.
+	queries []string
+}
+
+func newFakeConsul() *fakeConsul {
+	return &fakeConsul{changed: make(chan struct{})}
+}
+
+// set updates the service entries and index,
+// waking any blocked queries.
+func (f *fakeConsul) set(index uint64, entries ...*api.ServiceEntry) {
+	f.Lock()
+	f.index, f.entries = index, entries
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.Unlock()
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/carbon" {
+		http.NotFound(w, r)
+		return
+	}
+
+	f.Lock()
+	f.queries = append(f.queries, r.URL.RawQuery)
+	changed := f.changed
+	if idx, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64); idx > 0 && idx == f.index {
+		f.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(5 * time.Second):
+		}
+		f.Lock()
+	}
+	index, entries := f.index, f.entries
+	f.Unlock()
+
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(index, 10))
+	w.Header().Set("X-Consul-KnownLeader", "true")
+	w.Header().Set("X-Consul-LastContact", "0")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// query returns the nth request's query values.
+func (f *fakeConsul) query(t *testing.T, n int) url.Values {
+	f.Lock()
+	defer f.Unlock()
+
+	if n >= len(f.queries) {
+		t.Fatalf("request %d not made", n)
+	}
+
+	q, err := url.ParseQuery(f.queries[n])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+func entry(node, addr string, port int, instance string) *api.ServiceEntry {
+	return &api.ServiceEntry{
+		Node: &api.Node{Node: node, Address: node},
+		Service: &api.AgentService{
+			Service: "carbon",
+			Address: addr,
+			Port:    port,
+			Meta:    map[string]string{"instance": instance},
+		},
+	}
+}
+
+func TestConsulDestinations(t *testing.T) {
+	f := newFakeConsul()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c, err := NewConsul("carbon", "relay", "dc2", strings.TrimPrefix(srv.URL, "http://"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The service address is used if set,
+	// otherwise the node address.
+	f.set(10, entry("10.0.0.1", "", 2003, "a"), entry("10.0.0.9", "10.0.0.2", 2004, ""))
+
+	got, err := c.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:2003:a", "10.0.0.2:2004"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	q := f.query(t, 0)
+	if q.Get("index") != "" {
+		t.Errorf("first query has index %s, want none", q.Get("index"))
+	}
+	if q.Get("tag") != "relay" || q.Get("dc") != "dc2" || q.Get("passing") != "1" {
+		t.Errorf("unexpected query %v", q)
+	}
+}
+
+func TestConsulBlockingQuery(t *testing.T) {
+	f := newFakeConsul()
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c, err := NewConsul("carbon", "", "", strings.TrimPrefix(srv.URL, "http://"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.set(10, entry("10.0.0.1", "", 2003, "a"))
+	if _, err := c.Destinations(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The next query passes the last index
+	// and blocks until the service changes.
+	done := make(chan []string)
+	go func() {
+		dests, err := c.Destinations()
+		if err != nil {
+			t.Error(err)
+		}
+		done <- dests
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("query returned before the service changed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	f.set(12, entry("10.0.0.1", "", 2003, "a"), entry("10.0.0.2", "", 2003, "b"))
+
+	want := []string{"10.0.0.1:2003:a", "10.0.0.2:2003:b"}
+	select {
+	case got := <-done:
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("query didn't return after the service changed")
+	}
+
+	if q := f.query(t, 1); q.Get("index") != "10" {
+		t.Errorf("second query has index %s, want 10", q.Get("index"))
+	}
+
+	// An index that goes backwards resets the
+	// index, so the next query doesn't block.
+	f.set(5, entry("10.0.0.3", "", 2003, "c"))
+	if _, err := c.Destinations(); err != nil {
+		t.Fatal(err)
+	}
+	if q := f.query(t, 2); q.Get("index") != "12" {
+		t.Errorf("third query has index %s, want 12", q.Get("index"))
+	}
+
+	got, err := c.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"10.0.0.3:2003:c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after reset: got %v, want %v", got, want)
+	}
+	if q := f.query(t, 3); q.Get("index") != "" {
+		t.Errorf("query after reset has index %s, want none", q.Get("index"))
+	}
+}
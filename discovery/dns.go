@@ -0,0 +1,125 @@
+// Package discovery dns.go implements
+// DNS-based destination discovery.
+package discovery
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// dnsTimeout is the max time for a lookup.
+const dnsTimeout = 10 * time.Second
+
+// resolver looks up DNS records. It's
+// satisfied by *net.Resolver.
+type resolver interface {
+	LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// DNS discovers destinations from DNS records.
+// With SRV records, each target is resolved to its
+// addresses, each a destination on the target port.
+// With A/AAAA records, each address is a destination
+// on the configured port.
+type DNS struct {
+	kind     string
+	name     string
+	port     string
+	resolver resolver
+}
+
+// NewDNS initializes a *DNS provider. kind is
+// "dns-srv" or "dns-a"; for "dns-a", target takes
+// the form name:port. If server is set, lookups
+// are sent to the DNS server at that address rather
+// than the system resolver.
+func NewDNS(kind, target, server string) (*DNS, error) {
+	d := &DNS{kind: kind, name: target, resolver: net.DefaultResolver}
+
+	if kind == "dns-a" {
+		host, port, err := net.SplitHostPort(target)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := strconv.Atoi(port); err != nil {
+			return nil, errors.New("port must be numeric")
+		}
+		d.name, d.port = host, port
+	}
+
+	if server != "" {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			return nil, err
+		}
+
+		d.resolver = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, server)
+			},
+		}
+	}
+
+	return d, nil
+}
+
+// Source returns the provider source name.
+func (d *DNS) Source() string {
+	if d.kind == "dns-a" {
+		return d.kind + ":" + net.JoinHostPort(d.name, d.port)
+	}
+
+	return d.kind + ":" + d.name
+}
+
+// Destinations returns the destinations
+// currently resolved from DNS.
+func (d *DNS) Destinations() ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), dnsTimeout)
+	defer cancel()
+
+	if d.kind == "dns-a" {
+		return d.lookupHost(ctx, d.name, d.port)
+	}
+
+	// The SRV name is looked up as is
+	// rather than built from service,
+	// proto and name.
+	_, srvs, err := d.resolver.LookupSRV(ctx, "", "", d.name)
+	if err != nil {
+		return nil, err
+	}
+
+	dests := []string{}
+	for _, srv := range srvs {
+		addrs, err := d.lookupHost(ctx, strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port)))
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, addrs...)
+	}
+
+	return dests, nil
+}
+
+// lookupHost returns a destination on
+// port for each address of host.
+func (d *DNS) lookupHost(ctx context.Context, host, port string) ([]string, error) {
+	addrs, err := d.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	dests := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		dests = append(dests, net.JoinHostPort(addr, port))
+	}
+
+	return dests, nil
+}
@@ -0,0 +1,255 @@
+package discovery
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// stubResolver answers lookups from its
+// records rather than DNS.
+type stubResolver struct {
+	sync.Mutex
+	srv   map[string][]*net.SRV
+	hosts map[string][]string
+}
+
+func (r *stubResolver) LookupSRV(ctx context.Context, service, proto, name string) (string, []*net.SRV, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	srvs, ok := r.srv[name]
+	if !ok {
+		return "", nil, fmt.Errorf("no such host %s", name)
+	}
+
+	return name, srvs, nil
+}
+
+func (r *stubResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	addrs, ok := r.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+
+	return addrs, nil
+}
+
+func (r *stubResolver) setHosts(host string, addrs ...string) {
+	r.Lock()
+	r.hosts[host] = addrs
+	r.Unlock()
+}
+
+// nopWriter is a pool.Writer that does nothing.
+type nopWriter struct{}
+
+func (nopWriter) Start()                     {}
+func (nopWriter) Shutdown()                  {}
+func (nopWriter) Enqueue(*batch.Batch) bool  { return false }
+func (nopWriter) Health() pool.BreakerStatus { return pool.BreakerStatus{} }
+func (nopWriter) Stats() pool.ConnStatus     { return pool.ConnStatus{} }
+
+// testCluster returns a cluster whose writers register
+// their destination when created, counting the writers
+// created for each destination in added.
+func testCluster(t *testing.T) (*pool.Cluster, map[string]int) {
+	var mu sync.Mutex
+	added := make(map[string]int)
+
+	p := pool.NewPool()
+	p.SetWriter(func(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+		mu.Lock()
+		added[dest.Name]++
+		mu.Unlock()
+		c.Register(dest)
+		return nopWriter{}, nil
+	})
+
+	c, err := p.AddCluster(pool.ClusterConfig{
+		Name:          pool.DefaultCluster,
+		Distribution:  "broadcast",
+		HashAlgorithm: "carbon_ch",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, added
+}
+
+// registered returns the cluster's
+// registered destinations, sorted.
+func registered(c *pool.Cluster) []string {
+	c.RLock()
+	defer c.RUnlock()
+
+	names := []string{}
+	for name := range c.Registered {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func TestDNSDestinations(t *testing.T) {
+	r := &stubResolver{
+		srv: map[string][]*net.SRV{
+			"_carbon._tcp.example.com": {
+				{Target: "a.example.com.", Port: 2003},
+				{Target: "b.example.com.", Port: 2004},
+			},
+		},
+		hosts: map[string][]string{
+			"a.example.com": {"10.0.0.1", "10.0.0.2"},
+			"b.example.com": {"10.0.0.3"},
+		},
+	}
+
+	srv, err := NewDNS("dns-srv", "_carbon._tcp.example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.resolver = r
+
+	got, err := srv.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.1:2003", "10.0.0.2:2003", "10.0.0.3:2004"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dns-srv: got %v, want %v", got, want)
+	}
+
+	a, err := NewDNS("dns-a", "a.example.com:2005", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.resolver = r
+
+	got, err = a.Destinations()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"10.0.0.1:2005", "10.0.0.2:2005"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dns-a: got %v, want %v", got, want)
+	}
+
+	delete(r.hosts, "b.example.com")
+	if _, err := srv.Destinations(); err == nil {
+		t.Error("expected an error for a target that doesn't resolve")
+	}
+}
+
+func TestDNSReconcile(t *testing.T) {
+	r := &stubResolver{hosts: map[string][]string{}}
+	d, err := NewDNS("dns-a", "carbon.example.com:2003", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.resolver = r
+
+	c, added := testCluster(t)
+
+	// A destination from another source.
+	static, _ := pool.ParseDestination("10.0.1.1:2003")
+	if err := c.AddDestination(static); err != nil {
+		t.Fatal(err)
+	}
+
+	refresh := func() {
+		addrs, err := d.Destinations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reconcile(c, d.Source(), addrs)
+	}
+
+	// Adds.
+	r.setHosts("carbon.example.com", "10.0.0.1", "10.0.0.2")
+	refresh()
+	want := []string{"10.0.0.1:2003", "10.0.0.2:2003", "10.0.1.1:2003"}
+	if got := registered(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("after add: got %v, want %v", got, want)
+	}
+
+	// Unchanged records don't re-add destinations.
+	refresh()
+	if got := registered(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("after unchanged: got %v, want %v", got, want)
+	}
+	for _, name := range want {
+		if added[name] != 1 {
+			t.Errorf("%s added %d times, want 1", name, added[name])
+		}
+	}
+
+	// Removes, leaving the other source's destination.
+	r.setHosts("carbon.example.com", "10.0.0.2", "10.0.0.3")
+	refresh()
+	want = []string{"10.0.0.2:2003", "10.0.0.3:2003", "10.0.1.1:2003"}
+	if got := registered(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("after remove: got %v, want %v", got, want)
+	}
+}
+
+func TestDNSReconcileDraining(t *testing.T) {
+	r := &stubResolver{hosts: map[string][]string{}}
+	d, err := NewDNS("dns-a", "carbon.example.com:2003", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.resolver = r
+
+	c, _ := testCluster(t)
+
+	refresh := func() {
+		addrs, err := d.Destinations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reconcile(c, d.Source(), addrs)
+	}
+
+	r.setHosts("carbon.example.com", "10.0.0.1", "10.0.0.2")
+	refresh()
+
+	// Activate the destinations, as
+	// a connected writer would.
+	for _, name := range []string{"10.0.0.1:2003", "10.0.0.2:2003"} {
+		dest, _ := pool.ParseDestination(name)
+		c.AddConn(dest)
+	}
+
+	// The removed destination is drained, and
+	// stays registered across the next poll.
+	r.setHosts("carbon.example.com", "10.0.0.2")
+	refresh()
+	refresh()
+
+	if c.Draining("10.0.0.1:2003") == nil {
+		t.Error("expected 10.0.0.1:2003 to be draining")
+	}
+	want := []string{"10.0.0.1:2003", "10.0.0.2:2003"}
+	if got := registered(c); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
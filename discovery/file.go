@@ -0,0 +1,73 @@
+// Package discovery file.go implements
+// file-based destination discovery.
+package discovery
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// File discovers destinations listed in a file,
+// one destination per line. Blank lines and lines
+// starting with # are ignored. The file is only
+// re-read when its size or modification time changes.
+type File struct {
+	sync.Mutex
+	path    string
+	modTime time.Time
+	size    int64
+	dests   []string
+}
+
+// NewFile initializes a *File provider for path.
+func NewFile(path string) *File {
+	return &File{path: path}
+}
+
+// Source returns the provider source name.
+func (f *File) Source() string {
+	return "file:" + f.path
+}
+
+// Destinations returns the destinations
+// currently listed in the file.
+func (f *File) Destinations() ([]string, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.dests != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return f.dests, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	dests := []string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		dests = append(dests, line)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	f.dests, f.modTime, f.size = dests, info.ModTime(), info.Size()
+
+	return dests, nil
+}
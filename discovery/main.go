@@ -0,0 +1,196 @@
+// Package discovery reconciles cluster
+// destinations with destination discovery
+// providers.
+package discovery
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// Provider discovers a set of destinations.
+type Provider interface {
+	// Destinations returns the current destination
+	// strings, in the form taken by pool.ParseDestination.
+	// It may block until the destinations change.
+	Destinations() ([]string, error)
+	// Source returns the source name that
+	// discovered destinations are registered with.
+	Source() string
+}
+
+// Config holds a discovery provider and
+// the cluster it populates. The provider is
+// queried every Interval.
+type Config struct {
+	Cluster  string
+	Interval time.Duration
+	Provider Provider
+}
+
+// Parse takes a discovery list string and returns
+// a []Config. Providers are semicolon delimited and
+// take the form "provider:target[?option=value&...]".
+// Providers:
+// - file: destinations listed in a file, one per line.
+// - dns-srv: a DNS SRV record name.
+// - dns-a: a DNS A/AAAA record name and port (name:port).
+// - consul: a Consul service name.
+// Options:
+// - cluster: the cluster to populate (default cluster).
+// - interval: refresh interval (seconds); min for consul.
+// - resolver: DNS server (ip:port) for the DNS providers.
+// - tag, dc: Consul service tag and datacenter.
+// - address: Consul agent address (ip:port).
+// - instance-meta: Consul service meta key of the
+// carbon instance (default "instance").
+func Parse(s string) ([]Config, error) {
+	configs := []Config{}
+
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		target, opts := spec, ""
+		if i := strings.Index(spec, "?"); i >= 0 {
+			target, opts = spec[:i], spec[i+1:]
+		}
+
+		parts := strings.SplitN(target, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("Discovery %s not valid", spec)
+		}
+		kind, target := parts[0], parts[1]
+
+		params, err := url.ParseQuery(opts)
+		if err != nil {
+			return nil, fmt.Errorf("Discovery %s options not valid: %s", spec, err)
+		}
+
+		config := Config{Cluster: params.Get("cluster")}
+
+		if v := params.Get("interval"); v != "" {
+			secs, err := strconv.Atoi(v)
+			if err != nil || secs < 1 {
+				return nil, fmt.Errorf("Discovery %s: interval must be a positive integer", spec)
+			}
+			config.Interval = time.Duration(secs) * time.Second
+		}
+
+		switch kind {
+		case "file":
+			config.Provider = NewFile(target)
+			if config.Interval == 0 {
+				config.Interval = 5 * time.Second
+			}
+		case "dns-srv", "dns-a":
+			p, err := NewDNS(kind, target, params.Get("resolver"))
+			if err != nil {
+				return nil, fmt.Errorf("Discovery %s: %s", spec, err)
+			}
+			config.Provider = p
+			if config.Interval == 0 {
+				config.Interval = 30 * time.Second
+			}
+		case "consul":
+			p, err := NewConsul(target, params.Get("tag"), params.Get("dc"), params.Get("address"), params.Get("instance-meta"))
+			if err != nil {
+				return nil, fmt.Errorf("Discovery %s: %s", spec, err)
+			}
+			config.Provider = p
+			if config.Interval == 0 {
+				config.Interval = time.Second
+			}
+		default:
+			return nil, fmt.Errorf("Discovery %s: unknown provider %s", spec, kind)
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs, nil
+}
+
+// Run reconciles the cluster's destinations with
+// the provider every config.Interval. If the provider
+// returns an error, the destinations are left unchanged.
+func Run(c *pool.Cluster, config Config) {
+	source := config.Provider.Source()
+	log.Printf("Destination discovery started: %s%s\n", source, c.LogSuffix())
+
+	for {
+		addrs, err := config.Provider.Destinations()
+		if err != nil {
+			log.Printf("Destination discovery error (%s)%s: %s\n", source, c.LogSuffix(), err)
+		} else {
+			reconcile(c, source, addrs)
+		}
+
+		time.Sleep(config.Interval)
+	}
+}
+
+// reconcile adds discovered destinations that aren't
+// registered with the cluster and removes destinations
+// registered from source that are no longer discovered.
+// Destinations registered from other sources are left
+// as is. Destinations are added and drained the same
+// way as with the API.
+func reconcile(c *pool.Cluster, source string, addrs []string) {
+	discovered := make(map[string]pool.Destination)
+	for _, addr := range addrs {
+		dest, err := pool.ParseDestination(addr)
+		if err != nil {
+			log.Printf("Discovered destination %s%s not added: %s\n", addr, c.LogSuffix(), err)
+			continue
+		}
+		dest.Source = source
+		discovered[dest.Name] = dest
+	}
+
+	// Destinations with a writer yet to
+	// register them are also skipped.
+	registered := make(map[string]string)
+	c.RLock()
+	for k := range c.Writers {
+		registered[k] = ""
+	}
+	for k, v := range c.Sources {
+		registered[k] = v
+	}
+	c.RUnlock()
+
+	for name, dest := range discovered {
+		if _, exists := registered[name]; !exists {
+			if err := c.AddDestination(dest); err != nil {
+				log.Printf("%s%s\n", err, c.LogSuffix())
+			}
+		}
+	}
+
+	for name, s := range registered {
+		if _, exists := discovered[name]; exists || s != source {
+			continue
+		}
+
+		// A destination removed by a prior
+		// poll is left to finish draining.
+		if c.Draining(name) != nil {
+			continue
+		}
+
+		dest, err := pool.ParseDestination(name)
+		if err != nil {
+			continue
+		}
+		c.Drain(dest, c.DrainTimeout)
+	}
+}
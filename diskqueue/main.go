@@ -0,0 +1,461 @@
+// Package diskqueue implements an on-disk
+// FIFO queue of datapoints. A queue is a directory
+// of append-only segment files that are read in
+// order and removed once consumed, allowing queued
+// datapoints to survive process restarts.
+package diskqueue
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrFull is returned by Put when
+	// the queue is at its max size.
+	ErrFull = errors.New("Disk queue is full")
+	// ErrClosed is returned for operations
+	// on a closed queue.
+	ErrClosed = errors.New("Disk queue is closed")
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	// Persist the read position
+	// every cursorInterval reads.
+	cursorInterval = 1000
+)
+
+// Config holds disk queue configuration.
+// MaxSize is the max bytes on disk (0 is unlimited).
+// Segments older than MaxAge are discarded (0 is unlimited).
+// SegmentSize is the size at which a new segment file
+// is started. Expired, if set, is called with the number
+// of unread datapoints discarded with expired segments.
+type Config struct {
+	Dir         string
+	MaxSize     int64
+	MaxAge      time.Duration
+	SegmentSize int64
+	Expired     func(n int)
+}
+
+// Queue is an on-disk FIFO queue.
+// Delivery is at-least-once: the read position
+// is persisted periodically, so datapoints read since
+// the last persisted position are replayed after a restart.
+type Queue struct {
+	sync.Mutex
+	config   Config
+	segments []*segment
+	size     int64
+	closed   bool
+
+	// Current write segment.
+	writer *os.File
+	// Current read segment.
+	reader  *bufio.Reader
+	rfile   *os.File
+	roffset int64
+	reads   int
+}
+
+// segment is a segment file.
+type segment struct {
+	id       uint64
+	path     string
+	size     int64
+	modified time.Time
+}
+
+// Open opens the queue in config.Dir,
+// creating it if it doesn't exist. Existing
+// segments are loaded for reading.
+func Open(config Config) (*Queue, error) {
+	if config.SegmentSize <= 0 {
+		config.SegmentSize = 8 << 20
+	}
+
+	if err := os.MkdirAll(config.Dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{config: config}
+
+	files, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), segmentExt) {
+			continue
+		}
+
+		id, err := strconv.ParseUint(strings.TrimSuffix(f.Name(), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		q.segments = append(q.segments, &segment{
+			id:       id,
+			path:     filepath.Join(config.Dir, f.Name()),
+			size:     f.Size(),
+			modified: f.ModTime(),
+		})
+		q.size += f.Size()
+	}
+
+	sort.Slice(q.segments, func(i, j int) bool {
+		return q.segments[i].id < q.segments[j].id
+	})
+
+	// Resume from the persisted read position
+	// in the oldest segment.
+	if len(q.segments) > 0 {
+		q.roffset = q.loadCursor(q.segments[0].id)
+	}
+
+	return q, nil
+}
+
+// Put appends the datapoint m to the queue.
+func (q *Queue) Put(m string) error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	q.expire()
+
+	if q.config.MaxSize > 0 && q.size+int64(len(m)+1) > q.config.MaxSize {
+		return ErrFull
+	}
+
+	return q.write([]byte(m + "\n"))
+}
+
+// PutBatch appends the LF delimited datapoints p
+// to the queue in a single write. Returns the number
+// of datapoints written; if the queue is at its max
+// size, only the datapoints that fit are written
+// and ErrFull is returned.
+func (q *Queue) PutBatch(p []byte) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return 0, ErrClosed
+	}
+
+	q.expire()
+
+	var err error
+	if q.config.MaxSize > 0 && q.size+int64(len(p)) > q.config.MaxSize {
+		avail := q.config.MaxSize - q.size
+		if avail < 0 {
+			avail = 0
+		}
+		p, err = p[:bytes.LastIndexByte(p[:avail], '\n')+1], ErrFull
+	}
+
+	if len(p) == 0 {
+		return 0, err
+	}
+
+	if werr := q.write(p); werr != nil {
+		return 0, werr
+	}
+
+	return bytes.Count(p, []byte{'\n'}), err
+}
+
+// write appends the LF terminated datapoints
+// p to the current write segment.
+func (q *Queue) write(p []byte) error {
+	// Start a new segment if there's no open write segment
+	// or the current one is at the segment size threshold.
+	var last *segment
+	if len(q.segments) > 0 {
+		last = q.segments[len(q.segments)-1]
+	}
+
+	if q.writer == nil || last == nil || last.size >= q.config.SegmentSize {
+		if err := q.newSegment(); err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	if _, err := q.writer.Write(p); err != nil {
+		return err
+	}
+
+	n := int64(len(p))
+	last.size += n
+	last.modified = time.Now()
+	q.size += n
+
+	return nil
+}
+
+// Get pops the oldest datapoint from the queue.
+// The bool is false if the queue is empty.
+func (q *Queue) Get() (string, bool, error) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return "", false, ErrClosed
+	}
+
+	q.expire()
+
+	for len(q.segments) > 0 {
+		seg := q.segments[0]
+
+		if q.reader == nil {
+			f, err := os.Open(seg.path)
+			if err != nil {
+				return "", false, err
+			}
+			if _, err := f.Seek(q.roffset, io.SeekStart); err != nil {
+				f.Close()
+				return "", false, err
+			}
+			q.rfile, q.reader = f, bufio.NewReader(f)
+		}
+
+		l, err := q.reader.ReadString('\n')
+		if err == nil {
+			q.roffset += int64(len(l))
+			q.reads++
+			if q.reads%cursorInterval == 0 {
+				q.saveCursor(seg.id)
+			}
+			return l[:len(l)-1], true, nil
+		}
+
+		if err == io.EOF {
+			// The last segment may still be written to;
+			// the queue is empty for now.
+			if len(q.segments) == 1 {
+				q.closeReader()
+				return "", false, nil
+			}
+			// The segment is consumed. Any partial line
+			// (e.g. from a crash mid-write) is discarded.
+			q.dropSegment()
+			continue
+		}
+
+		return "", false, err
+	}
+
+	return "", false, nil
+}
+
+// Empty returns whether the queue
+// has no unread datapoints.
+func (q *Queue) Empty() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	if len(q.segments) == 0 {
+		return true
+	}
+
+	return len(q.segments) == 1 && q.roffset >= q.segments[0].size
+}
+
+// Size returns the bytes of unread
+// datapoints in the queue.
+func (q *Queue) Size() int64 {
+	q.Lock()
+	defer q.Unlock()
+
+	return q.size - q.roffset
+}
+
+// Close persists the read position
+// and closes any open segment files.
+func (q *Queue) Close() error {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.closed {
+		return nil
+	}
+
+	q.closed = true
+
+	if len(q.segments) > 0 {
+		q.saveCursor(q.segments[0].id)
+	}
+
+	q.closeReader()
+
+	if q.writer != nil {
+		return q.writer.Close()
+	}
+
+	return nil
+}
+
+// Purge closes the queue and removes
+// its directory and all queued datapoints.
+func (q *Queue) Purge() error {
+	q.Close()
+
+	q.Lock()
+	defer q.Unlock()
+
+	q.segments, q.size = nil, 0
+
+	return os.RemoveAll(q.config.Dir)
+}
+
+// newSegment closes the current write
+// segment and opens a new one.
+func (q *Queue) newSegment() error {
+	if q.writer != nil {
+		q.writer.Close()
+	}
+
+	var id uint64
+	if len(q.segments) > 0 {
+		id = q.segments[len(q.segments)-1].id + 1
+	}
+
+	path := filepath.Join(q.config.Dir, fmt.Sprintf("%020d%s", id, segmentExt))
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		q.writer = nil
+		return err
+	}
+
+	q.writer = f
+	q.segments = append(q.segments, &segment{id: id, path: path, modified: time.Now()})
+
+	return nil
+}
+
+// dropSegment removes the oldest segment.
+func (q *Queue) dropSegment() {
+	seg := q.segments[0]
+
+	q.closeReader()
+	q.roffset = 0
+
+	// Don't remove the segment out
+	// from under the writer.
+	if len(q.segments) == 1 && q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+
+	os.Remove(seg.path)
+	q.size -= seg.size
+	q.segments = q.segments[1:]
+
+	if len(q.segments) > 0 {
+		q.saveCursor(q.segments[0].id)
+	} else {
+		os.Remove(filepath.Join(q.config.Dir, cursorFile))
+	}
+}
+
+// expire drops segments that haven't been
+// written to within the configured MaxAge,
+// reporting the unread datapoints discarded.
+func (q *Queue) expire() {
+	if q.config.MaxAge <= 0 {
+		return
+	}
+
+	var expired int
+	for len(q.segments) > 0 && time.Since(q.segments[0].modified) > q.config.MaxAge {
+		expired += countPoints(q.segments[0].path, q.roffset)
+		q.dropSegment()
+	}
+
+	if expired > 0 && q.config.Expired != nil {
+		q.config.Expired(expired)
+	}
+}
+
+// countPoints returns the number of datapoints
+// in the segment file at path from offset.
+func countPoints(path string, offset int64) int {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0
+	}
+
+	var n int
+	buf := make([]byte, 32<<10)
+	for {
+		r, err := f.Read(buf)
+		n += bytes.Count(buf[:r], []byte{'\n'})
+		if err != nil {
+			return n
+		}
+	}
+}
+
+// closeReader closes the read segment.
+func (q *Queue) closeReader() {
+	if q.rfile != nil {
+		q.rfile.Close()
+	}
+	q.rfile, q.reader = nil, nil
+}
+
+// saveCursor persists the read position
+// within the segment id.
+func (q *Queue) saveCursor(id uint64) {
+	path := filepath.Join(q.config.Dir, cursorFile)
+	data := fmt.Sprintf("%d %d\n", id, q.roffset)
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(data), 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, path)
+}
+
+// loadCursor returns the persisted read
+// position if it references segment id.
+func (q *Queue) loadCursor(id uint64) int64 {
+	data, err := ioutil.ReadFile(filepath.Join(q.config.Dir, cursorFile))
+	if err != nil {
+		return 0
+	}
+
+	var cid uint64
+	var offset int64
+	if _, err := fmt.Sscanf(string(data), "%d %d", &cid, &offset); err != nil || cid != id {
+		return 0
+	}
+
+	return offset
+}
@@ -0,0 +1,195 @@
+package diskqueue
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// tempQueue opens a queue in a temporary directory,
+// returning a func that removes the directory.
+func tempQueue(t *testing.T, config Config) (*Queue, func()) {
+	dir, err := ioutil.TempDir("", "diskqueue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Dir = dir
+
+	q, err := Open(config)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return q, func() {
+		q.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// getAll pops datapoints until the queue is empty.
+func getAll(t *testing.T, q *Queue) []string {
+	var got []string
+	for {
+		m, ok, err := q.Get()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok {
+			return got
+		}
+		got = append(got, m)
+	}
+}
+
+func TestPutGetSegments(t *testing.T) {
+	q, cleanup := tempQueue(t, Config{SegmentSize: 64})
+	defer cleanup()
+
+	var want []string
+	for i := 0; i < 20; i++ {
+		m := fmt.Sprintf("metric.%02d 1 1500000000", i)
+		want = append(want, m)
+		if err := q.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(q.segments); n < 5 {
+		t.Fatalf("got %d segments, want at least 5", n)
+	}
+
+	got := getAll(t, q)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	// Consumed segments are removed, leaving
+	// the write segment.
+	if n := len(q.segments); n != 1 {
+		t.Errorf("got %d segments after reading, want 1", n)
+	}
+	if !q.Empty() || q.Size() != 0 {
+		t.Errorf("got empty %v, size %d after reading", q.Empty(), q.Size())
+	}
+}
+
+func TestPutBatch(t *testing.T) {
+	q, cleanup := tempQueue(t, Config{})
+	defer cleanup()
+
+	n, err := q.PutBatch([]byte("a 1 1\nb 2 2\nc 3 3\n"))
+	if n != 3 || err != nil {
+		t.Fatalf("got (%d, %v), want (3, nil)", n, err)
+	}
+
+	got := getAll(t, q)
+	if want := "[a 1 1 b 2 2 c 3 3]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	q, cleanup := tempQueue(t, Config{SegmentSize: 64})
+	defer cleanup()
+
+	for i := 0; i < 10; i++ {
+		if err := q.Put(fmt.Sprintf("metric.%02d 1 1500000000", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, _, err := q.Get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closing persists the read position,
+	// so reading resumes from it.
+	q.Close()
+
+	q, err := Open(q.config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	got := getAll(t, q)
+	if len(got) != 6 || got[0] != "metric.04 1 1500000000" {
+		t.Errorf("got %v after reopening, want metric.04 to metric.09", got)
+	}
+
+	// New datapoints are appended behind
+	// those loaded from disk.
+	if err := q.Put("metric.10 1 1500000000"); err != nil {
+		t.Fatal(err)
+	}
+	if got := getAll(t, q); len(got) != 1 || got[0] != "metric.10 1 1500000000" {
+		t.Errorf("got %v, want metric.10", got)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	q, cleanup := tempQueue(t, Config{MaxSize: 20})
+	defer cleanup()
+
+	// Each datapoint is 6 bytes with the LF.
+	for i := 0; i < 2; i++ {
+		if err := q.Put("a 1 1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Only the datapoints that fit are written.
+	n, err := q.PutBatch([]byte("b 2 2\nc 3 3\nd 4 4\n"))
+	if n != 1 || err != ErrFull {
+		t.Errorf("got (%d, %v), want (1, ErrFull)", n, err)
+	}
+
+	if err := q.Put("e 5 5"); err != ErrFull {
+		t.Errorf("got %v, want ErrFull", err)
+	}
+
+	got := getAll(t, q)
+	if want := "[a 1 1 a 1 1 b 2 2]"; fmt.Sprint(got) != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	var expired int
+	q, cleanup := tempQueue(t, Config{
+		SegmentSize: 12,
+		MaxAge:      50 * time.Millisecond,
+		Expired:     func(n int) { expired += n },
+	})
+	defer cleanup()
+
+	// Two segments of two datapoints.
+	for _, m := range []string{"a 1 1", "b 2 2", "c 3 3", "d 4 4"} {
+		if err := q.Put(m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if m, _, _ := q.Get(); m != "a 1 1" {
+		t.Fatalf("got %q, want a 1 1", m)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	// Only the unread datapoints are
+	// reported as expired.
+	if _, ok, _ := q.Get(); ok {
+		t.Error("got a datapoint from expired segments")
+	}
+	if expired != 3 {
+		t.Errorf("got %d expired datapoints, want 3", expired)
+	}
+	if q.Size() != 0 {
+		t.Errorf("got size %d after expiry, want 0", q.Size())
+	}
+}
@@ -10,7 +10,9 @@ import (
 	"log"
 	"net/http"
 
+	"github.com/jamiealquiza/polymur/batch"
 	"github.com/jamiealquiza/polymur/keysync"
+	"github.com/jamiealquiza/polymur/pool"
 	"github.com/jamiealquiza/polymur/statstracker"
 )
 
@@ -19,7 +21,7 @@ type HTTPListenerConfig struct {
 	Addr          string
 	HTTPPort      string
 	HTTPSPort     string
-	IncomingQueue chan []*string
+	IncomingQueue chan *batch.Batch
 	Cert          string
 	Key           string
 	KeyPrefix     bool
@@ -70,7 +72,7 @@ func HTTPListener(config *HTTPListenerConfig) {
 
 // ingest is a handler that accepts a batch of compressed data points.
 // Data points arive as a concatenated string with newline delimition.
-// Each batch is broken up and populated into a []*string and pushed
+// Each batch is broken up and populated into a *batch.Batch and pushed
 // to the IncomingQueue for downstream destination writing.
 func ingest(w http.ResponseWriter, req *http.Request, config *HTTPListenerConfig) {
 
@@ -116,26 +118,25 @@ func ingest(w http.ResponseWriter, req *http.Request, config *HTTPListenerConfig
 		return
 	}
 
-	io.WriteString(w, "Batch Received\n")
-
 	req.Body.Close()
 
-	batch := []*string{}
-	// Probably want to just pass a header that
-	// specifies how many data points are in the batch
-	// so that we can avoid using append().
+	dps := batch.Get()
+	// Scratch buffer for prefixing data points
+	// with the key name.
+	var prefixed []byte
 	for {
 		// This should have a timeout so
 		// malformed messages without a delim
 		// don't hang forever.
 		l, err := b.ReadBytes(10)
 
-		if len(l) > 0 {
-			m := string(l[:len(l)-1])
+		if m := bytes.TrimSuffix(l, []byte{10}); len(m) > 0 {
 			if config.KeyPrefix {
-				m = fmt.Sprintf("%s.%s", keyName, m)
+				prefixed = append(prefixed[:0], keyName...)
+				prefixed = append(prefixed, '.')
+				m = append(prefixed, m...)
 			}
-			batch = append(batch, &m)
+			dps.Append(m)
 			config.Stats.UpdateCount(1)
 		}
 		if err != nil {
@@ -143,7 +144,15 @@ func ingest(w http.ResponseWriter, req *http.Request, config *HTTPListenerConfig
 		}
 	}
 
-	config.IncomingQueue <- batch
+	if !pool.Memory.Admit(dps) {
+		dps.Release()
+		w.WriteHeader(http.StatusServiceUnavailable)
+		io.WriteString(w, "Memory Budget Exhausted\n")
+		return
+	}
+
+	config.IncomingQueue <- dps
+	io.WriteString(w, "Batch Received\n")
 }
 
 // ping validates a connecting polymur-proxy's API key.
@@ -6,15 +6,18 @@ import (
 	"bufio"
 	"log"
 	"net"
+	"sync"
 	"time"
 
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
 	"github.com/jamiealquiza/polymur/statstracker"
 )
 
 // TCPListenerConfig holds TCP listener config.
 type TCPListenerConfig struct {
 	Addr          string
-	IncomingQueue chan []*string
+	IncomingQueue chan *batch.Batch
 	FlushTimeout  int
 	FlushSize     int
 	Stats         *statstracker.Stats
@@ -45,66 +48,106 @@ func TCPListener(config *TCPListenerConfig) {
 // connectionHandler handles metrics input from a
 // single TCP connection.
 func connectionHandler(config *TCPListenerConfig, c net.Conn) {
-	messages := make(chan string, 128)
-	go messageBatcher(messages, config)
-	defer close(messages)
-	
+	b := newBatcher(config)
+	defer b.close()
+
 	inbound := bufio.NewScanner(c)
 	defer c.Close()
 
 	for inbound.Scan() {
-		m := inbound.Text()
-		messages <- m
+		m := inbound.Bytes()
+		if len(m) == 0 {
+			continue
+		}
+		b.add(m)
 		config.Stats.UpdateCount(1)
 	}
 }
 
-// messageBatcher batches messages for passing
-// around through Polymur.
-func messageBatcher(messages chan string, config *TCPListenerConfig) {
-	flushTimeout := time.NewTicker(time.Duration(config.FlushTimeout) * time.Second)
-	defer flushTimeout.Stop()
+// batcher batches messages from a connection for
+// passing around through Polymur. Batches are loaded
+// into the incoming queue once they reach the flush
+// size, or at the flush timeout.
+type batcher struct {
+	sync.Mutex
+	config *TCPListenerConfig
+	b      *batch.Batch
+	done   chan struct{}
+}
+
+// newBatcher returns a *batcher that
+// flushes at the config flush timeout.
+func newBatcher(config *TCPListenerConfig) *batcher {
+	b := &batcher{
+		config: config,
+		b:      batch.Get(),
+		done:   make(chan struct{}),
+	}
 
-	batch := make([]*string, config.FlushSize)
-	pos := 0
+	go b.timeout()
+
+	return b
+}
+
+// add copies the message m to the current batch.
+func (b *batcher) add(m []byte) {
+	b.Lock()
+	defer b.Unlock()
+
+	b.b.Append(m)
+
+	// If this puts us at the FlushSize threshold,
+	// enqueue into the q.
+	if b.b.Len() >= b.config.FlushSize {
+		b.flush()
+	}
+}
+
+// flush loads the current batch, if not empty,
+// into the incoming queue. Callers must hold the lock.
+func (b *batcher) flush() {
+	if b.b.Len() == 0 {
+		return
+	}
+
+	if len(b.config.IncomingQueue) == cap(b.config.IncomingQueue) {
+		log.Printf("Incoming queue capacity %d reached\n", cap(b.config.IncomingQueue))
+		// Needs some flow control logic.
+	}
+
+	if pool.Memory.Admit(b.b) {
+		b.config.IncomingQueue <- b.b
+	} else {
+		b.b.Release()
+	}
+	b.b = batch.Get()
+}
+
+// timeout flushes the current batch at
+// the flush timeout until the batcher is closed.
+func (b *batcher) timeout() {
+	flushTimeout := time.NewTicker(time.Duration(b.config.FlushTimeout) * time.Second)
+	defer flushTimeout.Stop()
 
-run:
 	for {
-		// We hit the flush timeout, load the current batch if present.
 		select {
 		case <-flushTimeout.C:
-			if len(batch) > 0 {
-				config.IncomingQueue <- batch
-				batch = make([]*string, config.FlushSize)
-				pos = 0
-			}
-		case m, ok := <-messages:
-			if !ok {
-				break run
-			}
-
-			// Drop message and respond if the incoming queue is at capacity.
-			if len(config.IncomingQueue) == cap(config.IncomingQueue) {
-				log.Printf("Incoming queue capacity %d reached\n", cap(config.IncomingQueue))
-				// Needs some flow control logic.
-			}
-
-			// If this puts us at the FlushSize threshold, enqueue
-			// into the q.
-			if pos+1 >= config.FlushSize {
-				batch[config.FlushSize-1] = &m
-				config.IncomingQueue <- batch
-				batch = make([]*string, config.FlushSize)
-				pos = 0
-			} else {
-				// Otherwise, just append message to current batch.
-				batch[pos] = &m
-				pos++
-			}
+			b.Lock()
+			b.flush()
+			b.Unlock()
+		case <-b.done:
+			return
 		}
 	}
+}
+
+// close loads any partial batch
+// and stops the flush timeout.
+func (b *batcher) close() {
+	close(b.done)
 
-	// Load any partial batch before
-	// we return.
-	config.IncomingQueue <- batch
+	b.Lock()
+	b.flush()
+	b.b.Release()
+	b.Unlock()
 }
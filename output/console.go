@@ -3,19 +3,44 @@
 package output
 
 import (
-	"fmt"
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
 )
 
-// Console reads from the destination queue and
-// prints the datapoints to console.
-func Console(q <-chan []*string) {
-batch:
-	for m := range q {
-		for _, l := range m {
-			if l == nil {
-				break batch
-			}
-			fmt.Println(*l)
-		}
+// newConsoleWriter returns a writer for a
+// console destination ("console://"), which
+// prints its data points to stdout.
+func newConsoleWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest); err != nil {
+		return nil, err
+	}
+
+	if dest.Addr != "" {
+		return nil, errors.New("console destinations take no address")
 	}
+
+	return newDestWriter(c, dest, dialConsole, connWriter), nil
+}
+
+// dialConsole returns a connection to stdout.
+func dialConsole(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+	return consoleConn{}, nil
+}
+
+// consoleConn writes to stdout;
+// closing it does nothing.
+type consoleConn struct{}
+
+// Write writes p to stdout.
+func (consoleConn) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+// Close does nothing.
+func (consoleConn) Close() error {
+	return nil
 }
@@ -0,0 +1,32 @@
+// Package output file.go writes
+// datapoints to a file destination.
+package output
+
+import (
+	"errors"
+	"io"
+	"os"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// newFileWriter returns a writer for a file destination,
+// "file:///path/to/file". Data points are appended to the
+// file, which is created if it doesn't exist.
+func newFileWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest); err != nil {
+		return nil, err
+	}
+
+	if dest.Addr == "" {
+		return nil, errors.New("file destinations take the form file:///path/to/file")
+	}
+
+	return newDestWriter(c, dest, dialFile, connWriter), nil
+}
+
+// dialFile opens the destination file for appending.
+func dialFile(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+	return os.OpenFile(dest.Addr, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+}
@@ -5,25 +5,22 @@ package output
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/tls"
-	"crypto/x509"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
 )
 
-// HTTPWriterConfig holds HTTP output
-// configuration.
-type HTTPWriterConfig struct {
-	Cert          string
-	APIKey        string
-	Gateway       string
-	IncomingQueue chan []*string
-	Workers       int
-	client        *http.Client
-	Verbose       bool
+// gatewayConfig holds polymur-gateway
+// connection configuration.
+type gatewayConfig struct {
+	APIKey  string
+	Gateway string
+	client  *http.Client
 }
 
 // GwResp captures the response string
@@ -33,140 +30,147 @@ type GwResp struct {
 	Code   int
 }
 
-// HTTPWriter writes compressesed message batches over HTTPS
-// to a polymur-gateway instance. Initial connection is OK'd
-// by hitting the /ping path with a valid client API key registered
-// with the polymur-gateway.
-func HTTPWriter(config *HTTPWriterConfig, ready chan bool) {
-
-	if config.Cert != "" {
-		cert, err := ioutil.ReadFile(config.Cert)
-		if err != nil {
-			log.Fatal(err)
-			return
-		}
-
-		// Use client cert.
-		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM(cert)
-		if !ok {
-			log.Fatal("Error parsing certificate")
-		}
-
-		tlsConf := &tls.Config{RootCAs: roots}
-		tr := &http.Transport{TLSClientConfig: tlsConf}
-		config.client = &http.Client{Transport: tr}
-	} else {
-		config.client = &http.Client{}
+// apiPost is a convenience wrapper for submitting requests to
+// a polymur-gateway and returning GwResp's.
+func apiPost(config *gatewayConfig, path string, postData io.Reader) (*GwResp, error) {
+	req, err := http.NewRequest("POST", config.Gateway+path, postData)
+	if err != nil {
+		return nil, err
 	}
 
-	// Try connection, verify api key.
-	log.Printf("Pinging gateway %s\n", config.Gateway)
-	response, err := apiPost(config, "/ping", nil)
+	req.Header.Add("X-polymur-key", config.APIKey)
+	resp, err := config.client.Do(req)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
 
-	// Check if not 200 and exit.
-	if response.Code != 200 {
-		log.Fatalf("[gateway]: %s\n", response.String)
-	} else {
-		log.Printf("Connection to gateway %s successful\n", config.Gateway)
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
 
-	ready <- true
+	resp.Body.Close()
 
-	// Start up writers.
-	for i := 0; i < config.Workers; i++ {
-		go writeStream(config, i)
-	}
+	return &GwResp{String: string(data), Code: resp.StatusCode}, nil
 }
 
-// writeStream reads data point batches from the IncomingQueue,
-// compresses and writes to the downstream polymur-gateway.
-func writeStream(config *HTTPWriterConfig, workerID int) {
-	log.Printf("HTTP writer #%d started\n", workerID)
-
-	var data bytes.Buffer
-	w := gzip.NewWriter(&data)
-	var count int
-
-	for m := range config.IncomingQueue {
-		count = packDataPoints(w, m)
-
-		if config.Verbose {
-			log.Printf("[worker #%d] sending batch (%d data points)\n",
-				workerID,
-				count)
-		}
-
-		start := time.Now()
-		response, err := apiPost(config, "/ingest", &data)
-		w.Reset(&data)
-
-		if err != nil {
-			// TODO need failure / retry logic.
-			log.Printf("[worker #%d] gateway]: %s",
-				workerID, err)
-			count = 0
-			continue
-		}
-
-		// If it's a non-200, log.
-		if response.Code != 200 {
-			log.Printf("[worker #%d] %s [gateway] %s",
-				workerID, time.Since(start), response.String)
-		} else {
-			// If it's a 200 but verbosity is true,
-			// log.
-			if config.Verbose {
-				log.Printf("[worker #%d] %s [gateway] %s",
-					workerID, time.Since(start), response.String)
-			}
-		}
-
-		count = 0
+// newHTTPWriter returns a writer for a polymur-gateway
+// destination, "https://host[:port]?api-key=key". Its
+// certificate is verified as with TLS destinations.
+func newHTTPWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest, "api-key"); err != nil {
+		return nil, err
 	}
+
+	if dest.Options.Get("api-key") == "" {
+		return nil, errors.New("api-key must be set")
+	}
+
+	return newDestWriter(c, dest, dialHTTP, connWriter), nil
 }
 
-// apiPost is a convenience wrapper for submitting requests to
-// a polymur-gateway and returning GwResp's.
-func apiPost(config *HTTPWriterConfig, path string, postData io.Reader) (*GwResp, error) {
-	req, err := http.NewRequest("POST", config.Gateway+path, postData)
+// CheckGateway pings the polymur-gateway destination
+// spec, returning an error if it can't be reached or
+// the API key isn't accepted.
+func CheckGateway(spec string, timeout time.Duration) error {
+	dest, err := pool.ParseDestination(spec)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	req.Header.Add("X-polymur-key", config.APIKey)
-	resp, err := config.client.Do(req)
+	conn, err := dialHTTP(dest, timeout)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	return conn.Close()
+}
+
+// dialHTTP pings the polymur-gateway at dest and
+// returns an *httpConn if the API key is accepted.
+func dialHTTP(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+	tr := &http.Transport{}
+	if dest.TLS != nil {
+		tr.TLSClientConfig = dest.TLS.Config()
+	}
+
+	config := &gatewayConfig{
+		APIKey:  dest.Options.Get("api-key"),
+		Gateway: "https://" + dest.Addr,
+		client:  &http.Client{Transport: tr, Timeout: timeout},
+	}
+
+	response, err := apiPost(config, "/ping", nil)
 	if err != nil {
+		tr.CloseIdleConnections()
 		return nil, err
 	}
 
-	resp.Body.Close()
+	if response.Code != 200 {
+		tr.CloseIdleConnections()
+		return nil, fmt.Errorf("[gateway] %s", response.String)
+	}
 
-	return &GwResp{String: string(data), Code: resp.StatusCode}, nil
+	// Ingest requests are limited by
+	// the write timeout instead.
+	config.client.Timeout = 0
+
+	conn := &httpConn{config: config, transport: tr}
+	conn.gz = gzip.NewWriter(&conn.buf)
+
+	return conn, nil
 }
 
-// packDataPoints takes a []*string batch of data points,
-// compresses them and returns the reader.
-func packDataPoints(w *gzip.Writer, d []*string) int {
-	var count int
-	for _, s := range d {
-		if s == nil {
-			break
-		}
-		w.Write([]byte(*s))
-		w.Write([]byte{10})
-		count++
+// httpConn is a connection to a polymur-gateway.
+// Each write is compressed and posted to /ingest;
+// a trailing partial line is held for the next write.
+type httpConn struct {
+	config    *gatewayConfig
+	transport *http.Transport
+	partial   []byte
+	buf       bytes.Buffer
+	gz        *gzip.Writer
+}
+
+// Write posts p, less any trailing partial line.
+func (h *httpConn) Write(p []byte) (int, error) {
+	lines, rest := splitLines(h.partial, p)
+	if len(lines) == 0 {
+		h.partial = rest
+		return len(p), nil
+	}
+
+	h.buf.Reset()
+	h.gz.Reset(&h.buf)
+	h.gz.Write(lines)
+	h.gz.Close()
+
+	response, err := apiPost(h.config, "/ingest", &h.buf)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.Code != 200 {
+		return 0, fmt.Errorf("[gateway] %s", response.String)
 	}
 
-	w.Close()
+	h.partial = append(h.partial[:0], rest...)
+
+	return len(p), nil
+}
+
+// splitLines appends p to partial and returns the
+// complete lines and any trailing partial line. Both
+// may share partial's underlying array.
+func splitLines(partial, p []byte) (lines, rest []byte) {
+	data := append(partial, p...)
+	i := bytes.LastIndexByte(data, '\n')
+
+	return data[:i+1], data[i+1:]
+}
 
-	return count
+// Close closes idle gateway connections.
+func (h *httpConn) Close() error {
+	h.transport.CloseIdleConnections()
+	return nil
 }
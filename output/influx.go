@@ -0,0 +1,302 @@
+// Package output influx.go writes datapoints
+// to an InfluxDB destination in line protocol.
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// metricTemplates map Graphite paths for InfluxDB and
+// Prometheus destinations; see TCPWriterConfig.Templates.
+var metricTemplates Templates
+
+// Line protocol escaping.
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// newInfluxWriter returns a writer for an InfluxDB
+// destination, "influx://host:port?db=name". Options:
+// - db: database (required).
+// - rp: retention policy.
+// - user, password: credentials.
+// Writes are made over HTTPS if any tls option is set.
+func newInfluxWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest, "db", "rp", "user", "password"); err != nil {
+		return nil, err
+	}
+
+	if dest.Options.Get("db") == "" {
+		return nil, errors.New("db must be set")
+	}
+
+	w := newDestWriter(c, dest, nil, connWriter)
+	w.dial = func(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+		return dialInflux(w, timeout)
+	}
+
+	return w, nil
+}
+
+// dialInflux pings the writer's InfluxDB destination
+// and returns an *influxConn if it's reachable.
+func dialInflux(w *destWriter, timeout time.Duration) (io.WriteCloser, error) {
+	dest := w.dest
+
+	tr := &http.Transport{}
+	base := "http://" + dest.Addr
+	if dest.TLS != nil {
+		tr.TLSClientConfig = dest.TLS.Config()
+		base = "https://" + dest.Addr
+	}
+
+	client := &http.Client{Transport: tr, Timeout: timeout}
+
+	resp, err := client.Get(base + "/ping")
+	if err != nil {
+		tr.CloseIdleConnections()
+		return nil, err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		tr.CloseIdleConnections()
+		return nil, fmt.Errorf("[influxdb] ping: %s", resp.Status)
+	}
+
+	params := url.Values{}
+	params.Set("db", dest.Options.Get("db"))
+	params.Set("precision", "s")
+	if rp := dest.Options.Get("rp"); rp != "" {
+		params.Set("rp", rp)
+	}
+
+	// Writes are limited by
+	// the write timeout instead.
+	client.Timeout = 0
+
+	conn := &influxConn{
+		w:         w,
+		client:    client,
+		transport: tr,
+		url:       base + "/write?" + params.Encode(),
+		user:      dest.Options.Get("user"),
+		password:  dest.Options.Get("password"),
+	}
+	conn.gz = gzip.NewWriter(&conn.buf)
+
+	return conn, nil
+}
+
+// influxConn is a connection to an InfluxDB destination.
+// Each write is converted to line protocol (see
+// influxLine), compressed and posted to /write; a
+// trailing partial line is held for the next write.
+type influxConn struct {
+	w         *destWriter
+	client    *http.Client
+	transport *http.Transport
+	url       string
+	user      string
+	password  string
+	partial   []byte
+	lines     bytes.Buffer
+	buf       bytes.Buffer
+	gz        *gzip.Writer
+}
+
+// Write posts p, less any trailing partial line. Data
+// points that can't be converted are dropped, as are
+// batches InfluxDB rejects as not valid. Failed posts
+// are retried (see destWriter.retry); the error is then
+// returned, and the writer reconnects and resends the batch.
+func (i *influxConn) Write(p []byte) (int, error) {
+	c, dest := i.w.c, i.w.dest
+
+	lines, rest := splitLines(i.partial, p)
+	if len(lines) == 0 {
+		i.partial = rest
+		return len(p), nil
+	}
+
+	i.lines.Reset()
+	var points int
+	for _, m := range bytes.Split(lines[:len(lines)-1], []byte{'\n'}) {
+		if len(m) == 0 {
+			continue
+		}
+		if !influxLine(&i.lines, m) {
+			pool.Drops.Add(pool.DropConversion, c.Name, dest.Name, 1, m)
+			continue
+		}
+		points++
+	}
+
+	if points > 0 {
+		send := func() error { return i.send(points) }
+		if err := i.w.retry(send); err != nil {
+			return 0, err
+		}
+	}
+
+	i.partial = append(i.partial[:0], rest...)
+
+	return len(p), nil
+}
+
+// send compresses and posts the converted lines.
+func (i *influxConn) send(points int) error {
+	c, dest := i.w.c, i.w.dest
+
+	i.buf.Reset()
+	i.gz.Reset(&i.buf)
+	i.gz.Write(i.lines.Bytes())
+	i.gz.Close()
+
+	req, err := http.NewRequest("POST", i.url, bytes.NewReader(i.buf.Bytes()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "gzip")
+	if i.user != "" {
+		req.SetBasicAuth(i.user, i.password)
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNoContent:
+		return nil
+	case resp.StatusCode == http.StatusBadRequest:
+		// Retrying a batch that isn't valid won't
+		// succeed; InfluxDB writes any valid points.
+		log.Printf("Destination %s rejected batch: %s\n", dest.Name, bytes.TrimSpace(body))
+		pool.Drops.Add(pool.DropWriteError, c.Name, dest.Name, int64(influxDropped(body, points)), nil)
+		return nil
+	default:
+		return fmt.Errorf("[influxdb] %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+}
+
+// influxDropped returns the number of points InfluxDB
+// dropped from a rejected batch of points. A partial
+// write error reports points dropped on write as
+// "dropped=n", and each line that couldn't be parsed
+// as "unable to parse". Otherwise, or if the count
+// can't be determined, the whole batch was dropped.
+func influxDropped(body []byte, points int) int {
+	if !bytes.Contains(body, []byte("partial write")) {
+		return points
+	}
+
+	n := bytes.Count(body, []byte("unable to parse"))
+	if i := bytes.LastIndex(body, []byte("dropped=")); i >= 0 {
+		digits := body[i+len("dropped="):]
+		end := 0
+		for end < len(digits) && digits[end] >= '0' && digits[end] <= '9' {
+			end++
+		}
+		dropped, _ := strconv.Atoi(string(digits[:end]))
+		n += dropped
+	}
+
+	if n == 0 || n > points {
+		return points
+	}
+
+	return n
+}
+
+// Close closes idle InfluxDB connections.
+func (i *influxConn) Close() error {
+	i.transport.CloseIdleConnections()
+	return nil
+}
+
+// influxLine converts a Graphite data point to line
+// protocol with the metric templates and appends it
+// to buf. The field is "value" unless set by the
+// template. Returns false if m isn't a valid data point.
+func influxLine(buf *bytes.Buffer, m []byte) bool {
+	path, value, ts, ok := parseDataPoint(m)
+	if !ok {
+		return false
+	}
+
+	measurement, field, tags := metricTemplates.Apply(path, ".")
+	if field == "" {
+		field = "value"
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf.WriteString(measurementEscaper.Replace(measurement))
+	for _, k := range keys {
+		if tags[k] == "" {
+			continue
+		}
+		buf.WriteByte(',')
+		buf.WriteString(keyEscaper.Replace(k))
+		buf.WriteByte('=')
+		buf.WriteString(keyEscaper.Replace(tags[k]))
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(keyEscaper.Replace(field))
+	buf.WriteByte('=')
+	buf.WriteString(strconv.FormatFloat(value, 'g', -1, 64))
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(int64(ts), 10))
+	buf.WriteByte('\n')
+
+	return true
+}
+
+// parseDataPoint parses a Graphite data point, "path
+// value timestamp", with the timestamp in seconds.
+// Returns false if the value isn't a finite number
+// or the timestamp isn't a number.
+func parseDataPoint(m []byte) (path string, value, ts float64, ok bool) {
+	fields := strings.Fields(string(m))
+	if len(fields) != 3 {
+		return "", 0, 0, false
+	}
+
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return "", 0, 0, false
+	}
+
+	ts, err = strconv.ParseFloat(fields[2], 64)
+	if err != nil {
+		return "", 0, 0, false
+	}
+
+	return fields[0], value, ts, true
+}
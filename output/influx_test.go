@@ -0,0 +1,242 @@
+package output
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// withTemplates sets the metric templates, returning
+// a func that restores the previous templates.
+func withTemplates(t *testing.T, s string) func() {
+	templates, err := ParseTemplates(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prev := metricTemplates
+	metricTemplates = templates
+
+	return func() { metricTemplates = prev }
+}
+
+func TestInfluxLine(t *testing.T) {
+	defer withTemplates(t, "servers.* .host.measurement.field* dc=us-east;tagged.* .tag.measurement")()
+
+	tests := []struct {
+		in   string
+		want string
+		ok   bool
+	}{
+		{"servers.web01.cpu.load.shortterm 0.42 1500000000", "cpu,dc=us-east,host=web01 load.shortterm=0.42 1500000000\n", true},
+		{"collectd.web01.cpu 1 1500000000", "collectd.web01.cpu value=1 1500000000\n", true},
+		{"stats.api 1e+21 1500000000.5", "stats.api value=1e+21 1500000000\n", true},
+		// Escaping.
+		{"tagged.a,b=c.x,y 2 1500000000", `x\,y,tag=a\,b\=c value=2 1500000000` + "\n", true},
+		// Empty tag values are omitted.
+		{"tagged..m 3 1500000000", "m value=3 1500000000\n", true},
+		// Not valid data points.
+		{"stats.api NaN 1500000000", "", false},
+		{"stats.api +Inf 1500000000", "", false},
+		{"stats.api abc 1500000000", "", false},
+		{"stats.api 1 abc", "", false},
+		{"stats.api 1", "", false},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		ok := influxLine(&buf, []byte(tt.in))
+		if ok != tt.ok || buf.String() != tt.want {
+			t.Errorf("%q: got (%q, %v), want (%q, %v)", tt.in, buf.String(), ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestInfluxDropped(t *testing.T) {
+	tests := []struct {
+		body string
+		want int
+	}{
+		{`{"error":"partial write: field type conflict: input field \"value\" on measurement \"cpu\" is type string, already exists as type float dropped=2"}`, 2},
+		{`{"error":"partial write: points beyond retention policy dropped=1"}`, 1},
+		{`{"error":"partial write: unable to parse 'a b': invalid field format\nunable to parse 'c d': invalid field format dropped=0"}`, 2},
+		{`{"error":"unable to parse 'a b': invalid field format"}`, 10},
+		{`{"error":"database not found: \"graphite\""}`, 10},
+		{`{"error":"partial write: dropped=50"}`, 10},
+		{``, 10},
+	}
+
+	for _, tt := range tests {
+		if got := influxDropped([]byte(tt.body), 10); got != tt.want {
+			t.Errorf("%s: got %d, want %d", tt.body, got, tt.want)
+		}
+	}
+}
+
+// fakeInflux serves the InfluxDB ping and
+// write endpoints, recording written lines.
+type fakeInflux struct {
+	sync.Mutex
+	// status and body are the
+	// write response.
+	status int
+	body   string
+	query  string
+	auth   string
+	lines  []string
+}
+
+func (f *fakeInflux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/ping":
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case "/write":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	body := r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		body = gz
+	}
+	b, _ := ioutil.ReadAll(body)
+
+	user, password, _ := r.BasicAuth()
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.query = r.URL.RawQuery
+	f.auth = user + ":" + password
+	f.lines = append(f.lines, strings.Split(strings.TrimSuffix(string(b), "\n"), "\n")...)
+
+	if f.status == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(f.status)
+	w.Write([]byte(f.body))
+}
+
+// influxConnTo dials the fake InfluxDB
+// server srv as a destination of c.
+func influxConnTo(t *testing.T, c *pool.Cluster, srv *httptest.Server, opts string) *influxConn {
+	dest, err := pool.ParseDestination("influx://" + strings.TrimPrefix(srv.URL, "http://") + "?" + opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newInfluxWriter(c, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := dialInflux(w.(*destWriter), time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn.(*influxConn)
+}
+
+func TestInfluxWrite(t *testing.T) {
+	defer withTemplates(t, "servers.* .host.measurement.field*")()
+
+	f := &fakeInflux{}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c := pool.NewCluster("influx-write")
+	conn := influxConnTo(t, c, srv, "db=graphite&rp=short&user=polymur&password=secret")
+	defer conn.Close()
+
+	// The trailing partial line is held
+	// until the next write.
+	if _, err := conn.Write([]byte("servers.web01.cpu.load 0.5 1500000000\nservers.web02.cpu.lo")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("ad 0.25 1500000000\nstats.api not-a-number 1500000000\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Lock()
+	defer f.Unlock()
+
+	want := []string{
+		"cpu,host=web01 load=0.5 1500000000",
+		"cpu,host=web02 load=0.25 1500000000",
+	}
+	if strings.Join(f.lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got lines %q, want %q", f.lines, want)
+	}
+	if f.query != "db=graphite&precision=s&rp=short" {
+		t.Errorf("got query %s", f.query)
+	}
+	if f.auth != "polymur:secret" {
+		t.Errorf("got credentials %s", f.auth)
+	}
+
+	if n := influxDrops(c.Name, pool.DropConversion); n != 1 {
+		t.Errorf("got %d conversion drops, want 1", n)
+	}
+}
+
+func TestInfluxPartialWrite(t *testing.T) {
+	f := &fakeInflux{
+		status: http.StatusBadRequest,
+		body:   `{"error":"partial write: points beyond retention policy dropped=1"}`,
+	}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c := pool.NewCluster("influx-partial-write")
+	conn := influxConnTo(t, c, srv, "db=graphite")
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("a 1 1500000000\nb 2 1\nc 3 1500000000\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n := influxDrops(c.Name, pool.DropWriteError); n != 1 {
+		t.Errorf("got %d write-error drops, want 1", n)
+	}
+
+	// A batch rejected outright is dropped.
+	f.Lock()
+	f.body = `{"error":"unable to parse 'a 1 x': bad timestamp"}`
+	f.Unlock()
+
+	if _, err := conn.Write([]byte("a 1 1500000000\nb 2 1500000000\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n := influxDrops(c.Name, pool.DropWriteError); n != 3 {
+		t.Errorf("got %d write-error drops, want 3", n)
+	}
+}
+
+// influxDrops returns the drops counted
+// for reason in the named cluster.
+func influxDrops(cluster, reason string) int64 {
+	var n int64
+	for _, d := range pool.Drops.Counts() {
+		if d.Cluster == cluster && d.Reason == reason {
+			n += d.Count
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,381 @@
+// Package output prometheus.go writes datapoints
+// to a Prometheus remote_write destination.
+package output
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// defaultPromBatchSize is the default
+// max samples per remote_write request.
+const defaultPromBatchSize = 1000
+
+// newPromWriter returns a writer for a Prometheus
+// remote_write destination, "prometheus://host:port".
+// Options:
+// - path: remote_write path (default /api/v1/write).
+// - batch-size: max samples per request (default 1000).
+// - user, password: credentials.
+// Writes are made over HTTPS if any tls option is set.
+func newPromWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest, "path", "batch-size", "user", "password"); err != nil {
+		return nil, err
+	}
+
+	if dest.Port == "" {
+		return nil, errors.New("prometheus destinations take the form prometheus://host:port")
+	}
+
+	path := "/api/v1/write"
+	if v := dest.Options.Get("path"); v != "" {
+		if !strings.HasPrefix(v, "/") {
+			return nil, errors.New("path must start with /")
+		}
+		path = v
+	}
+
+	batchSize := defaultPromBatchSize
+	if v := dest.Options.Get("batch-size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, errors.New("batch-size must be a positive integer")
+		}
+		batchSize = n
+	}
+
+	w := newDestWriter(c, dest, nil, connWriter)
+	w.dial = func(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+		return dialProm(w, path, batchSize, timeout)
+	}
+
+	return w, nil
+}
+
+// dialProm returns a *promConn for the writer's
+// destination. remote_write has no health check,
+// so the destination is checked by connecting to it.
+func dialProm(w *destWriter, path string, batchSize int, timeout time.Duration) (io.WriteCloser, error) {
+	dest := w.dest
+
+	conn, err := net.DialTimeout("tcp", dest.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+
+	tr := &http.Transport{}
+	base := "http://" + dest.Addr
+	if dest.TLS != nil {
+		tr.TLSClientConfig = dest.TLS.Config()
+		base = "https://" + dest.Addr
+	}
+
+	return &promConn{
+		w:         w,
+		client:    &http.Client{Transport: tr},
+		transport: tr,
+		url:       base + path,
+		user:      dest.Options.Get("user"),
+		password:  dest.Options.Get("password"),
+		batchSize: batchSize,
+	}, nil
+}
+
+// promConn is a connection to a Prometheus remote_write
+// destination. Each write is converted to samples (see
+// promSample) and posted as snappy compressed protobuf
+// WriteRequests of at most batchSize samples; a trailing
+// partial line is held for the next write.
+type promConn struct {
+	w         *destWriter
+	client    *http.Client
+	transport *http.Transport
+	url       string
+	user      string
+	password  string
+	batchSize int
+	partial   []byte
+	series    []promSeries
+	// ends holds the end of each
+	// series' line in the write.
+	ends []int
+	buf  []byte
+	body []byte
+	// written is the bytes written to the
+	// connection; delivered is the bytes
+	// of those posted (see Delivered).
+	written   int64
+	delivered int64
+}
+
+// promSeries is a single sample time series.
+type promSeries struct {
+	labels    []promLabel
+	value     float64
+	timestamp int64
+}
+
+// promLabel is a time series label.
+type promLabel struct {
+	name  string
+	value string
+}
+
+// Write posts p, less any trailing partial line. Data
+// points that can't be converted are dropped, as are
+// requests the destination rejects as not valid. Failed
+// posts are retried (see destWriter.retry); the error is
+// then returned, and the writer reconnects and resends
+// the data from the first request that failed.
+func (p *promConn) Write(b []byte) (int, error) {
+	c, dest := p.w.c, p.w.dest
+
+	// start is the offset in the data written to
+	// the connection of the lines posted by this write.
+	start := p.written - int64(len(p.partial))
+	p.written += int64(len(b))
+
+	lines, rest := splitLines(p.partial, b)
+	if len(lines) == 0 {
+		p.partial = rest
+		return len(b), nil
+	}
+
+	p.series, p.ends = p.series[:0], p.ends[:0]
+	for i := 0; i < len(lines); {
+		end := i + bytes.IndexByte(lines[i:], '\n') + 1
+		m := lines[i : end-1]
+		i = end
+
+		if len(m) == 0 {
+			continue
+		}
+
+		s, ok := promSample(m)
+		if !ok {
+			pool.Drops.Add(pool.DropConversion, c.Name, dest.Name, 1, m)
+			continue
+		}
+		p.series = append(p.series, s)
+		p.ends = append(p.ends, end)
+	}
+
+	for i := 0; i < len(p.series); {
+		n := p.batchSize
+		if n > len(p.series)-i {
+			n = len(p.series) - i
+		}
+
+		series := p.series[i : i+n]
+		send := func() error { return p.send(series) }
+		if err := p.w.retry(send); err != nil {
+			return 0, err
+		}
+
+		i += n
+		p.delivered = start + int64(p.ends[i-1])
+	}
+
+	p.delivered = start + int64(len(lines))
+	p.partial = append(p.partial[:0], rest...)
+
+	return len(b), nil
+}
+
+// Delivered returns the bytes written to the
+// connection that have been posted, so that only
+// the remainder is resent after a failed write.
+func (p *promConn) Delivered() int64 {
+	return p.delivered
+}
+
+// send encodes and posts a WriteRequest holding series.
+func (p *promConn) send(series []promSeries) error {
+	c, dest := p.w.c, p.w.dest
+
+	p.buf = encodeWriteRequest(p.buf[:0], series)
+	p.body = snappyEncode(p.body[:0], p.buf)
+
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(p.body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if p.user != "" {
+		req.SetBasicAuth(p.user, p.password)
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode/100 == 2:
+		return nil
+	case resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests:
+		// Client errors other than rate limiting
+		// won't succeed if retried.
+		log.Printf("Destination %s rejected batch: %s\n", dest.Name, bytes.TrimSpace(body))
+		pool.Drops.Add(pool.DropWriteError, c.Name, dest.Name, int64(len(series)), nil)
+		return nil
+	default:
+		return fmt.Errorf("[prometheus] %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+}
+
+// Close closes idle remote_write connections.
+func (p *promConn) Close() error {
+	p.transport.CloseIdleConnections()
+	return nil
+}
+
+// promSample converts a Graphite data point to a sample
+// with the metric templates. Path nodes are joined with
+// underscores; the metric name is the measurement, and
+// the field if set by the template, and tags are labels.
+// Characters not valid in names are replaced with
+// underscores. Returns false if m isn't a valid data point.
+func promSample(m []byte) (promSeries, bool) {
+	path, value, ts, ok := parseDataPoint(m)
+	if !ok {
+		return promSeries{}, false
+	}
+
+	measurement, field, tags := metricTemplates.Apply(path, "_")
+	name := measurement
+	if field != "" {
+		name += "_" + field
+	}
+
+	s := promSeries{
+		labels:    make([]promLabel, 0, len(tags)+1),
+		value:     value,
+		timestamp: int64(ts * 1000),
+	}
+
+	s.labels = append(s.labels, promLabel{name: "__name__", value: promName(name, true)})
+	for k, v := range tags {
+		if v == "" {
+			continue
+		}
+		s.labels = append(s.labels, promLabel{name: promName(k, false), value: v})
+	}
+
+	sort.Slice(s.labels, func(i, j int) bool {
+		return s.labels[i].name < s.labels[j].name
+	})
+
+	return s, true
+}
+
+// promName replaces characters not valid in metric
+// names (or label names, which can't contain colons)
+// with underscores, and prefixes names starting with
+// a digit with an underscore.
+func promName(s string, colons bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case c >= '0' && c <= '9':
+		case c == ':' && colons:
+		default:
+			b[i] = '_'
+		}
+	}
+
+	if len(b) > 0 && b[0] >= '0' && b[0] <= '9' {
+		b = append([]byte{'_'}, b...)
+	}
+
+	return string(b)
+}
+
+// encodeWriteRequest appends the protobuf encoding of a
+// prometheus.WriteRequest holding series to buf:
+//
+//	WriteRequest { repeated TimeSeries timeseries = 1; }
+//	TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	Label { string name = 1; string value = 2; }
+//	Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(buf []byte, series []promSeries) []byte {
+	for _, s := range series {
+		sampleSize := 1 + 8 + 1 + uvarintLen(uint64(s.timestamp))
+
+		size := 1 + uvarintLen(uint64(sampleSize)) + sampleSize
+		for _, l := range s.labels {
+			labelSize := stringFieldLen(l.name) + stringFieldLen(l.value)
+			size += 1 + uvarintLen(uint64(labelSize)) + labelSize
+		}
+
+		// TimeSeries.
+		buf = append(buf, 1<<3|2)
+		buf = appendUvarint(buf, uint64(size))
+
+		for _, l := range s.labels {
+			buf = append(buf, 1<<3|2)
+			buf = appendUvarint(buf, uint64(stringFieldLen(l.name)+stringFieldLen(l.value)))
+			buf = appendStringField(buf, 1, l.name)
+			buf = appendStringField(buf, 2, l.value)
+		}
+
+		// Sample.
+		buf = append(buf, 2<<3|2)
+		buf = appendUvarint(buf, uint64(sampleSize))
+		buf = append(buf, 1<<3|1)
+		v := math.Float64bits(s.value)
+		for i := uint(0); i < 64; i += 8 {
+			buf = append(buf, uint8(v>>i))
+		}
+		buf = append(buf, 2<<3|0)
+		buf = appendUvarint(buf, uint64(s.timestamp))
+	}
+
+	return buf
+}
+
+// appendStringField appends a protobuf string field.
+func appendStringField(buf []byte, field int, s string) []byte {
+	buf = append(buf, uint8(field)<<3|2)
+	buf = appendUvarint(buf, uint64(len(s)))
+
+	return append(buf, s...)
+}
+
+// stringFieldLen returns the encoded
+// length of a protobuf string field.
+func stringFieldLen(s string) int {
+	return 1 + uvarintLen(uint64(len(s))) + len(s)
+}
+
+// uvarintLen returns the length
+// of the varint encoding of v.
+func uvarintLen(v uint64) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+
+	return n
+}
@@ -0,0 +1,378 @@
+package output
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+func TestPromName(t *testing.T) {
+	tests := []struct {
+		in     string
+		colons bool
+		want   string
+	}{
+		{"cpu_load", true, "cpu_load"},
+		{"5xx.count", true, "_5xx_count"},
+		{"1a.b-c", true, "_1a_b_c"},
+		{"http2xx_total", true, "http2xx_total"},
+		{"a.b-c", true, "a_b_c"},
+		{"job:rate5m", true, "job:rate5m"},
+		{"job:rate5m", false, "job_rate5m"},
+		{"9", false, "_9"},
+		{"", true, ""},
+	}
+
+	for _, tt := range tests {
+		if got := promName(tt.in, tt.colons); got != tt.want {
+			t.Errorf("promName(%q, %v) = %q, want %q", tt.in, tt.colons, got, tt.want)
+		}
+	}
+}
+
+func TestEncodeWriteRequest(t *testing.T) {
+	// Reference encodings made with the protobuf
+	// wire format package. Zero values are written
+	// rather than omitted, which decoders accept.
+	tests := []struct {
+		series []promSeries
+		want   string
+	}{
+		{
+			[]promSeries{
+				{[]promLabel{{"__name__", "cpu_load"}, {"host", "web01"}}, 0.42, 1500000000000},
+			},
+			"0a370a140a085f5f6e616d655f5f12086370755f6c6f61640a0d0a04686f737412057765623031121009e17a14ae47e1da3f1080b0def7d32b",
+		},
+		{
+			[]promSeries{
+				{[]promLabel{{"__name__", "a"}}, -1.5, 0},
+				{[]promLabel{{"__name__", "b"}, {"dc", strings.Repeat("x", 200)}}, 1e21, 1 << 40},
+				{[]promLabel{{"__name__", "c"}}, 0, -1},
+			},
+			"0a1c0a0d0a085f5f6e616d655f5f120161120b09000000000000f8bf10000af3010a0d0a085f5f6e616d655f5f1201620acf010a02646312c801" +
+				strings.Repeat("78", 200) +
+				"12100950efe2d6e41a4b44108080808080200a250a0d0a085f5f6e616d655f5f120163121409000000000000000010ffffffffffffffffff01",
+		},
+	}
+
+	for i, tt := range tests {
+		if got := hex.EncodeToString(encodeWriteRequest(nil, tt.series)); got != tt.want {
+			t.Errorf("request %d: got %s, want %s", i, got, tt.want)
+		}
+	}
+}
+
+// snappyDecode decodes a snappy block, returning
+// the number of elements of each kind.
+func snappyDecode(src []byte) ([]byte, map[string]int, error) {
+	n, l := binary.Uvarint(src)
+	if l <= 0 {
+		return nil, nil, errors.New("bad length")
+	}
+	src = src[l:]
+
+	dst := make([]byte, 0, n)
+	kinds := make(map[string]int)
+
+	for len(src) > 0 {
+		tag := src[0]
+		var length, offset int
+
+		switch tag & 3 {
+		case snappyLiteral:
+			length, src = int(tag>>2), src[1:]
+			switch {
+			case length == 60 && len(src) >= 1:
+				length, src = int(src[0]), src[1:]
+			case length == 61 && len(src) >= 2:
+				length, src = int(src[0])|int(src[1])<<8, src[2:]
+			case length >= 60:
+				return nil, nil, errors.New("bad literal length")
+			}
+			length++
+			if length > len(src) {
+				return nil, nil, errors.New("short literal")
+			}
+			dst, src = append(dst, src[:length]...), src[length:]
+			kinds["literal"]++
+			continue
+		case snappyCopy1:
+			if len(src) < 2 {
+				return nil, nil, errors.New("short copy")
+			}
+			length, offset, src = 4+int(tag>>2&7), int(tag>>5)<<8|int(src[1]), src[2:]
+			kinds["copy1"]++
+		case snappyCopy2:
+			if len(src) < 3 {
+				return nil, nil, errors.New("short copy")
+			}
+			length, offset, src = 1+int(tag>>2), int(src[1])|int(src[2])<<8, src[3:]
+			kinds["copy2"]++
+		default:
+			return nil, nil, errors.New("unexpected copy4")
+		}
+
+		if offset == 0 || offset > len(dst) {
+			return nil, nil, errors.New("bad offset")
+		}
+		for i := 0; i < length; i++ {
+			dst = append(dst, dst[len(dst)-offset])
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return nil, nil, errors.New("length mismatch")
+	}
+
+	return dst, kinds, nil
+}
+
+func TestSnappyEncode(t *testing.T) {
+	// Reference encodings made with github.com/golang/snappy.
+	known := []struct {
+		in, want string
+	}{
+		{strings.Repeat("abcdefgh", 10) + "0123456789", "5a1c6162636465666768fe080011082430313233343536373839"},
+		{strings.Repeat("x", 100), "640078fe01008a0100"},
+	}
+
+	for _, tt := range known {
+		if got := hex.EncodeToString(snappyEncode(nil, []byte(tt.in))); got != tt.want {
+			t.Errorf("%.10q...: got %s, want %s", tt.in, got, tt.want)
+		}
+	}
+
+	r := rand.New(rand.NewSource(1))
+	random := func(n int) []byte {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+
+	// repeat returns random bytes followed by a
+	// match of length bytes at offset.
+	repeat := func(offset, length int) []byte {
+		b := random(offset)
+		for len(b) < offset+length {
+			b = append(b, b[len(b)-offset])
+		}
+		return append(b, random(8)...)
+	}
+
+	tests := []struct {
+		name string
+		in   []byte
+		// kinds holds element kinds
+		// the encoding must contain.
+		kinds []string
+	}{
+		{"empty", nil, nil},
+		{"short", random(16), []string{"literal"}},
+		{"literal 60", random(60), []string{"literal"}},
+		{"literal 61", random(61), []string{"literal"}},
+		{"literal 256", random(256), []string{"literal"}},
+		{"literal 257", random(257), []string{"literal"}},
+		{"block", random(65536), []string{"literal"}},
+		{"blocks", random(200000), []string{"literal"}},
+		{"copy1 4", repeat(8, 4), []string{"copy1"}},
+		{"copy1 11", repeat(2047, 11), []string{"copy1"}},
+		{"copy2 12", repeat(8, 12), []string{"copy2"}},
+		{"copy2 offset", repeat(2048, 4), []string{"copy2"}},
+		{"copy 64", repeat(100, 64), []string{"copy2"}},
+		{"copy 65", repeat(100, 65), []string{"copy2", "copy1"}},
+		{"copy 67", repeat(100, 67), []string{"copy2"}},
+		{"copy 68", repeat(100, 68), []string{"copy2"}},
+		{"copy 1000", repeat(40000, 1000), []string{"copy2"}},
+		{"datapoints", bytes.Repeat([]byte("a.b.c 1 1500000000\n"), 10000), []string{"literal", "copy2"}},
+	}
+
+	for _, tt := range tests {
+		got, kinds, err := snappyDecode(snappyEncode(nil, tt.in))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, tt.in) {
+			t.Errorf("%s: decoded %d bytes don't match the input", tt.name, len(got))
+		}
+		for _, k := range tt.kinds {
+			if kinds[k] == 0 {
+				t.Errorf("%s: no %s elements in %v", tt.name, k, kinds)
+			}
+		}
+	}
+}
+
+// protoFields calls f with each length delimited
+// field of the protobuf message b.
+func protoFields(b []byte, f func(field uint64, v []byte)) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errors.New("bad key")
+		}
+		b = b[n:]
+
+		switch key & 7 {
+		case 0:
+			if _, n = binary.Uvarint(b); n <= 0 {
+				return errors.New("bad varint")
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errors.New("short fixed64")
+			}
+			b = b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return errors.New("bad length")
+			}
+			f(key>>3, b[n:n+int(l)])
+			b = b[n+int(l):]
+		default:
+			return errors.New("unexpected wire type")
+		}
+	}
+
+	return nil
+}
+
+// promNames returns the metric name of
+// each series in a WriteRequest.
+func promNames(req []byte) ([]string, error) {
+	var names []string
+
+	err := protoFields(req, func(_ uint64, ts []byte) {
+		protoFields(ts, func(field uint64, label []byte) {
+			if field != 1 {
+				return
+			}
+			var name, value string
+			protoFields(label, func(field uint64, v []byte) {
+				if field == 1 {
+					name = string(v)
+				} else {
+					value = string(v)
+				}
+			})
+			if name == "__name__" {
+				names = append(names, value)
+			}
+		})
+	})
+
+	return names, err
+}
+
+// fakeRemoteWrite is a remote_write endpoint that
+// records the series names written. Requests whose
+// number (from 1) is in fail are answered with a 500.
+type fakeRemoteWrite struct {
+	sync.Mutex
+	requests int
+	fail     map[int]bool
+	names    map[string]int
+}
+
+func (f *fakeRemoteWrite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+
+	f.Lock()
+	defer f.Unlock()
+
+	f.requests++
+	if f.fail[f.requests] {
+		http.Error(w, "unavailable", http.StatusInternalServerError)
+		return
+	}
+
+	req, _, err := snappyDecode(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	names, err := promNames(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, n := range names {
+		f.names[n]++
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// received returns how many times
+// each of names was written.
+func (f *fakeRemoteWrite) received(names ...string) []int {
+	f.Lock()
+	defer f.Unlock()
+
+	counts := make([]int, len(names))
+	for i, n := range names {
+		counts[i] = f.names[n]
+	}
+
+	return counts
+}
+
+func TestPromResendFailed(t *testing.T) {
+	defer func(d time.Duration) { writeFlushInterval = d }(writeFlushInterval)
+	writeFlushInterval = 5 * time.Millisecond
+
+	// The second request of the second
+	// batch fails.
+	f := &fakeRemoteWrite{fail: map[int]bool{3: true}, names: make(map[string]int)}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	c := pool.NewCluster("prom-resend")
+	c.QueueCap = 10
+
+	dest, err := pool.ParseDestination("prometheus://" + strings.TrimPrefix(srv.URL, "http://") +
+		"?batch-size=2&reconnect-failures=1&reconnect-backoff=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := newPromWriter(c, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go pw.Start()
+	defer pw.Shutdown()
+
+	waitFor(t, "the destination to join the pool", func() bool { return c.Queue(dest.Name) != nil })
+
+	c.Enqueue(dest.Name, batch.New("m0 1 1500000000", "m1 1 1500000000"))
+	waitFor(t, "the first batch", func() bool { return fmt.Sprint(f.received("m0", "m1")) == "[1 1]" })
+
+	c.Enqueue(dest.Name, batch.New("m2 1 1500000000", "m3 1 1500000000", "m4 1 1500000000", "m5 1 1500000000"))
+	waitFor(t, "the second batch", func() bool { return f.received("m5")[0] > 0 })
+
+	f.Lock()
+	if f.requests != 4 {
+		t.Errorf("got %d requests, want 4", f.requests)
+	}
+	f.Unlock()
+
+	// Only the failed request is resent.
+	if got := fmt.Sprint(f.received("m0", "m1", "m2", "m3", "m4", "m5")); got != "[1 1 1 1 1 1]" {
+		t.Errorf("got series written %s times, want once each", got)
+	}
+}
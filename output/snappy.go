@@ -0,0 +1,137 @@
+// Package output snappy.go implements snappy
+// block compression for remote_write requests.
+package output
+
+// Snappy element tags.
+const (
+	snappyLiteral = 0x00
+	snappyCopy1   = 0x01
+	snappyCopy2   = 0x02
+)
+
+// Snappy encoder settings. Input is compressed in
+// independent blocks so that copy offsets fit in two
+// bytes; inputs too short to hold a match are
+// emitted as a single literal.
+const (
+	snappyMaxBlockSize = 65536
+	snappyMinBlockSize = 17
+	snappyTableBits    = 14
+)
+
+// snappyEncode appends the snappy block format
+// encoding (not the framed stream format) of
+// src to dst and returns the result.
+func snappyEncode(dst, src []byte) []byte {
+	dst = appendUvarint(dst, uint64(len(src)))
+
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyMaxBlockSize {
+			block = block[:snappyMaxBlockSize]
+		}
+		src = src[len(block):]
+
+		if len(block) < snappyMinBlockSize {
+			dst = snappyEmitLiteral(dst, block)
+			continue
+		}
+		dst = snappyEncodeBlock(dst, block)
+	}
+
+	return dst
+}
+
+// snappyEncodeBlock appends the encoding of a block
+// of at most snappyMaxBlockSize bytes. Matches of
+// four or more bytes are found with a hash table of
+// the last position each four byte sequence was seen.
+func snappyEncodeBlock(dst, src []byte) []byte {
+	var table [1 << snappyTableBits]uint16
+
+	// lit is the start of the
+	// pending literal bytes.
+	lit := 0
+
+	for s := 0; s+4 <= len(src); {
+		u := load32(src, s)
+		h := (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h])
+		table[h] = uint16(s)
+
+		if candidate >= s || load32(src, candidate) != u {
+			s++
+			continue
+		}
+
+		n := 4
+		for s+n < len(src) && src[candidate+n] == src[s+n] {
+			n++
+		}
+
+		dst = snappyEmitLiteral(dst, src[lit:s])
+		dst = snappyEmitCopy(dst, s-candidate, n)
+		s += n
+		lit = s
+	}
+
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+// snappyEmitLiteral appends a literal element.
+func snappyEmitLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := len(lit) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, uint8(n)<<2|snappyLiteral)
+	case n < 1<<8:
+		dst = append(dst, 60<<2|snappyLiteral, uint8(n))
+	default:
+		dst = append(dst, 61<<2|snappyLiteral, uint8(n), uint8(n>>8))
+	}
+
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy appends copy elements for a match of
+// length bytes at offset, which are at least 4 and less
+// than snappyMaxBlockSize.
+func snappyEmitCopy(dst []byte, offset, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|snappyCopy2, uint8(offset), uint8(offset>>8))
+		length -= 64
+	}
+
+	// Leave at least 4 bytes for the final element.
+	if length > 64 {
+		dst = append(dst, 59<<2|snappyCopy2, uint8(offset), uint8(offset>>8))
+		length -= 60
+	}
+
+	if length >= 12 || offset >= 2048 {
+		return append(dst, uint8(length-1)<<2|snappyCopy2, uint8(offset), uint8(offset>>8))
+	}
+
+	return append(dst, uint8(offset>>8)<<5|uint8(length-4)<<2|snappyCopy1, uint8(offset))
+}
+
+// load32 returns the little-endian
+// uint32 at b[i:i+4].
+func load32(b []byte, i int) uint32 {
+	b = b[i : i+4]
+	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16 | uint32(b[3])<<24
+}
+
+// appendUvarint appends the varint encoding of v.
+func appendUvarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, uint8(v)|0x80)
+		v >>= 7
+	}
+
+	return append(dst, uint8(v))
+}
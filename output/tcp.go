@@ -1,50 +1,191 @@
 // Package output tcp.go writes
-// datapoints to a TCP destination.
+// datapoints to a TCP (or TLS) destination.
 package output
 
 import (
+	"bufio"
+	"crypto/tls"
 	"errors"
-	"fmt"
+	"io"
 	"log"
 	"net"
 	"strings"
 	"time"
 
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/discovery"
+	"github.com/jamiealquiza/polymur/diskqueue"
 	"github.com/jamiealquiza/polymur/pool"
 )
 
 // TCPWriterConfig holds TCP output
-// configuraiton.
+// configuraiton. Destinations, Distribution,
+// HashAlgorithm and QueueCap configure the default
+// cluster and are the defaults for any additional
+// clusters specified in Clusters (see pool.ParseClusters).
+// If SpillDir is set, destination queue overflow is
+// spilled to disk, up to SpillMaxSize megabytes and
+// SpillMaxAge seconds per destination. Retry configures
+// failed message retries for all clusters. Workers is the
+// number of goroutines distributing the IncomingQueue;
+// with more than one, batches may be delivered out of order.
+// Destination writes are buffered up to WriteBufferSize
+// bytes and flushed at least every FlushInterval. If
+// StateFile is set, destinations registered and unregistered
+// with the API are persisted to it and restored at startup
+// (see pool.State). Discovery lists destination discovery
+// providers (see discovery.Parse). DrainTimeout is the max
+// time to drain a destination (see pool.Cluster.Drain).
+// UDPMTU is the default max UDP datagram size.
+// If Backpressure is set, batches are enqueued to every
+// destination with its writer, waiting while a destination
+// queue is full or the destination isn't connected rather
+// than dropping; distribution, and in turn the listeners,
+// are blocked by the slowest destination.
+// Templates map Graphite paths for InfluxDB and
+// Prometheus destinations (see ParseTemplates).
+// Health configures destination write deadlines and
+// circuit breakers for all clusters (see pool.HealthConfig),
+// and Reconnect the default destination reconnect policy
+// (see pool.ReconnectConfig).
 type TCPWriterConfig struct {
-	Destinations  string
-	Distribution  string
-	IncomingQueue chan []*string
-	QueueCap      int
+	Destinations    string
+	Distribution    string
+	HashAlgorithm   string
+	Clusters        string
+	IncomingQueue   chan *batch.Batch
+	QueueCap        int
+	SpillDir        string
+	SpillMaxSize    int
+	SpillMaxAge     int
+	Failover        string
+	Retry           pool.RetryConfig
+	Workers         int
+	WriteBufferSize int
+	FlushInterval   time.Duration
+	StateFile       string
+	Discovery       string
+	DrainTimeout    time.Duration
+	UDPMTU          int
+	Templates       string
+	Health          pool.HealthConfig
+	Reconnect       pool.ReconnectConfig
+	Backpressure    bool
 }
 
+// Destination write buffering; see DestinationWriter.
+var (
+	writeBufferSize    = 64 << 10
+	writeFlushInterval = 100 * time.Millisecond
+)
+
+// replayBatchSize is the max number of spilled
+// messages or hints replayed per write.
+const replayBatchSize = 100
+
 // TCPWriter reads datapoints from the outbound destination
-// queue and writes it to the TCP destination.
+// queue and writes it to the TCP destination. Destinations
+// are written by the writer registered for their scheme
+// (see NewWriter), so clusters may mix output types.
 func TCPWriter(p *pool.Pool, config *TCPWriterConfig, ready chan bool) {
-	p.Lock()
-	p.Distribution = config.Distribution
-	p.QueueCap = config.QueueCap
-	p.Unlock()
+	if config.WriteBufferSize > 0 {
+		writeBufferSize = config.WriteBufferSize
+	}
+	if config.FlushInterval > 0 {
+		writeFlushInterval = config.FlushInterval
+	}
+	if config.UDPMTU > 0 {
+		udpMTU = config.UDPMTU
+	}
 
-	go retryMessageHandler(p)
+	templates, err := ParseTemplates(config.Templates)
+	if err != nil {
+		log.Fatal(err)
+	}
+	metricTemplates = templates
 
-	Destinations := strings.Split(config.Destinations, ",")
-	for _, addr := range Destinations {
-		if addr == "" {
-			continue
+	defaults := pool.ClusterConfig{
+		Name:          pool.DefaultCluster,
+		Destinations:  config.Destinations,
+		Distribution:  config.Distribution,
+		HashAlgorithm: config.HashAlgorithm,
+		QueueCap:      config.QueueCap,
+		Failover:      config.Failover,
+		DrainTimeout:  config.DrainTimeout,
+		Retry:         config.Retry,
+		Health:        config.Health,
+		Reconnect:     config.Reconnect,
+		Spill: diskqueue.Config{
+			Dir:     config.SpillDir,
+			MaxSize: int64(config.SpillMaxSize) << 20,
+			MaxAge:  time.Duration(config.SpillMaxAge) * time.Second,
+		},
+	}
+
+	clusters, err := pool.ParseClusters(config.Clusters, defaults)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	p.SetWriter(NewWriter)
+
+	var state *pool.State
+	if config.StateFile != "" {
+		state, err = pool.LoadState(config.StateFile)
+		if err != nil {
+			log.Fatalf("State file error: %s\n", err)
 		}
+		p.SetState(state)
+	}
 
-		dest, err := pool.ParseDestination(addr)
+	for _, clusterConfig := range append([]pool.ClusterConfig{defaults}, clusters...) {
+		c, err := p.AddCluster(clusterConfig)
 		if err != nil {
-			fmt.Println(err)
-			continue
+			log.Fatal(err)
+		}
+
+		go c.RetryHandler()
+		go c.HealthCheck()
+
+		Destinations := []pool.Destination{}
+		for _, addr := range strings.Split(clusterConfig.Destinations, ",") {
+			if addr == "" {
+				continue
+			}
+
+			dest, err := pool.ParseDestination(addr)
+			if err != nil {
+				log.Printf("Destination %s%s not added: %s\n", addr, c.LogSuffix(), err)
+				continue
+			}
+			dest.Source = pool.SourceFlag
+
+			Destinations = append(Destinations, dest)
 		}
 
-		go DestinationWriter(p, dest)
+		if state != nil {
+			Destinations = state.Destinations(c.Name, Destinations)
+		}
+
+		for _, dest := range Destinations {
+			if err := c.AddDestination(dest); err != nil {
+				log.Printf("%s%s\n", err, c.LogSuffix())
+			}
+		}
+	}
+
+	discoveries, err := discovery.Parse(config.Discovery)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, d := range discoveries {
+		c, err := p.Cluster(d.Cluster)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		go discovery.Run(c, d)
 	}
 
 	// In case we want any initialization to block.
@@ -54,164 +195,459 @@ func TCPWriter(p *pool.Pool, config *TCPWriterConfig, ready chan bool) {
 	ready <- true
 
 	// Pop messages from the incoming queue and distribute.
-	for messages := range config.IncomingQueue {
-		p.DistributionMethod[config.Distribution](p, messages)
+	for i := 1; i < config.Workers; i++ {
+		go distributor(p, config.IncomingQueue, config.Backpressure)
 	}
+	distributor(p, config.IncomingQueue, config.Backpressure)
 }
 
-// DestinationWriter requests a connection.
-// It dequeues from the connection outbound buffer
-// and writes to the respective destination.
-func DestinationWriter(p *pool.Pool, dest pool.Destination) {
+// distributor pops message batches from the
+// incoming queue and distributes them to the pool,
+// or enqueues them to every destination if
+// backpressure is set (see enqueueAll).
+func distributor(p *pool.Pool, incoming chan *batch.Batch, backpressure bool) {
+	for b := range incoming {
+		pool.Memory.Free(pool.MemoryIncoming, b.Size())
+		if backpressure {
+			enqueueAll(p, b)
+		} else {
+			p.Distribute(b)
+		}
+		b.Release()
+	}
+}
+
+// maxEnqueueWait is the max wait between
+// attempts to enqueue to a full queue.
+const maxEnqueueWait = 100 * time.Millisecond
+
+// enqueueAll enqueues b to every destination of every
+// cluster with the destination's writer, retrying while
+// its queue is full or it isn't connected. Destinations
+// removed while waiting are skipped.
+func enqueueAll(p *pool.Pool, b *batch.Batch) {
+	for _, c := range p.ClusterList() {
+		for name, w := range c.WriterList() {
+			wait := time.Millisecond
+			for !w.Enqueue(b) && c.Writer(name) == w {
+				time.Sleep(wait)
+				if wait < maxEnqueueWait {
+					wait *= 2
+				}
+			}
+		}
+	}
+}
+
+// newTCPWriter returns a writer for
+// a TCP (or TLS) destination.
+func newTCPWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest); err != nil {
+		return nil, err
+	}
+
+	return newDestWriter(c, dest, dialTCP, connWriter), nil
+}
+
+// connWriter requests a connection.
+// It dequeues batches from the destination outbound
+// queue and writes them to the respective destination
+// through a write buffer, which is flushed when it reaches
+// writeBufferSize and at least every writeFlushInterval.
+// Spilled messages and hints are replayed once the
+// outbound queue is drained. If the destination is
+// being drained (see pool.Cluster.Drain), the writer
+// writes the remaining queued messages and exits; if
+// it's removed, unflushed batches are redistributed
+// (see pool.Cluster.Redistribute). A destination's connection writers share its queue,
+// so messages for a series may be written out of order.
+// Once the writer is shut down, it writes any buffered
+// batches and exits.
+func connWriter(dw *destWriter) {
+	c, dest := dw.c, dw.dest
 
 	// Get initial connection.
-	p.Register(dest)
-	conn, err := establishConn(p, dest)
+	conn, err := dw.establishConn(false)
 	if err != nil {
 		return
 	}
-	defer conn.Close()
+	defer func() { conn.Close() }()
 
-	// Dequeue from destination outbound queue
-	// and send.
-	n := 1
-	for {
-		// Exponential backoff var
-		// if the channel is empty.
-		if n < 1000 {
-			n = n * 2
-		}
-
-		// Need to make sure the connection
-		// exists. It's possible that it becomes
-		// unregistered (therefore doesn't exist) between
-		// checking if it exists and attempting to read from it.
-		p.Lock()
-		_, ok := p.Conns[dest.Name]
-		if !ok {
-			p.Unlock()
-			return
+	flush := time.NewTicker(writeFlushInterval)
+	defer flush.Stop()
+
+	// The buffer is oversized so that it's flushed
+	// explicitly rather than partway through a batch.
+	w := bufio.NewWriterSize(conn, 2*writeBufferSize)
+
+	// Batches written since the last flush are resent
+	// if the flush fails. A write to a connection closed
+	// by the destination can succeed locally, losing the
+	// data, so batches from the previous flush are resent
+	// as well, unless the connection reports what was
+	// delivered (see deliverer). Batches are released
+	// once they're no longer needed for a resend.
+	var pending, flushed []*batch.Batch
+	defer func() {
+		release(pending)
+		release(flushed)
+	}()
+
+	var drain *pool.Drain
+	// drained is set once a drained
+	// queue is closed and empty.
+	var drained bool
+	// stopping is set once the
+	// writer is shut down.
+	var stopping bool
+
+	// delivered is the connection's delivered
+	// bytes as of the last flush (see deliverer).
+	var delivered int64
+
+	// reconnect waits on a new connection and resends
+	// any unflushed batches. If the destination isn't
+	// registered, it drops them and returns false.
+	reconnect := func() bool {
+		// A connection that reports delivery only
+		// resends what wasn't delivered.
+		resend, skip := append(flushed, pending...), int64(0)
+		if d, ok := conn.(deliverer); ok {
+			resend, skip = pending, d.Delivered()-delivered
 		}
 
-		// Have to do a non-blocking read attempt, otherwise
-		// unlocking the mutex will be blocked.
-		select {
-		case m, ok := <-p.Conns[dest.Name]:
-			p.Unlock()
+		conn.Close()
 
-			if !ok {
+		newConn, err := dw.establishConn(true)
+		if err != nil {
+			for _, b := range pending {
+				pool.Drops.Add(pool.DropDestinationRemoved, c.Name, dest.Name, int64(b.Len()), nil)
+			}
+			return false
+		}
+
+		conn, delivered = newConn, 0
+		w = bufio.NewWriterSize(conn, 2*writeBufferSize)
+		for _, b := range resend {
+			data := b.Bytes()
+			if skip >= int64(len(data)) {
+				skip -= int64(len(data))
+				continue
+			}
+			w.Write(data[skip:])
+			skip = 0
+		}
+
+		return true
+	}
+
+	for {
+		stopping = stopping || dw.stopping()
+
+		// The queue is replaced if the destination is
+		// removed from and re-added to the pool.
+		q, state := c.QueueState(dest.Name)
+		if q == nil && drain == nil {
+			if drain = c.Draining(dest.Name); drain != nil {
+				defer drain.Finish()
+			}
+		}
+
+		// If the circuit breaker was opened, the destination
+		// is failed; reconnect once it can be probed. A
+		// registered destination that isn't in the pool is
+		// failed as well, such as while another connection
+		// is probing it.
+		if drain == nil && !stopping && (state == pool.BreakerOpen || q == nil && state != "") {
+			if !reconnect() {
 				return
 			}
+			continue
+		}
 
-			_, err := fmt.Fprintln(conn, *m)
-			// If we fail to send, reload the message into the
-			// queue and attempt to reconnect.
-			if err != nil {
-				p.Conns[dest.Name] <- m
-				log.Printf("Destination %s error: %s\n", dest.Name, err)
+		// If it's no longer in the pool (and isn't being
+		// drained), hand any unflushed batches back to
+		// the cluster and close this writer.
+		if q == nil && drain == nil {
+			for _, b := range pending {
+				c.Redistribute(dest.Name, b)
+			}
+			return
+		}
 
-				// Wait on a connection. If the destination isn't
-				// registered, err and close this writer.
-				newConn, err := establishConn(p, dest)
-				if err != nil {
-					break
+		if drain != nil {
+			if drain.Expired() {
+				// Make a last attempt to
+				// write any buffered batches.
+				if w.Flush() == nil {
+					drain.Written(points(pending))
 				} else {
-					conn = newConn
+					for _, b := range pending {
+						pool.Drops.Add(pool.DropDestinationRemoved, c.Name, dest.Name, int64(b.Len()), nil)
+					}
 				}
+				return
 			}
-			// Reset backoff var.
-			n = 1
+			q = drain.Queue()
+		}
+
+		var b *batch.Batch
+
+		select {
+		case qb, ok := <-q.C:
+			if !ok {
+				drained = drain != nil
+				break
+			}
+			q.Done(qb)
+			b = qb
 		default:
-			p.Unlock()
-			time.Sleep(time.Duration(n) * time.Millisecond)
+			// The queue is drained; replay any spilled
+			// messages and hints before blocking.
+			if drain == nil {
+				if b = c.Replay(dest.Name, replayBatchSize); b != nil {
+					break
+				}
+			}
+
+			select {
+			case qb, ok := <-q.C:
+				if !ok {
+					drained = drain != nil
+					break
+				}
+				q.Done(qb)
+				b = qb
+			case <-flush.C:
+			case <-dw.stop:
+				stopping = true
+			}
+		}
+
+		if b != nil {
+			w.Write(b.Bytes())
+			pending = append(pending, b)
+		}
+
+		if w.Buffered() < writeBufferSize && b != nil && !stopping {
 			continue
 		}
 
+		// If we fail to send, attempt to reconnect
+		// and resend any unflushed batches.
+		for err := w.Flush(); err != nil; err = w.Flush() {
+			log.Printf("Destination %s error: %s\n", dest.Name, err)
+			if drain == nil {
+				c.WriteFailed(dest, err)
+			}
+
+			if stopping || !reconnect() {
+				return
+			}
+		}
+
+		if drain != nil {
+			drain.Written(points(pending))
+		}
+
+		if d, ok := conn.(deliverer); ok {
+			delivered = d.Delivered()
+		}
+
+		if len(pending) > 0 {
+			if drain == nil {
+				c.WriteSucceeded(dest)
+			}
+			release(flushed)
+			flushed, pending = pending, flushed[:0]
+		}
+
+		if drained || stopping {
+			return
+		}
+	}
+}
+
+// deliverer is implemented by connections whose
+// writes return once the destination has accepted
+// the data, such as HTTP APIs. Delivered returns the
+// bytes written to the connection that were accepted.
+type deliverer interface {
+	Delivered() int64
+}
+
+// points returns the number of
+// messages in batches.
+func points(batches []*batch.Batch) int {
+	var n int
+	for _, b := range batches {
+		n += b.Len()
 	}
+
+	return n
 }
 
-// establishConn manages TCP connections. Upon successful
+// release releases each batch in batches.
+func release(batches []*batch.Batch) {
+	for _, b := range batches {
+		b.Release()
+	}
+}
+
+// establishConn manages destination connections, opened
+// with the writer's dial function. Upon successful
 // connection, establishConn will add the respective outbound
-// queue to the global connection pool.	If a previously existing connection is
-// being retried but fails for 3 consecutive attempts, it will be removed
-// from the global pool. Background attempts will continue and the connection
-// will rejoin the pool upon success.
-func establishConn(p *pool.Pool, dest pool.Destination) (net.Conn, error) {
-	retry := 0
-	retryMax := 3
+// queue to the global connection pool. Failed attempts are
+// retried according to the destination's reconnect policy
+// (see pool.ReconnectConfig). If a previously existing
+// connection fails for the policy's max failures, its circuit
+// breaker is opened (see pool.Cluster.OpenBreaker). While the
+// breaker is open, connection attempts wait until the
+// destination can be probed; the breaker is then half-open
+// and the destination rejoins the pool upon success. Writes
+// to the returned connection fail if they exceed the
+// destination write timeout. reconnect is set if the
+// calling writer has previously been connected. Attempts
+// are abandoned once the writer is shut down.
+func (w *destWriter) establishConn(reconnect bool) (io.WriteCloser, error) {
+	c, dest := w.c, w.dest
+	policy := c.ReconnectPolicy(dest)
 
 	for {
 		// If it's not registered, abort.
-		if _, destinationRegistered := p.Registered[dest.Name]; !destinationRegistered {
+		registered, active := c.ConnState(dest.Name)
+		if !registered {
 			return nil, errors.New("Destination not registered")
 		}
 
-		_, connectionIsInPool := p.Conns[dest.Name]
-
-		// Are we retrying a previously established connection that failed?
-		if retry >= retryMax && connectionIsInPool {
-			log.Printf("Exceeded retry count (%d) for destination %s\n", retryMax, dest.Name)
-			p.RemoveConn(dest)
+		if w.stopping() {
+			return nil, errors.New("Writer shut down")
 		}
 
-		// Try a connection every 10s.
-		conn, err := net.DialTimeout("tcp", dest.Addr, time.Duration(3*time.Second))
+		// Wait to probe a failed destination. Registration
+		// is rechecked at least every second.
+		if wait := time.Until(c.ProbeAt(dest.Name)); wait > 0 && c.Draining(dest.Name) == nil {
+			if wait > time.Second {
+				wait = time.Second
+			}
+			time.Sleep(wait)
+			continue
+		}
 
+		conn, err := w.dial(dest, policy.DialTimeout)
 		if err != nil {
-			log.Printf("Destination error: %s, retrying in 10s\n", err)
-			time.Sleep(10 * time.Second)
-			// Increment failure count.
-			retry++
+			failures := c.ConnFailed(dest, err)
+
+			// Are we retrying a previously established connection that failed?
+			if failures == policy.MaxFailures && active {
+				log.Printf("Exceeded retry count (%d) for destination %s\n", policy.MaxFailures, dest.Name)
+				c.OpenBreaker(dest, pool.BreakerReconnect)
+			}
+
+			backoff := policy.Backoff(failures)
+			log.Printf("Destination error: %s, retrying in %s\n", err, backoff-backoff%time.Millisecond)
+			select {
+			case <-time.After(backoff):
+			case <-w.stop:
+			}
 			continue
+		}
+
+		c.Connected(dest, reconnect)
+		conn = withWriteTimeout(conn, writeTimeout(c, dest))
+
+		// A draining destination isn't re-added.
+		if c.Draining(dest.Name) != nil {
+			log.Printf("Reconnected to draining destination: %s\n", dest.Name)
+			return conn, nil
+		}
+
+		// A failed destination is probed.
+		c.HalfOpenBreaker(dest)
+
+		// If this connection succeeds and is not in the pool
+		if _, active = c.ConnState(dest.Name); !active {
+			log.Printf("Adding destination to connection pool: %s\n", dest.Name)
+			c.AddConn(dest)
 		} else {
-			// If this connection succeeds and is not in the pool
-			if !connectionIsInPool {
-				log.Printf("Adding destination to connection pool: %s\n", dest.Name)
-				p.AddConn(dest)
-			} else {
-				// If this connection is still in the pool, we're
-				// likely here due to a temporary disconnect.
+			// If this connection is still in the pool, we're
+			// likely here due to a temporary disconnect, or
+			// another of the destination's connections added it.
+			if reconnect {
 				log.Printf("Reconnected to destination: %s\n", dest.Name)
+			} else {
+				log.Printf("Added connection to destination: %s\n", dest.Name)
 			}
-
-			return conn, nil
+			c.RestoreConn(dest)
 		}
 
+		return conn, nil
 	}
+}
 
+// dialTCP connects to dest, over TLS if configured.
+// The timeout includes the TLS handshake.
+func dialTCP(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+	if dest.TLS == nil {
+		return net.DialTimeout("tcp", dest.Addr, timeout)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", dest.Addr, dest.TLS.Config())
 }
 
-// retryMessageHandler catches any messages loaded
-// into the failedMessage queue and retries Distribution.
-// TODO: needs exponential backoff when no Destinations
-// are available; messages will enter a tight loop.
-func retryMessageHandler(p *pool.Pool) {
-	flushTimeout := time.Tick(15 * time.Second)
-	messages := []*string{}
-	batchSize := 30
+// writeTimeout returns the write
+// timeout for a destination.
+func writeTimeout(c *pool.Cluster, dest pool.Destination) time.Duration {
+	if dest.WriteTimeout != 0 {
+		return dest.WriteTimeout
+	}
 
-	for {
-		// We hit the flush timeout, load the current batch if present.
-		select {
-		case <-flushTimeout:
-			if len(messages) > 0 {
-				p.DistributionMethod[p.Distribution](p, messages)
-				messages = []*string{}
-			}
-			messages = []*string{}
-		case retry := <-p.RetryQueue:
-			// If this puts us at the batchSize threshold, enqueue
-			// into the messageIncomingQueue.
-			if len(messages)+1 >= batchSize {
-				messages = append(messages, retry...)
-				// Lazy latency injection to tame loops. See TODO.
-				time.Sleep(500 * time.Millisecond)
-				p.DistributionMethod[p.Distribution](p, messages)
-				messages = []*string{}
-			} else {
-				// Otherwise, just append message to current batch.
-				messages = append(messages, retry...)
-			}
+	return c.Health.WriteTimeout
+}
+
+// withWriteTimeout applies a write timeout to conn,
+// if it's a network or HTTP connection.
+func withWriteTimeout(conn io.WriteCloser, timeout time.Duration) io.WriteCloser {
+	switch conn := conn.(type) {
+	case net.Conn:
+		return newDeadlineConn(conn, timeout)
+	case *httpConn:
+		if timeout > 0 {
+			conn.config.client.Timeout = timeout
+		}
+	case *influxConn:
+		if timeout > 0 {
+			conn.client.Timeout = timeout
 		}
+	case *promConn:
+		if timeout > 0 {
+			conn.client.Timeout = timeout
+		}
+	}
+
+	return conn
+}
+
+// deadlineConn is a net.Conn that sets
+// a write deadline before each write.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// newDeadlineConn wraps conn with a write timeout.
+// A non-positive timeout returns conn as is.
+func newDeadlineConn(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
 	}
+
+	return &deadlineConn{Conn: conn, timeout: timeout}
+}
+
+// Write sets the write deadline and writes p.
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Write(p)
 }
@@ -0,0 +1,359 @@
+package output
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+}
+
+// benchBatchSize is the number of data
+// points per batch written by benchmarks.
+const benchBatchSize = 100
+
+// countingSink starts a TCP listener that
+// counts received data points. It returns the
+// listener address and a channel that's closed
+// once want data points are received.
+func countingSink(t testing.TB, want int64) (string, chan struct{}) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var received int64
+	done := make(chan struct{})
+
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf := make([]byte, 64<<10)
+		for {
+			n, err := conn.Read(buf)
+			if atomic.AddInt64(&received, int64(bytes.Count(buf[:n], []byte{'\n'}))) >= want {
+				close(done)
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return l.Addr().String(), done
+}
+
+// legacyWriter is the destination writer prior to
+// batch queues: a per-message queue read with locked,
+// non-blocking receives and a sleep backoff when idle,
+// and a write per message.
+func legacyWriter(mu *sync.Mutex, q chan *string, conn net.Conn) {
+	n := 1
+	for {
+		if n < 1000 {
+			n = n * 2
+		}
+
+		mu.Lock()
+		select {
+		case m, ok := <-q:
+			mu.Unlock()
+			if !ok {
+				return
+			}
+			if _, err := fmt.Fprintln(conn, *m); err != nil {
+				return
+			}
+			n = 1
+		default:
+			mu.Unlock()
+			time.Sleep(time.Duration(n) * time.Millisecond)
+		}
+	}
+}
+
+// BenchmarkWriteLegacy measures writing batches of
+// data points to a TCP destination with the prior
+// implementation.
+func BenchmarkWriteLegacy(b *testing.B) {
+	addr, done := countingSink(b, int64(b.N*benchBatchSize))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	var mu sync.Mutex
+	q := make(chan *string, b.N*benchBatchSize)
+	go legacyWriter(&mu, q, conn)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < benchBatchSize; j++ {
+			m := fmt.Sprintf("bench.series.%d 1 1500000000", j)
+			q <- &m
+		}
+	}
+	<-done
+	b.StopTimer()
+	close(q)
+}
+
+// BenchmarkWrite measures writing batches of data
+// points to a TCP destination through its writer.
+func BenchmarkWrite(b *testing.B) {
+	addr, done := countingSink(b, int64(b.N*benchBatchSize))
+
+	c := pool.NewCluster(pool.DefaultCluster)
+	c.Distribution = "broadcast"
+	c.QueueCap = b.N * benchBatchSize
+
+	dest, err := pool.ParseDestination(addr)
+	if err != nil {
+		b.Fatal(err)
+	}
+	w, err := newTCPWriter(c, dest)
+	if err != nil {
+		b.Fatal(err)
+	}
+	go w.Start()
+	defer w.Shutdown()
+
+	for c.Queue(dest.Name) == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bt := batch.Get()
+		for j := 0; j < benchBatchSize; j++ {
+			bt.AppendString(fmt.Sprintf("bench.series.%d 1 1500000000", j))
+		}
+		c.Distribute(bt)
+		bt.Release()
+	}
+	<-done
+}
+
+// queueWriter is a pool.Writer that
+// only enqueues to the cluster.
+type queueWriter struct {
+	c    *pool.Cluster
+	name string
+}
+
+func (queueWriter) Start()                        {}
+func (queueWriter) Shutdown()                     {}
+func (w queueWriter) Enqueue(b *batch.Batch) bool { return w.c.Enqueue(w.name, b) }
+func (queueWriter) Health() pool.BreakerStatus    { return pool.BreakerStatus{} }
+func (queueWriter) Stats() pool.ConnStatus        { return pool.ConnStatus{} }
+
+func TestEnqueueAllBackpressure(t *testing.T) {
+	p := pool.NewPool()
+	p.SetWriter(func(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+		return queueWriter{c: c, name: dest.Name}, nil
+	})
+
+	c, err := p.AddCluster(pool.ClusterConfig{
+		Name:          pool.DefaultCluster,
+		Distribution:  "broadcast",
+		HashAlgorithm: "carbon_ch",
+		QueueCap:      1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, _ := pool.ParseDestination("127.0.0.1:2003")
+	if err := c.AddDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+	c.Register(dest)
+	c.AddConn(dest)
+
+	// The second batch waits for
+	// the full queue to be read.
+	done := make(chan struct{})
+	go func() {
+		enqueueAll(p, batch.New("a.b 1 1500000000"))
+		enqueueAll(p, batch.New("a.b 2 1500000000"))
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("enqueued to a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	q := c.Queue(dest.Name)
+	for i := 1; i <= 2; i++ {
+		select {
+		case b := <-q.C:
+			q.Done(b)
+			if string(b.Point(0)) != fmt.Sprintf("a.b %d 1500000000", i) {
+				t.Errorf("got %s", b.Point(0))
+			}
+			b.Release()
+		case <-time.After(time.Second):
+			t.Fatalf("batch %d not enqueued", i)
+		}
+	}
+	<-done
+
+	// A removed destination is skipped.
+	c.Unregister(dest)
+	enqueueAll(p, batch.New("a.b 3 1500000000"))
+}
+
+// lineSink starts a TCP listener that accepts any
+// number of connections and records the distinct
+// lines received. It returns the listener address
+// and a func reporting whether a line was received.
+func lineSink(t *testing.T) (string, func(string) bool) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	lines := make(map[string]bool)
+
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				s := bufio.NewScanner(conn)
+				for s.Scan() {
+					mu.Lock()
+					lines[s.Text()] = true
+					mu.Unlock()
+				}
+			}()
+		}
+	}()
+
+	return l.Addr().String(), func(line string) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return lines[line]
+	}
+}
+
+// waitFor fails the test if cond isn't
+// true within a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestConnWriterBreaker(t *testing.T) {
+	defer func(d time.Duration) { writeFlushInterval = d }(writeFlushInterval)
+	writeFlushInterval = 5 * time.Millisecond
+
+	addr, received := lineSink(t)
+
+	c := pool.NewCluster("conn-writer-breaker")
+	c.QueueCap = 10
+	c.Health.OpenTimeout = 20 * time.Millisecond
+	c.Health.CheckInterval = time.Millisecond
+
+	dest, _ := pool.ParseDestination(addr)
+	pw, err := newTCPWriter(c, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := pw.(*destWriter)
+	go w.Start()
+	defer w.Shutdown()
+
+	for i := 1; i <= 10; i++ {
+		waitFor(t, "the destination to rejoin the pool", func() bool { return c.Queue(dest.Name) != nil })
+
+		m := fmt.Sprintf("a.b %d 1500000000", i)
+		if !c.Enqueue(dest.Name, batch.New(m)) {
+			t.Fatal("enqueue failed")
+		}
+		waitFor(t, "the breaker to close", func() bool {
+			return received(m) && c.BreakerState(dest.Name) == pool.BreakerClosed
+		})
+
+		if i%2 == 0 {
+			c.OpenBreaker(dest, pool.BreakerWriteFailures)
+		} else {
+			// The destination is removed from the pool
+			// before its breaker is opened, as when the
+			// writer reads its state in between.
+			c.RemoveConn(dest)
+		}
+
+		select {
+		case <-w.done:
+			t.Fatal("writer exited")
+		default:
+		}
+	}
+}
+
+func TestReconnectBreaker(t *testing.T) {
+	c := pool.NewCluster("reconnect-breaker")
+	c.Health.OpenTimeout = 10 * time.Millisecond
+
+	dest, _ := pool.ParseDestination("127.0.0.1:2003?reconnect-failures=3&reconnect-backoff=1")
+	c.Register(dest)
+	c.AddConn(dest)
+
+	// Each attempt records the breaker state
+	// left by the previous attempts.
+	var states []string
+	var w *destWriter
+	w = newDestWriter(c, dest, func(pool.Destination, time.Duration) (io.WriteCloser, error) {
+		states = append(states, c.BreakerState(dest.Name))
+		if len(states) == 4 {
+			w.stopOnce.Do(func() { close(w.stop) })
+		}
+		return nil, errors.New("connection refused")
+	}, nil)
+
+	if _, err := w.establishConn(true); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	want := []string{pool.BreakerClosed, pool.BreakerClosed, pool.BreakerClosed, pool.BreakerOpen}
+	if fmt.Sprint(states) != fmt.Sprint(want) {
+		t.Errorf("got states %v, want %v", states, want)
+	}
+	if h := c.DestinationHealth(dest.Name); h.Reason != pool.BreakerReconnect {
+		t.Errorf("got reason %q, want %q", h.Reason, pool.BreakerReconnect)
+	}
+}
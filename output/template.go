@@ -0,0 +1,190 @@
+// Package output template.go maps Graphite
+// paths to measurements, tags and fields.
+package output
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Template maps Graphite paths to a measurement (or
+// metric name), tags and field, in the form of InfluxDB
+// Graphite templates: "[filter] template [tag=value,...]".
+// The filter is a dot-delimited glob pattern matched
+// against the leading nodes of a path. Each template node
+// names what the respective path node is used as:
+// "measurement", "field", a tag name, or nothing (the node
+// is skipped). A final "measurement*" or "field*" takes the
+// remaining nodes. The trailing tags are added to every path
+// matching the template. For example, with the template
+// "servers.* .host.measurement.field*", the path
+// "servers.web01.cpu.load.shortterm" has the measurement
+// "cpu", the tag host=web01 and the field "load.shortterm".
+type Template struct {
+	filter []string
+	nodes  []string
+	tags   map[string]string
+}
+
+// Templates is a template list. A path is mapped
+// by the first template whose filter matches it.
+type Templates []*Template
+
+// ParseTemplates parses a semicolon-delimited
+// template list (see Template).
+func ParseTemplates(s string) (Templates, error) {
+	templates := Templates{}
+
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+
+		t, err := parseTemplate(spec)
+		if err != nil {
+			return nil, fmt.Errorf("Template %s not valid: %s", spec, err)
+		}
+		templates = append(templates, t)
+	}
+
+	return templates, nil
+}
+
+// parseTemplate parses a single template.
+func parseTemplate(spec string) (*Template, error) {
+	parts := strings.Fields(spec)
+
+	var filter, template, tags string
+	switch len(parts) {
+	case 1:
+		template = parts[0]
+	case 2:
+		// The second part is either
+		// the template or the tags.
+		if strings.Contains(parts[1], "=") {
+			template, tags = parts[0], parts[1]
+		} else {
+			filter, template = parts[0], parts[1]
+		}
+	case 3:
+		filter, template, tags = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("too many fields")
+	}
+
+	t := &Template{
+		nodes: strings.Split(template, "."),
+		tags:  map[string]string{},
+	}
+
+	if filter != "" {
+		t.filter = strings.Split(filter, ".")
+		for _, f := range t.filter {
+			if _, err := path.Match(f, ""); err != nil {
+				return nil, fmt.Errorf("filter: %s", err)
+			}
+		}
+	}
+
+	for i, n := range t.nodes {
+		if strings.HasSuffix(n, "*") && i != len(t.nodes)-1 {
+			return nil, fmt.Errorf("%s must be the last node", n)
+		}
+		if strings.HasSuffix(n, "*") && n != "measurement*" && n != "field*" {
+			return nil, fmt.Errorf("unknown node %s", n)
+		}
+	}
+
+	if tags != "" {
+		for _, tag := range strings.Split(tags, ",") {
+			kv := strings.SplitN(tag, "=", 2)
+			if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+				return nil, fmt.Errorf("tag %s must take the form key=value", tag)
+			}
+			t.tags[kv[0]] = kv[1]
+		}
+	}
+
+	return t, nil
+}
+
+// match returns whether the template
+// filter matches the path nodes.
+func (t *Template) match(nodes []string) bool {
+	if len(t.filter) > len(nodes) {
+		return false
+	}
+
+	for i, f := range t.filter {
+		if ok, _ := path.Match(f, nodes[i]); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Apply maps a Graphite path with the first
+// matching template. Measurement and field nodes
+// (and tag values taken from more than one node) are
+// joined with sep. If no template matches, or the
+// template has no measurement nodes, the measurement
+// is the path. The field is empty if the template
+// has no field nodes.
+func (ts Templates) Apply(p, sep string) (measurement, field string, tags map[string]string) {
+	nodes := strings.Split(p, ".")
+	tags = map[string]string{}
+
+	var t *Template
+	for _, candidate := range ts {
+		if candidate.match(nodes) {
+			t = candidate
+			break
+		}
+	}
+
+	if t == nil {
+		return strings.Join(nodes, sep), "", tags
+	}
+
+	for k, v := range t.tags {
+		tags[k] = v
+	}
+
+	var m, f []string
+	// Tags taken from path nodes override
+	// those set with the template.
+	pathTags := map[string][]string{}
+
+	for i, n := range t.nodes {
+		if i >= len(nodes) {
+			break
+		}
+
+		switch n {
+		case "":
+		case "measurement":
+			m = append(m, nodes[i])
+		case "measurement*":
+			m = append(m, nodes[i:]...)
+		case "field":
+			f = append(f, nodes[i])
+		case "field*":
+			f = append(f, nodes[i:]...)
+		default:
+			pathTags[n] = append(pathTags[n], nodes[i])
+		}
+	}
+
+	for k, v := range pathTags {
+		tags[k] = strings.Join(v, sep)
+	}
+
+	if len(m) == 0 {
+		m = nodes
+	}
+
+	return strings.Join(m, sep), strings.Join(f, sep), tags
+}
@@ -0,0 +1,80 @@
+package output
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTemplates(t *testing.T) {
+	valid := []string{
+		"",
+		"measurement*",
+		".host.measurement.field*",
+		"servers.* .host.measurement.field* dc=us-east",
+		"servers.* .host.measurement.field*;stats.* .measurement*",
+		"measurement.field dc=us-east,env=prod",
+	}
+
+	for _, s := range valid {
+		if _, err := ParseTemplates(s); err != nil {
+			t.Errorf("%q: %s", s, err)
+		}
+	}
+
+	invalid := []string{
+		"measurement*.field",
+		"host.tags*",
+		"servers.* measurement dc",
+		"servers.* measurement dc=",
+		"servers.[ measurement",
+		"a b c=d e",
+	}
+
+	for _, s := range invalid {
+		if _, err := ParseTemplates(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestTemplatesApply(t *testing.T) {
+	templates, err := ParseTemplates("servers.* .host.measurement.field* dc=us-east;" +
+		"stats.timers.* ..measurement.field;" +
+		"stats.* .measurement* env=prod;" +
+		"app.*.* .region.region.measurement.field")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path        string
+		measurement string
+		field       string
+		tags        map[string]string
+	}{
+		// measurement and field*, with template tags.
+		{"servers.web01.cpu.load.shortterm", "cpu", "load.shortterm", map[string]string{"host": "web01", "dc": "us-east"}},
+		// The first matching filter is used.
+		{"stats.timers.api.p99", "api", "p99", map[string]string{}},
+		// measurement* takes the remaining nodes.
+		{"stats.counters.api.requests", "counters.api.requests", "", map[string]string{"env": "prod"}},
+		// Tags from more than one node are joined.
+		{"app.us.east.requests.count", "requests", "count", map[string]string{"region": "us.east"}},
+		// Paths shorter than the template.
+		{"servers.web01", "servers.web01", "", map[string]string{"host": "web01", "dc": "us-east"}},
+		// No match.
+		{"collectd.web01.cpu", "collectd.web01.cpu", "", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		measurement, field, tags := templates.Apply(tt.path, ".")
+		if measurement != tt.measurement || field != tt.field || !reflect.DeepEqual(tags, tt.tags) {
+			t.Errorf("%s: got (%q, %q, %v), want (%q, %q, %v)",
+				tt.path, measurement, field, tags, tt.measurement, tt.field, tt.tags)
+		}
+	}
+
+	if m, f, _ := templates.Apply("servers.web01.cpu.load.shortterm", "_"); m != "cpu" || f != "load_shortterm" {
+		t.Errorf("sep _: got (%q, %q)", m, f)
+	}
+}
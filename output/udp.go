@@ -0,0 +1,221 @@
+// Package output udp.go writes
+// datapoints to a UDP destination.
+package output
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// udpMTU is the default max UDP datagram
+// size; see TCPWriterConfig.UDPMTU.
+var udpMTU = 1472
+
+// newUDPWriter returns a writer for a UDP destination.
+// The mtu option overrides udpMTU.
+func newUDPWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	if err := checkOptions(dest, "mtu"); err != nil {
+		return nil, err
+	}
+
+	if dest.TLS != nil {
+		return nil, errors.New("tls isn't supported for udp destinations")
+	}
+
+	if dest.Port == "" {
+		return nil, errors.New("udp destinations take the form udp://ip:port")
+	}
+
+	mtu := udpMTU
+	if v := dest.Options.Get("mtu"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("mtu must be a positive integer")
+		}
+		mtu = n
+	}
+
+	write := func(w *destWriter) { udpWriter(w, mtu) }
+
+	return newDestWriter(c, dest, dialUDP, write), nil
+}
+
+// dialUDP connects to dest.
+func dialUDP(dest pool.Destination, timeout time.Duration) (io.WriteCloser, error) {
+	return net.DialTimeout("udp", dest.Addr, timeout)
+}
+
+// udpWriter dequeues batches from the destination
+// outbound queue and writes them to the respective UDP
+// destination, packing as many messages per datagram as fit
+// in the destination MTU. A message larger than the MTU is
+// sent in its own datagram. Partially filled datagrams are
+// sent at least every writeFlushInterval. Messages in
+// datagrams that fail to send are dropped. Queue, drain
+// and circuit breaker handling is as with connWriter.
+func udpWriter(w *destWriter, mtu int) {
+	c, dest := w.c, w.dest
+
+	conn, err := w.establishConn(false)
+	if err != nil {
+		return
+	}
+	defer func() { conn.Close() }()
+
+	flush := time.NewTicker(writeFlushInterval)
+	defer flush.Stop()
+
+	packet := make([]byte, 0, mtu)
+	// points is the number of
+	// messages in packet.
+	var points int
+
+	// Sent and failed datagrams are
+	// reported every writeFlushInterval.
+	var sent, failed int64
+	var sendErr error
+	report := func() {
+		if sent == 0 && failed == 0 {
+			return
+		}
+		c.PacketsSent(dest, sent, failed, sendErr)
+		if sent > 0 && sendErr == nil {
+			c.WriteSucceeded(dest)
+		}
+		sent, failed, sendErr = 0, 0, nil
+	}
+	defer report()
+
+	var drain *pool.Drain
+	send := func() {
+		if points == 0 {
+			return
+		}
+
+		if _, err := conn.Write(packet); err != nil {
+			if failed == 0 {
+				log.Printf("Destination %s error: %s\n", dest.Name, err)
+			}
+			failed++
+			sendErr = err
+			pool.Drops.Add(pool.DropWriteError, c.Name, dest.Name, int64(points), nil)
+			if drain == nil {
+				c.WriteFailed(dest, err)
+			}
+		} else {
+			sent++
+			if drain != nil {
+				drain.Written(points)
+			}
+		}
+
+		packet, points = packet[:0], 0
+	}
+	defer send()
+
+	for {
+		if w.stopping() {
+			return
+		}
+
+		q, state := c.QueueState(dest.Name)
+		if q == nil && drain == nil {
+			if drain = c.Draining(dest.Name); drain != nil {
+				defer drain.Finish()
+			}
+		}
+
+		// If the circuit breaker was opened, or the
+		// destination is registered but not in the pool,
+		// it's failed; reconnect once it can be probed.
+		if drain == nil && (state == pool.BreakerOpen || q == nil && state != "") {
+			report()
+			conn.Close()
+
+			newConn, err := w.establishConn(true)
+			if err != nil {
+				pool.Drops.Add(pool.DropDestinationRemoved, c.Name, dest.Name, int64(points), nil)
+				points = 0
+				return
+			}
+
+			conn = newConn
+			continue
+		}
+
+		if q == nil && drain == nil {
+			return
+		}
+
+		if drain != nil {
+			if drain.Expired() {
+				send()
+				return
+			}
+			q = drain.Queue()
+		}
+
+		var b *batch.Batch
+
+		select {
+		case qb, ok := <-q.C:
+			if !ok {
+				send()
+				return
+			}
+			q.Done(qb)
+			b = qb
+		default:
+			// The queue is drained; send any partial
+			// datagram and replay any spilled messages
+			// and hints before blocking.
+			send()
+			if drain == nil {
+				if b = c.Replay(dest.Name, replayBatchSize); b != nil {
+					break
+				}
+			}
+
+			select {
+			case qb, ok := <-q.C:
+				if !ok {
+					send()
+					return
+				}
+				q.Done(qb)
+				b = qb
+			case <-flush.C:
+				report()
+				continue
+			case <-w.stop:
+				return
+			}
+		}
+
+		for i := 0; i < b.Len(); i++ {
+			m := b.Point(i)
+			if len(packet)+len(m)+1 > mtu {
+				send()
+			}
+			packet = append(packet, m...)
+			packet = append(packet, '\n')
+			points++
+		}
+		b.Release()
+
+		select {
+		case <-flush.C:
+			send()
+			report()
+		default:
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package output
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+func TestUDPWriterPacking(t *testing.T) {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	const mtu = 64
+
+	c := pool.NewCluster("udp-packing")
+	c.QueueCap = 100
+
+	dest, _ := pool.ParseDestination(fmt.Sprintf("udp://%s?mtu=%d", l.LocalAddr(), mtu))
+	w, err := newUDPWriter(c, dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go w.Start()
+	defer w.Shutdown()
+
+	waitFor(t, "the destination to join the pool", func() bool { return c.Queue(dest.Name) != nil })
+
+	// Datapoints of varying length, including
+	// one larger than the MTU.
+	var points []string
+	for i := 0; i < 40; i++ {
+		points = append(points, fmt.Sprintf("servers.web%0*d.cpu %d 1500000000", i%7+1, i, i))
+	}
+	points[20] = "servers." + strings.Repeat("x", mtu) + " 1 1500000000"
+
+	if !c.Enqueue(dest.Name, batch.New(points...)) {
+		t.Fatal("enqueue failed")
+	}
+
+	var datagrams [][]byte
+	var lines []string
+	buf := make([]byte, 64<<10)
+	l.SetReadDeadline(time.Now().Add(time.Second))
+	for len(lines) < len(points) {
+		n, _, err := l.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("got %d of %d datapoints: %s", len(lines), len(points), err)
+		}
+
+		d := append([]byte(nil), buf[:n]...)
+		datagrams = append(datagrams, d)
+		lines = append(lines, strings.Split(strings.TrimSuffix(string(d), "\n"), "\n")...)
+
+		// Datapoints aren't split across datagrams.
+		if !bytes.HasSuffix(d, []byte{'\n'}) {
+			t.Errorf("datagram %q doesn't end with a datapoint", d)
+		}
+		// Only a single oversized datapoint
+		// exceeds the MTU.
+		if n > mtu && bytes.Count(d, []byte{'\n'}) != 1 {
+			t.Errorf("got a %d byte datagram of %d datapoints", n, bytes.Count(d, []byte{'\n'}))
+		}
+	}
+
+	if strings.Join(lines, "\n") != strings.Join(points, "\n") {
+		t.Errorf("got datapoints %q, want %q", lines, points)
+	}
+
+	// Datagrams are packed: the first datapoint
+	// of each datagram didn't fit in the previous.
+	for i := 1; i < len(datagrams); i++ {
+		next := bytes.IndexByte(datagrams[i], '\n') + 1
+		if len(datagrams[i-1])+next <= mtu {
+			t.Errorf("datagram %d (%d bytes) sent with room for %d more", i-1, len(datagrams[i-1]), next)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Package output writer.go implements
+// the destination writer registry.
+package output
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// writers holds the WriterFunc registered
+// for each destination URL scheme.
+var (
+	writersMu sync.RWMutex
+	writers   = map[string]pool.WriterFunc{}
+)
+
+func init() {
+	RegisterWriter("tcp", newTCPWriter)
+	RegisterWriter("udp", newUDPWriter)
+	RegisterWriter("https", newHTTPWriter)
+	RegisterWriter("console", newConsoleWriter)
+	RegisterWriter("file", newFileWriter)
+	RegisterWriter("influx", newInfluxWriter)
+	RegisterWriter("prometheus", newPromWriter)
+}
+
+// RegisterWriter registers f as the WriterFunc for
+// destinations with the given URL scheme, such as "tcp"
+// for "tcp://ip:port", replacing any registered for it.
+func RegisterWriter(scheme string, f pool.WriterFunc) {
+	writersMu.Lock()
+	writers[scheme] = f
+	writersMu.Unlock()
+}
+
+// NewWriter returns a writer for dest with the WriterFunc
+// registered for its scheme. It's the pool's WriterFunc,
+// so that a cluster can route to any mix of outputs.
+func NewWriter(c *pool.Cluster, dest pool.Destination) (pool.Writer, error) {
+	writersMu.RLock()
+	f, registered := writers[dest.Scheme]
+	writersMu.RUnlock()
+
+	if !registered {
+		return nil, fmt.Errorf("unknown scheme %s", dest.Scheme)
+	}
+
+	return f(c, dest)
+}
+
+// destWriter is a pool.Writer that writes a destination's
+// queue over connections opened by dial, with a write
+// function (such as connWriter) run for each of the
+// destination's connections. Outputs differ in dial
+// and write; queueing, reconnects, health checks and
+// draining are handled by the cluster.
+type destWriter struct {
+	c     *pool.Cluster
+	dest  pool.Destination
+	dial  func(pool.Destination, time.Duration) (io.WriteCloser, error)
+	write func(*destWriter)
+	// stop is closed by Shutdown;
+	// done once Start returns.
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+// newDestWriter returns a *destWriter for dest.
+func newDestWriter(c *pool.Cluster, dest pool.Destination, dial func(pool.Destination, time.Duration) (io.WriteCloser, error), write func(*destWriter)) *destWriter {
+	return &destWriter{
+		c:     c,
+		dest:  dest,
+		dial:  dial,
+		write: write,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// Start registers the destination and runs
+// a write function for each of its connections.
+func (w *destWriter) Start() {
+	defer close(w.done)
+
+	w.c.Register(w.dest)
+
+	var wg sync.WaitGroup
+	wg.Add(w.dest.Connections)
+	for i := 0; i < w.dest.Connections; i++ {
+		go func() {
+			w.write(w)
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+}
+
+// Enqueue queues b for the destination.
+func (w *destWriter) Enqueue(b *batch.Batch) bool {
+	return w.c.Enqueue(w.dest.Name, b)
+}
+
+// Health returns the destination's
+// circuit breaker status.
+func (w *destWriter) Health() pool.BreakerStatus {
+	return w.c.DestinationHealth(w.dest.Name)
+}
+
+// Stats returns the destination's
+// connection status.
+func (w *destWriter) Stats() pool.ConnStatus {
+	return w.c.DestinationStats(w.dest.Name)
+}
+
+// Shutdown stops the write functions, which
+// write any buffered messages and exit.
+func (w *destWriter) Shutdown() {
+	w.stopOnce.Do(func() { close(w.stop) })
+	<-w.done
+}
+
+// stopping returns whether
+// Shutdown has been called.
+func (w *destWriter) stopping() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// retry calls send until it succeeds, up to the
+// destination's reconnect max failures, with the reconnect
+// backoff between attempts. It's used by outputs whose
+// connections can be established while writes fail, such
+// as HTTP APIs. Returns the last error.
+func (w *destWriter) retry(send func() error) error {
+	policy := w.c.ReconnectPolicy(w.dest)
+
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || attempt >= policy.MaxFailures || w.stopping() {
+			return err
+		}
+
+		backoff := policy.Backoff(attempt)
+		log.Printf("Destination %s error: %s, retrying in %s\n", w.dest.Name, err, backoff-backoff%time.Millisecond)
+		select {
+		case <-time.After(backoff):
+		case <-w.stop:
+		}
+	}
+}
+
+// checkOptions returns an error if dest has
+// options other than those supported.
+func checkOptions(dest pool.Destination, supported ...string) error {
+	names := make([]string, 0, len(dest.Options))
+	for k := range dest.Options {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+next:
+	for _, k := range names {
+		for _, s := range supported {
+			if k == s {
+				continue next
+			}
+		}
+		return fmt.Errorf("unknown option %s", k)
+	}
+
+	return nil
+}
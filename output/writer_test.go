@@ -0,0 +1,53 @@
+package output
+
+import (
+	"testing"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+func TestWriterHealthStats(t *testing.T) {
+	specs := []string{
+		"127.0.0.1:2003",
+		"tcp://127.0.0.1:2004?tls-server-name=carbon.example.com",
+		"udp://127.0.0.1:2005",
+		"influx://127.0.0.1:8086?db=graphite",
+		"prometheus://127.0.0.1:9090",
+	}
+
+	c := pool.NewCluster("writer-health-stats")
+
+	for _, spec := range specs {
+		dest, err := pool.ParseDestination(spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w, err := NewWriter(c, dest)
+		if err != nil {
+			t.Fatalf("%s: %s", spec, err)
+		}
+
+		c.Register(dest)
+		if s := w.Health(); s.State != pool.BreakerClosed {
+			t.Errorf("%s: got state %q, want %q", spec, s.State, pool.BreakerClosed)
+		}
+		if s := w.Stats(); s.Connections != 1 || s.TLS != (dest.TLS != nil) {
+			t.Errorf("%s: got stats %+v", spec, s)
+		}
+
+		if w.Enqueue(batch.New("a.b 1 1500000000")) {
+			t.Errorf("%s: enqueued to an inactive destination", spec)
+		}
+		c.AddConn(dest)
+		if !w.Enqueue(batch.New("a.b 1 1500000000")) {
+			t.Errorf("%s: enqueue failed", spec)
+		}
+
+		c.OpenBreaker(dest, pool.BreakerSlow)
+		if s := w.Health(); s.State != pool.BreakerOpen {
+			t.Errorf("%s: got state %q, want %q", spec, s.State, pool.BreakerOpen)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+// Package pool breaker.go implements destination
+// health checks and circuit breakers.
+package pool
+
+import (
+	"log"
+	"time"
+)
+
+// Circuit breaker states. A closed or half-open
+// destination is routed to; an open destination is
+// handled according to the failover policy (see FailConn).
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Reasons a circuit breaker is opened.
+const (
+	BreakerWriteFailures = "write-failures"
+	BreakerReconnect     = "reconnect-failures"
+	BreakerSlow          = "slow"
+)
+
+// HealthConfig holds destination health checking
+// configuration. Writes that don't complete within
+// WriteTimeout fail. A destination's circuit breaker
+// opens after MaxFailures write failures within
+// FailureWindow; successful writes don't reset the count,
+// as a destination that has stopped reading accepts writes
+// to each new connection until its buffers are full. It
+// also opens if the queue is at least SlowFill full (0-1)
+// and has grown (or is full) over SlowChecks consecutive
+// checks, made every CheckInterval. After OpenTimeout,
+// the destination is probed: the breaker is half-open
+// and the destination is routed to again. It closes once
+// writes have succeeded for a CheckInterval, and opens
+// again on any failure. A zero WriteTimeout or SlowChecks
+// disables write deadlines or slow destination detection.
+type HealthConfig struct {
+	WriteTimeout  time.Duration
+	MaxFailures   int
+	FailureWindow time.Duration
+	OpenTimeout   time.Duration
+	CheckInterval time.Duration
+	SlowChecks    int
+	SlowFill      float64
+}
+
+// DefaultHealthConfig returns
+// the default HealthConfig.
+func DefaultHealthConfig() HealthConfig {
+	return HealthConfig{
+		WriteTimeout:  10 * time.Second,
+		MaxFailures:   3,
+		FailureWindow: time.Minute,
+		OpenTimeout:   30 * time.Second,
+		CheckInterval: 5 * time.Second,
+		SlowChecks:    3,
+		SlowFill:      0.5,
+	}
+}
+
+// Breaker is a destination circuit breaker.
+// Breakers are guarded by the cluster lock.
+type Breaker struct {
+	state    string
+	reason   string
+	since    time.Time
+	failures int
+	failed   time.Time
+	opened   int64
+	// lastLen and growth track queue
+	// growth across health checks.
+	lastLen int
+	growth  int
+}
+
+// BreakerStatus is a snapshot of a circuit breaker.
+type BreakerStatus struct {
+	State    string    `json:"state"`
+	Reason   string    `json:"reason,omitempty"`
+	Since    time.Time `json:"since"`
+	Failures int       `json:"failures"`
+	Opened   int64     `json:"opened"`
+}
+
+// newBreaker returns a closed *Breaker.
+func newBreaker() *Breaker {
+	return &Breaker{state: BreakerClosed, since: time.Now()}
+}
+
+// set changes the breaker state.
+func (b *Breaker) set(state, reason string) {
+	b.state, b.reason = state, reason
+	b.since = time.Now()
+	b.failures, b.growth = 0, 0
+}
+
+// BreakerState returns the named destination's circuit
+// breaker state, or "" if the destination isn't registered.
+func (c *Cluster) BreakerState(name string) string {
+	c.RLock()
+	defer c.RUnlock()
+
+	if b := c.Breakers[name]; b != nil {
+		return b.state
+	}
+
+	return ""
+}
+
+// ProbeAt returns when the named destination can
+// be probed, or the zero time if its circuit breaker
+// isn't open.
+func (c *Cluster) ProbeAt(name string) time.Time {
+	c.RLock()
+	defer c.RUnlock()
+
+	if b := c.Breakers[name]; b != nil && b.state == BreakerOpen {
+		return b.since.Add(c.Health.OpenTimeout)
+	}
+
+	return time.Time{}
+}
+
+// OpenBreaker opens dest's circuit breaker and fails
+// the destination (see FailConn).
+func (c *Cluster) OpenBreaker(dest Destination, reason string) {
+	c.Lock()
+	b := c.Breakers[dest.Name]
+	if b == nil || b.state == BreakerOpen {
+		c.Unlock()
+		return
+	}
+	c.open(dest.Name, b, reason)
+	c.Unlock()
+
+	c.FailConn(dest)
+}
+
+// open opens a circuit breaker.
+// Callers must hold the lock.
+func (c *Cluster) open(name string, b *Breaker, reason string) {
+	b.set(BreakerOpen, reason)
+	b.opened++
+	log.Printf("Circuit breaker opened for destination %s (%s)%s\n", name, reason, c.LogSuffix())
+}
+
+// HalfOpenBreaker moves dest's circuit breaker from
+// open to half-open, once the destination has reconnected
+// for a probe. The caller restores the destination's routing.
+func (c *Cluster) HalfOpenBreaker(dest Destination) {
+	c.Lock()
+	defer c.Unlock()
+
+	if b := c.Breakers[dest.Name]; b != nil && b.state == BreakerOpen {
+		b.set(BreakerHalfOpen, "")
+		log.Printf("Probing destination %s%s\n", dest.Name, c.LogSuffix())
+	}
+}
+
+// WriteSucceeded records a successful write to dest,
+// closing its circuit breaker if it's been half-open
+// for a check interval.
+func (c *Cluster) WriteSucceeded(dest Destination) {
+	c.Lock()
+	defer c.Unlock()
+
+	b := c.Breakers[dest.Name]
+	if b == nil {
+		return
+	}
+
+	if b.state == BreakerHalfOpen && time.Since(b.since) >= c.Health.CheckInterval {
+		b.set(BreakerClosed, "")
+		log.Printf("Circuit breaker closed for destination %s%s\n", dest.Name, c.LogSuffix())
+	}
+}
+
+// WriteFailed records a failed write to dest as its
+// last error. The
+// circuit breaker is opened if it's half-open, or the
+// failures within Health.FailureWindow reach
+// Health.MaxFailures.
+func (c *Cluster) WriteFailed(dest Destination, err error) {
+	c.Lock()
+	if s := c.ConnStats[dest.Name]; s != nil {
+		s.setError(err)
+	}
+
+	b := c.Breakers[dest.Name]
+	if b == nil || b.state == BreakerOpen {
+		c.Unlock()
+		return
+	}
+
+	if time.Since(b.failed) > c.Health.FailureWindow {
+		b.failures = 0
+	}
+	b.failures++
+	b.failed = time.Now()
+	if b.state == BreakerClosed && b.failures < c.Health.MaxFailures {
+		c.Unlock()
+		return
+	}
+
+	c.open(dest.Name, b, BreakerWriteFailures)
+	c.Unlock()
+
+	c.FailConn(dest)
+}
+
+// HealthCheck opens the circuit breaker of destinations
+// whose queues are growing without being written, such
+// as a destination that accepts connections but has
+// stopped reading. It runs for the life of the cluster.
+func (c *Cluster) HealthCheck() {
+	if c.Health.SlowChecks < 1 || c.Health.CheckInterval <= 0 {
+		return
+	}
+
+	for {
+		time.Sleep(c.Health.CheckInterval)
+
+		r := c.routes()
+		slow := []Destination{}
+
+		c.Lock()
+		for name, q := range r.conns {
+			b := c.Breakers[name]
+			if b == nil || b.state == BreakerOpen || r.down[name] {
+				continue
+			}
+
+			l := q.Len()
+			if (l > b.lastLen || l >= q.Cap()) && float64(l) >= c.Health.SlowFill*float64(q.Cap()) {
+				b.growth++
+			} else {
+				b.growth = 0
+			}
+			b.lastLen = l
+
+			if b.growth >= c.Health.SlowChecks {
+				c.open(name, b, BreakerSlow)
+				slow = append(slow, c.dests[name])
+			}
+		}
+		c.Unlock()
+
+		for _, dest := range slow {
+			c.FailConn(dest)
+		}
+	}
+}
+
+// BreakerStatus returns the circuit breaker
+// status of each registered destination.
+func (c *Cluster) BreakerStatus() map[string]BreakerStatus {
+	c.RLock()
+	defer c.RUnlock()
+
+	status := make(map[string]BreakerStatus, len(c.Breakers))
+	for name, b := range c.Breakers {
+		status[name] = b.status()
+	}
+
+	return status
+}
+
+// DestinationHealth returns the named destination's
+// circuit breaker status. The zero value is returned
+// if the destination isn't registered.
+func (c *Cluster) DestinationHealth(name string) BreakerStatus {
+	c.RLock()
+	defer c.RUnlock()
+
+	if b := c.Breakers[name]; b != nil {
+		return b.status()
+	}
+
+	return BreakerStatus{}
+}
+
+// status returns a snapshot of the breaker.
+func (b *Breaker) status() BreakerStatus {
+	return BreakerStatus{
+		State:    b.state,
+		Reason:   b.reason,
+		Since:    b.since,
+		Failures: b.failures,
+		Opened:   b.opened,
+	}
+}
@@ -0,0 +1,447 @@
+// Package pool cluster.go implements
+// destination clusters.
+package pool
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/consistenthash"
+	"github.com/jamiealquiza/polymur/diskqueue"
+)
+
+// Cluster holds a set of destination connections,
+// queues and routing functions. Each cluster has its own
+// hash ring, queue capacity and distribution method.
+// Sources holds the source of each registered destination
+// (see Destination). The exported state is guarded by the
+// lock; distribution reads an immutable snapshot of it
+// that is swapped on every update.
+type Cluster struct {
+	sync.RWMutex
+	Name string
+	// Ring is the current hash ring. It's replaced
+	// rather than modified on membership changes.
+	Ring               consistenthash.Ring
+	Conns              map[string]*Queue
+	Registered         map[string]time.Time
+	Sources            map[string]string
+	Filters            map[string]*Filter
+	DistributionMethod map[string]func(*Cluster, *batch.Batch)
+	Distribution       string
+	QueueCap           int
+	RetryQueue         chan *Retry
+	Retry              RetryConfig
+	// Spill configures disk queues that absorb
+	// destination queue overflow. Spilling is
+	// disabled if Spill.Dir is empty.
+	Spill  diskqueue.Config
+	Spills map[string]*diskqueue.Queue
+	// Failover is the failed destination policy.
+	// Down references destinations held on the ring
+	// while failed; Hints holds their messages.
+	Failover string
+	Down     map[string]bool
+	Hints    map[string]*hints
+	// Drains holds destinations being drained,
+	// or drained since they were last added.
+	Drains       map[string]*Drain
+	DrainTimeout time.Duration
+	// Breakers holds the circuit breaker of each
+	// registered destination; Health configures them.
+	Breakers map[string]*Breaker
+	Health   HealthConfig
+	// ConnStats holds the connection status of each
+	// registered destination; Reconnect is the default
+	// reconnect policy.
+	ConnStats map[string]*ConnStatus
+	Reconnect ReconnectConfig
+	// Writers holds the writer of each
+	// destination added with AddDestination.
+	Writers map[string]Writer
+	// rrNext is the round-robin
+	// destination counter.
+	rrNext uint32
+
+	snapshot      atomic.Value
+	hashAlgorithm string
+	// nodes are the ring members
+	// in the order they were added.
+	nodes []consistenthash.Node
+
+	// dests holds each added or registered Destination.
+	dests map[string]Destination
+
+	retryStats     *RetryStats
+	deadLetterMu   sync.Mutex
+	deadLetterFile *os.File
+
+	// state, if set, persists destinations
+	// registered and unregistered at runtime.
+	state *State
+	// writer creates the writer of a
+	// destination added with AddDestination.
+	writer WriterFunc
+}
+
+// NewCluster initializes a *Cluster. The hash ring
+// defaults to carbon_ch; see SetHashAlgorithm.
+func NewCluster(name string) *Cluster {
+	cluster := &Cluster{
+		Name:         name,
+		Ring:         &consistenthash.HashRing{Vnodes: 100},
+		Conns:        make(map[string]*Queue),
+		Registered:   make(map[string]time.Time),
+		Sources:      make(map[string]string),
+		Filters:      make(map[string]*Filter),
+		Spills:       make(map[string]*diskqueue.Queue),
+		Failover:     FailoverRedistribute,
+		Down:         make(map[string]bool),
+		Hints:        make(map[string]*hints),
+		Drains:       make(map[string]*Drain),
+		DrainTimeout: defaultDrainTimeout,
+		Breakers:     make(map[string]*Breaker),
+		Health:       DefaultHealthConfig(),
+		ConnStats:    make(map[string]*ConnStatus),
+		Reconnect:    DefaultReconnectConfig(),
+		Writers:      make(map[string]Writer),
+		dests:        make(map[string]Destination),
+		DistributionMethod: map[string]func(*Cluster, *batch.Batch){
+			"broadcast":   (*Cluster).broadcast,
+			"hash-route":  (*Cluster).hashRoute,
+			"round-robin": (*Cluster).roundRobin,
+			"least-queue": (*Cluster).leastQueue,
+		},
+		Retry:      DefaultRetryConfig(),
+		retryStats: &RetryStats{},
+	}
+
+	cluster.RetryQueue = make(chan *Retry, cluster.Retry.QueueCap)
+	cluster.publish()
+
+	return cluster
+}
+
+// Distribute passes a batch of messages to the
+// cluster's distribution method. Destination queues
+// take their own references to b; the caller's
+// reference is unaffected.
+func (c *Cluster) Distribute(b *batch.Batch) {
+	c.DistributionMethod[c.Distribution](c, b)
+}
+
+// SetHashAlgorithm replaces the cluster's hash ring
+// with an empty ring using the named algorithm.
+// It must be called before any connections are added.
+func (c *Cluster) SetHashAlgorithm(algorithm string) error {
+	ring, err := consistenthash.New(algorithm, 100)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.hashAlgorithm = algorithm
+	c.Ring = ring
+	c.publish()
+	c.Unlock()
+
+	return nil
+}
+
+// Distribution functions.
+
+// broadcast takes a batch of messages and
+// enqueues it to every destination's outbound queue.
+// Destinations with a Filter only receive matching messages.
+func (c *Cluster) broadcast(b *batch.Batch) {
+	r := c.routes()
+	for _, name := range r.names {
+		db := b
+		if f, filtered := r.filters[name]; filtered {
+			db = batch.Get()
+			for i := 0; i < b.Len(); i++ {
+				if m := b.Point(i); f.Match(m) {
+					db.Append(m)
+				}
+			}
+		} else {
+			b.Retain()
+		}
+
+		// Drop anything that doesn't fit.
+		if db.Len() > 0 {
+			if i := c.enqueue(r, name, db); i < db.Len() {
+				c.drop(DropQueueFull, name, db.Len()-i, db.Point(i))
+			}
+		}
+
+		db.Release()
+	}
+}
+
+// hashRoute takes a batch of messages and
+// distributes them to the destination outbound
+// queues according to the CH algo.
+func (c *Cluster) hashRoute(b *batch.Batch) {
+	r := c.routes()
+	batches := make(map[string]*batch.Batch, len(r.names))
+	// hintsFull holds the index of the first message
+	// and the number of messages dropped for each failed
+	// destination, counted once per batch.
+	var hintsFull map[string][2]int
+
+	for i := 0; i < b.Len(); i++ {
+		m := b.Point(i)
+		node, err := r.ring.GetNode(batch.Name(m))
+		// Current failure mode if the hash
+		// ring is empty; nothing can be routed.
+		if err != nil {
+			c.drop(DropNoDestinations, "", b.Len()-i, m)
+			break
+		}
+
+		// Store hints for failed destinations
+		// held on the ring.
+		if r.down[node] {
+			if !c.hint(r, node, m) {
+				if hintsFull == nil {
+					hintsFull = make(map[string][2]int)
+				}
+				d, exists := hintsFull[node]
+				if !exists {
+					d[0] = i
+				}
+				d[1]++
+				hintsFull[node] = d
+			}
+			continue
+		}
+
+		nb, exists := batches[node]
+		if !exists {
+			nb = batch.Get()
+			batches[node] = nb
+		}
+		nb.Append(m)
+	}
+
+	for node, d := range hintsFull {
+		c.drop(DropHintsFull, node, d[1], b.Point(d[0]))
+	}
+
+	for node, nb := range batches {
+		// If unavailable, load into failed messages for retry.
+		for i := c.enqueue(r, node, nb); i < nb.Len(); i++ {
+			c.retry(string(nb.Point(i)))
+		}
+		nb.Release()
+	}
+}
+
+// roundRobin takes a batch of messages and
+// enqueues it to the next destination in turn.
+func (c *Cluster) roundRobin(b *batch.Batch) {
+	r := c.routes()
+
+	order := append([]string(nil), r.names...)
+	if len(order) == 0 {
+		c.dropBatch(DropNoDestinations, b)
+		return
+	}
+
+	// Rotate the destination list so that
+	// the batch starts on the next destination.
+	n := int(atomic.AddUint32(&c.rrNext, 1) % uint32(len(order)))
+	order = append(order[n:], order[:n]...)
+
+	c.balance(r, b, order)
+}
+
+// leastQueue takes a batch of messages and
+// enqueues it to the destination with the
+// shortest outbound queue.
+func (c *Cluster) leastQueue(b *batch.Batch) {
+	r := c.routes()
+
+	order := append([]string(nil), r.names...)
+	if len(order) == 0 {
+		c.dropBatch(DropNoDestinations, b)
+		return
+	}
+
+	sort.SliceStable(order, func(i, j int) bool {
+		return r.conns[order[i]].Len() < r.conns[order[j]].Len()
+	})
+
+	c.balance(r, b, order)
+}
+
+// balance enqueues the batch to the first destination
+// in order with capacity for it. If every destination
+// queue is full, the batch is spilled to disk on the first
+// destination (if enabled); any messages that can't be
+// spilled are loaded into the retry queue.
+func (c *Cluster) balance(r *routes, b *batch.Batch, order []string) {
+	for _, name := range order {
+		if r.conns[name].put(b) {
+			return
+		}
+	}
+
+	// All destinations are full, load into failed messages for retry.
+	for i := c.spill(r, order[0], b); i < b.Len(); i++ {
+		c.retry(string(b.Point(i)))
+	}
+}
+
+// Cluster state update methods.
+
+// Register adds a timestamped connection
+// to the cluster's registered connection list.
+// A registered destination is not necessarily active.
+// Destinations registered with the API are persisted
+// to the state file, if set.
+func (c *Cluster) Register(dest Destination) {
+	c.Lock()
+	log.Printf("Registered destination %s%s\n", dest.Name, c.LogSuffix())
+	c.Registered[dest.Name] = time.Now()
+	c.dests[dest.Name] = dest
+	c.Sources[dest.Name] = dest.Source
+	c.Breakers[dest.Name] = newBreaker()
+	c.ConnStats[dest.Name] = &ConnStatus{Connections: dest.Connections, TLS: dest.TLS != nil}
+	c.Unlock()
+
+	if c.state != nil && dest.Source == SourceAPI {
+		c.state.add(c.Name, dest)
+	}
+}
+
+// Unregister removes a connection from the
+// cluster and additionally drops the connection queue
+// and any spilled messages or hints. The removal is
+// persisted to the state file, if set.
+func (c *Cluster) Unregister(dest Destination) {
+	c.Lock()
+	source := c.Sources[dest.Name]
+	delete(c.Registered, dest.Name)
+	delete(c.dests, dest.Name)
+	delete(c.Sources, dest.Name)
+	delete(c.Breakers, dest.Name)
+	delete(c.ConnStats, dest.Name)
+	delete(c.Writers, dest.Name)
+	c.Unlock()
+
+	if c.state != nil {
+		c.state.remove(c.Name, dest.Name, source)
+	}
+
+	log.Printf("Unregistered destination %s%s\n", dest.Name, c.LogSuffix())
+	c.RemoveConn(dest)
+	c.purgeSpill(dest.Name)
+
+	c.Lock()
+	c.dropHints(dest.Name)
+	c.Unlock()
+}
+
+// AddConn adds a connection's outbound queue
+// to the cluster's active list. Destinations that
+// aren't registered, or are already active (another
+// of the destination's connections added it), aren't
+// added.
+func (c *Cluster) AddConn(dest Destination) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, registered := c.Registered[dest.Name]; !registered {
+		return
+	}
+	if _, active := c.Conns[dest.Name]; active {
+		return
+	}
+
+	c.Conns[dest.Name] = newQueue(c.QueueCap)
+	delete(c.Drains, dest.Name)
+	if dest.Filter != nil {
+		c.Filters[dest.Name] = dest.Filter
+	}
+	c.openSpill(dest)
+	c.loadHints(dest.Name)
+
+	// The ring builds the node key from the destination IP,
+	// port and instance according to its hashing algorithm.
+	c.removeNode(dest.Name)
+	c.nodes = append(c.nodes, consistenthash.Node{
+		IP:       dest.IP,
+		Port:     dest.Port,
+		Instance: dest.ID,
+		Name:     dest.Name,
+		Weight:   dest.Weight,
+	})
+	c.buildRing()
+
+	c.publish()
+}
+
+// RemoveConn removes a connection's outbound queue
+// from the cluster's active lists.
+// Additionally, it will redistribute any in-flight messages.
+func (c *Cluster) RemoveConn(dest Destination) {
+	c.Lock()
+	// Check if it exists, first.
+	if _, connectionIsInPool := c.Conns[dest.Name]; !connectionIsInPool {
+		c.Unlock()
+		return
+	}
+
+	log.Printf("Removing destination %s from connection pool%s\n", dest.Name, c.LogSuffix())
+
+	// Grab the queue to redistribute any message it's holding.
+	q := c.Conns[dest.Name]
+
+	// Remove.
+	delete(c.Conns, dest.Name)
+	delete(c.Filters, dest.Name)
+	c.closeSpill(dest.Name)
+	c.removeNode(dest.Name)
+	c.buildRing()
+	c.publish()
+	c.Unlock()
+
+	// If the queue had any in-flight messages, redistribute
+	// them (broadcast messages are dropped). The queue is
+	// closed once distribution can no longer reference it.
+	if q.Len() > 0 && c.Distribution != "broadcast" {
+		log.Printf("Redistributing in-flight messages for %s", dest.Name)
+	}
+	c.flush(dest.Name, q)
+	go c.retire(dest.Name, q)
+}
+
+// removeNode removes the named destination
+// from the ring members. Callers must hold the lock.
+func (c *Cluster) removeNode(name string) {
+	nodes := c.nodes[:0]
+	for _, n := range c.nodes {
+		if n.Name != name {
+			nodes = append(nodes, n)
+		}
+	}
+	c.nodes = nodes
+}
+
+// LogSuffix returns the cluster name formatted
+// for log messages. The default cluster is omitted
+// to keep single cluster logging unchanged.
+func (c *Cluster) LogSuffix() string {
+	if c.Name == DefaultCluster {
+		return ""
+	}
+	return fmt.Sprintf(" [cluster %s]", c.Name)
+}
@@ -0,0 +1,197 @@
+package pool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/consistenthash"
+)
+
+func init() {
+	log.SetOutput(ioutil.Discard)
+	// Set once rather than per test; queues retired
+	// by earlier tests read it in the background.
+	retireGrace = 10 * time.Millisecond
+}
+
+// benchDestinations is the number of
+// destinations distributed to by benchmarks.
+const benchDestinations = 4
+
+// benchPoints returns 100 data points
+// for distinct series.
+func benchPoints() []string {
+	points := make([]string, 100)
+	for i := range points {
+		points[i] = fmt.Sprintf("bench.series.%d 1 1500000000", i)
+	}
+
+	return points
+}
+
+// legacyPool is the pool distribution implementation
+// prior to routing snapshots: a single lock guards
+// the ring and per-message destination queues, and
+// is read locked for each batch.
+type legacyPool struct {
+	sync.RWMutex
+	ring  *consistenthash.HashRing
+	conns map[string]chan *string
+	retry chan []*string
+}
+
+func (p *legacyPool) hashRoute(messages []*string) {
+	p.RLock()
+	defer p.RUnlock()
+	for _, m := range messages {
+		if m == nil {
+			break
+		}
+
+		key := strings.Fields(*m)[0]
+		node, err := p.ring.GetNode([]byte(key))
+		if err != nil {
+			continue
+		}
+
+		select {
+		case p.conns[node] <- m:
+			continue
+		default:
+		}
+
+		select {
+		case p.retry <- []*string{m}:
+		default:
+		}
+	}
+}
+
+// BenchmarkHashRouteLegacy measures hash-route
+// distribution with the prior implementation.
+func BenchmarkHashRouteLegacy(b *testing.B) {
+	p := &legacyPool{
+		ring:  &consistenthash.HashRing{Vnodes: 100},
+		conns: make(map[string]chan *string),
+		retry: make(chan []*string, 4096),
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < benchDestinations; i++ {
+		name := fmt.Sprintf("127.0.0.1:%d", 2003+i)
+		q := make(chan *string, 4096)
+		p.conns[name] = q
+		p.ring.AddNode(consistenthash.Node{IP: "127.0.0.1", Port: fmt.Sprint(2003 + i), Name: name})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range q {
+			}
+		}()
+	}
+	go func() {
+		for range p.retry {
+		}
+	}()
+
+	points := benchPoints()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		// Batches were allocated per read.
+		for pb.Next() {
+			messages := make([]*string, len(points))
+			for i := range points {
+				m := points[i]
+				messages[i] = &m
+			}
+			p.hashRoute(messages)
+		}
+	})
+
+	b.StopTimer()
+	for _, q := range p.conns {
+		close(q)
+	}
+	wg.Wait()
+}
+
+// BenchmarkHashRoute measures hash-route distribution
+// with routing snapshots and batch queues.
+func BenchmarkHashRoute(b *testing.B) {
+	c := NewCluster(DefaultCluster)
+	c.Distribution = "hash-route"
+	c.QueueCap = 1 << 20
+
+	for i := 0; i < benchDestinations; i++ {
+		dest, _ := ParseDestination(fmt.Sprintf("127.0.0.1:%d", 2003+i))
+		c.Register(dest)
+		c.AddConn(dest)
+
+		q := c.Queue(dest.Name)
+		go func() {
+			for qb := range q.C {
+				q.Done(qb)
+				qb.Release()
+			}
+		}()
+	}
+	go func() {
+		for range c.RetryQueue {
+		}
+	}()
+
+	points := benchPoints()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			bt := batch.Get()
+			for _, m := range points {
+				bt.AppendString(m)
+			}
+			c.Distribute(bt)
+			bt.Release()
+		}
+	})
+}
+
+func TestQueueClose(t *testing.T) {
+	q := newQueue(10)
+	b := batch.New("a.b 1 1500000000")
+
+	if !q.put(b) {
+		t.Fatal("put to an open queue failed")
+	}
+
+	q.close()
+	q.close()
+
+	if q.put(b) {
+		t.Error("put to a closed queue succeeded")
+	}
+
+	qb, ok := <-q.C
+	if !ok || qb.Len() != 1 {
+		t.Error("expected the queued batch")
+	}
+	if _, ok := <-q.C; ok {
+		t.Error("expected a closed queue")
+	}
+}
+
+func TestFilterMatchAllocs(t *testing.T) {
+	f := &Filter{Sample: 50}
+	m := []byte("servers.web01.cpu.load 1 1500000000")
+
+	if allocs := testing.AllocsPerRun(100, func() { f.Match(m) }); allocs != 0 {
+		t.Errorf("Match allocated %g times", allocs)
+	}
+}
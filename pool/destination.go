@@ -0,0 +1,259 @@
+// Package pool destination.go parses
+// destination strings.
+package pool
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Destination is an output destination.
+type Destination struct {
+	IP   string
+	Port string
+	ID   string
+	Addr string
+	Name string
+	// Scheme is the destination URL scheme,
+	// which selects its writer (see SetWriter).
+	Scheme string
+	// Weight scales the destination's
+	// share of the hash ring.
+	Weight int
+	// Connections is the number of connections
+	// (and writers) to the destination.
+	Connections int
+	// Filter limits the metrics mirrored
+	// to the destination in broadcast mode.
+	Filter *Filter
+	// WriteTimeout, if non-zero, overrides the
+	// cluster's Health.WriteTimeout; a negative
+	// value disables write deadlines.
+	WriteTimeout time.Duration
+	// Reconnect holds reconnect policy options;
+	// zero values use the cluster's policy.
+	Reconnect ReconnectConfig
+	// TLS, if set, configures
+	// connections to use TLS.
+	TLS *TLSConfig
+	// Options holds options not handled by
+	// the pool, for the destination's writer.
+	Options url.Values
+	// Spec is the destination string,
+	// including any options.
+	Spec string
+	// Source is where the destination
+	// was registered from.
+	Source string
+}
+
+// DefaultScheme is the scheme of
+// destinations specified without one.
+const DefaultScheme = "tcp"
+
+// Destination sources.
+const (
+	// SourceFlag: the -destinations or -clusters flags.
+	SourceFlag = "flag"
+	// SourceAPI: the putdest API command.
+	SourceAPI = "api"
+	// SourceState: registered with putdest prior
+	// to a restart and restored from the state file.
+	SourceState = "state"
+)
+
+// ParseDestination takes a destination string
+// and returns a Destination{}. Destinations take the
+// form "[scheme://]ip:port[:instance][?option=value&...]",
+// with IPv6 addresses in brackets ("[::1]:2003"); the
+// destination name excludes any options, and the scheme
+// if it's the default. Destinations with a scheme other than
+// the default may take any address, such as a file path.
+// Supported options (others are passed to the writer):
+// - weight: hash ring weight (default 1).
+// - connections: number of connections (default 1).
+// - filter: broadcast only metrics matching this regex.
+// - sample: broadcast this percentage of series (default 100).
+// - write-timeout: write deadline (seconds, 0 is disabled).
+// - dial-timeout: connection timeout (seconds).
+// - reconnect-backoff: min reconnect backoff (ms).
+// - reconnect-max-backoff: max reconnect backoff (seconds).
+// - reconnect-failures: failed reconnects before eviction.
+// - tls: connect with TLS (true/false).
+// - tls-ca: CA bundle to verify the destination (implies tls).
+// - tls-cert, tls-key: client certificate and key (implies tls).
+// - tls-server-name: name to verify the destination
+// certificate against (implies tls).
+func ParseDestination(s string) (Destination, error) {
+	addr, opts := s, ""
+	if i := strings.Index(s, "?"); i >= 0 {
+		addr, opts = s[:i], s[i+1:]
+	}
+
+	d := Destination{Name: addr, Scheme: DefaultScheme, Weight: 1, Connections: 1, Spec: s}
+	if i := strings.Index(addr, "://"); i >= 0 {
+		d.Scheme, addr = addr[:i], addr[i+3:]
+		if d.Scheme == DefaultScheme {
+			d.Name = addr
+		}
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// An instance may follow the port.
+		if i := strings.LastIndex(addr, ":"); i >= 0 {
+			if host, port, err = net.SplitHostPort(addr[:i]); err == nil {
+				d.ID = addr[i+1:]
+			}
+		}
+	}
+
+	switch {
+	case err == nil:
+		d.IP, d.Port, d.Addr = host, port, host
+		if port != "" {
+			d.Addr = net.JoinHostPort(host, port)
+		}
+	case !strings.Contains(addr, ":") && d.Scheme != DefaultScheme:
+		// The address, such as a file path, stands
+		// in for the IP as the hash ring node key.
+		d.IP, d.Addr = addr, addr
+	default:
+		return d, fmt.Errorf("Destination %s not valid\n", s)
+	}
+
+	if opts == "" {
+		return d, nil
+	}
+
+	params, err := url.ParseQuery(opts)
+	if err != nil {
+		return d, fmt.Errorf("Destination %s options not valid: %s\n", s, err)
+	}
+
+	if err := d.parseOptions(params); err != nil {
+		return d, fmt.Errorf("Destination %s not valid: %s\n", s, err)
+	}
+
+	return d, nil
+}
+
+// parseOptions populates destination
+// settings from destination string options.
+func (d *Destination) parseOptions(params url.Values) error {
+	for k, v := range params {
+		val := v[len(v)-1]
+
+		switch k {
+		case "weight":
+			w, err := strconv.Atoi(val)
+			if err != nil || w < 1 {
+				return fmt.Errorf("weight must be a positive integer")
+			}
+			d.Weight = w
+		case "connections":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return fmt.Errorf("connections must be a positive integer")
+			}
+			d.Connections = n
+		case "filter":
+			re, err := regexp.Compile(val)
+			if err != nil {
+				return fmt.Errorf("filter not valid: %s", err)
+			}
+			d.filter().Pattern = re
+		case "sample":
+			pct, err := strconv.ParseFloat(val, 64)
+			if err != nil || pct <= 0 || pct > 100 {
+				return fmt.Errorf("sample must be a percentage between 0 and 100")
+			}
+			d.filter().Sample = pct
+		case "write-timeout":
+			secs, err := strconv.Atoi(val)
+			if err != nil || secs < 0 {
+				return fmt.Errorf("write-timeout must be a non-negative integer")
+			}
+			d.WriteTimeout = time.Duration(secs) * time.Second
+			if secs == 0 {
+				d.WriteTimeout = -1
+			}
+		case "dial-timeout":
+			secs, err := strconv.Atoi(val)
+			if err != nil || secs < 1 {
+				return fmt.Errorf("dial-timeout must be a positive integer")
+			}
+			d.Reconnect.DialTimeout = time.Duration(secs) * time.Second
+		case "reconnect-backoff":
+			ms, err := strconv.Atoi(val)
+			if err != nil || ms < 1 {
+				return fmt.Errorf("reconnect-backoff must be a positive integer")
+			}
+			d.Reconnect.MinBackoff = time.Duration(ms) * time.Millisecond
+		case "reconnect-max-backoff":
+			secs, err := strconv.Atoi(val)
+			if err != nil || secs < 1 {
+				return fmt.Errorf("reconnect-max-backoff must be a positive integer")
+			}
+			d.Reconnect.MaxBackoff = time.Duration(secs) * time.Second
+		case "reconnect-failures":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return fmt.Errorf("reconnect-failures must be a positive integer")
+			}
+			d.Reconnect.MaxFailures = n
+		case "tls":
+			enabled, err := strconv.ParseBool(val)
+			if err != nil {
+				return fmt.Errorf("tls must be true or false")
+			}
+			if enabled {
+				d.tls()
+			}
+		case "tls-ca":
+			d.tls().CA = val
+		case "tls-cert":
+			d.tls().Cert = val
+		case "tls-key":
+			d.tls().Key = val
+		case "tls-server-name":
+			d.tls().ServerName = val
+		default:
+			if d.Options == nil {
+				d.Options = url.Values{}
+			}
+			d.Options.Set(k, val)
+		}
+	}
+
+	if d.TLS != nil {
+		if err := d.TLS.load(d.IP); err != nil {
+			return fmt.Errorf("tls: %s", err)
+		}
+	}
+
+	return nil
+}
+
+// tls returns the destination's
+// TLSConfig, initializing it if unset.
+func (d *Destination) tls() *TLSConfig {
+	if d.TLS == nil {
+		d.TLS = &TLSConfig{}
+	}
+	return d.TLS
+}
+
+// filter returns the destination's
+// Filter, initializing it if unset.
+func (d *Destination) filter() *Filter {
+	if d.Filter == nil {
+		d.Filter = &Filter{Sample: 100}
+	}
+	return d.Filter
+}
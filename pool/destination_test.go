@@ -0,0 +1,47 @@
+package pool
+
+import "testing"
+
+func TestParseDestination(t *testing.T) {
+	tests := []struct {
+		in                         string
+		name, scheme, ip, port, id string
+		addr                       string
+	}{
+		{"10.0.5.20:2003", "10.0.5.20:2003", "tcp", "10.0.5.20", "2003", "", "10.0.5.20:2003"},
+		{"10.0.5.20:2003:a?weight=2", "10.0.5.20:2003:a", "tcp", "10.0.5.20", "2003", "a", "10.0.5.20:2003"},
+		{"tcp://carbon.example.com:2003", "carbon.example.com:2003", "tcp", "carbon.example.com", "2003", "", "carbon.example.com:2003"},
+		{"[2001:db8::20]:2003", "[2001:db8::20]:2003", "tcp", "2001:db8::20", "2003", "", "[2001:db8::20]:2003"},
+		{"[::1]:2003:b", "[::1]:2003:b", "tcp", "::1", "2003", "b", "[::1]:2003"},
+		{"udp://[::1]:2003", "udp://[::1]:2003", "udp", "::1", "2003", "", "[::1]:2003"},
+		{"influx://10.0.6.10:8086:stats?db=stats", "influx://10.0.6.10:8086:stats", "influx", "10.0.6.10", "8086", "stats", "10.0.6.10:8086"},
+		{"https://gateway.example.com?api-key=k", "https://gateway.example.com", "https", "gateway.example.com", "", "", "gateway.example.com"},
+		{"file:///var/log/polymur.log", "file:///var/log/polymur.log", "file", "/var/log/polymur.log", "", "", "/var/log/polymur.log"},
+		{"console://", "console://", "console", "", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		d, err := ParseDestination(tt.in)
+		if err != nil {
+			t.Errorf("%s: %s", tt.in, err)
+			continue
+		}
+		if d.Name != tt.name || d.Scheme != tt.scheme || d.IP != tt.ip || d.Port != tt.port || d.ID != tt.id || d.Addr != tt.addr {
+			t.Errorf("%s: got name %q scheme %q ip %q port %q id %q addr %q", tt.in, d.Name, d.Scheme, d.IP, d.Port, d.ID, d.Addr)
+		}
+	}
+
+	invalid := []string{
+		"10.0.5.20",
+		"2001:db8::20:2003",
+		"10.0.5.20:2003:a:b",
+		"[::1:2003",
+		"10.0.5.20:2003?weight=0",
+	}
+
+	for _, s := range invalid {
+		if _, err := ParseDestination(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+}
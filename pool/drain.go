@@ -0,0 +1,187 @@
+// Package pool drain.go implements
+// graceful destination removal.
+package pool
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// defaultDrainTimeout is the
+// default Cluster.DrainTimeout.
+const defaultDrainTimeout = time.Minute
+
+// Drain states.
+const (
+	DrainActive   = "draining"
+	DrainDone     = "done"
+	DrainTimedOut = "timed-out"
+)
+
+// Drain tracks a destination being drained: it's
+// removed from routing, and its writers write the
+// remaining queued messages before the destination
+// is unregistered. Messages left when the drain
+// times out are redistributed (or dropped, for
+// broadcast) as with Unregister.
+type Drain struct {
+	Started  time.Time
+	Deadline time.Time
+	// Queued is the number of queued
+	// messages when the drain started.
+	Queued  int64
+	written int64
+	state   string
+	queue   *Queue
+	// writers is the number of destination
+	// writers yet to finish with the queue.
+	writers int32
+	done    chan struct{}
+}
+
+// DrainStatus is a snapshot of drain progress.
+type DrainStatus struct {
+	State     string    `json:"state"`
+	Started   time.Time `json:"started"`
+	Deadline  time.Time `json:"deadline"`
+	Queued    int64     `json:"queued"`
+	Written   int64     `json:"written"`
+	Remaining int       `json:"remaining"`
+}
+
+// Queue returns the queue being drained.
+func (d *Drain) Queue() *Queue {
+	return d.queue
+}
+
+// Written adds n to the number of
+// messages written by the drain.
+func (d *Drain) Written(n int) {
+	atomic.AddInt64(&d.written, int64(n))
+}
+
+// Expired returns whether the drain timed out.
+func (d *Drain) Expired() bool {
+	return time.Now().After(d.Deadline)
+}
+
+// Finish marks a writer as finished with the queue.
+// It must be called once by each of the destination's
+// writers.
+func (d *Drain) Finish() {
+	if atomic.AddInt32(&d.writers, -1) == 0 {
+		close(d.done)
+	}
+}
+
+// Drain removes dest from routing and unregisters it once
+// its writer has written the remaining queued messages, or
+// the timeout elapses. A destination that's already being
+// drained is left to that drain; one that's neither active
+// nor draining is unregistered immediately.
+func (c *Cluster) Drain(dest Destination, timeout time.Duration) {
+	c.Lock()
+	if d := c.Drains[dest.Name]; d != nil && d.state == DrainActive {
+		c.Unlock()
+		return
+	}
+
+	q, active := c.Conns[dest.Name]
+	if !active {
+		c.Unlock()
+		c.Unregister(dest)
+		return
+	}
+
+	writers := 1
+	if s := c.ConnStats[dest.Name]; s != nil && s.Connections > 1 {
+		writers = s.Connections
+	}
+
+	now := time.Now()
+	d := &Drain{
+		Started:  now,
+		Deadline: now.Add(timeout),
+		Queued:   int64(q.Len()),
+		state:    DrainActive,
+		queue:    q,
+		writers:  int32(writers),
+		done:     make(chan struct{}),
+	}
+	c.Drains[dest.Name] = d
+
+	log.Printf("Draining destination %s (%d in-flight messages)%s\n", dest.Name, d.Queued, c.LogSuffix())
+
+	delete(c.Conns, dest.Name)
+	delete(c.Filters, dest.Name)
+	c.closeSpill(dest.Name)
+	c.removeNode(dest.Name)
+	c.buildRing()
+	c.publish()
+	c.Unlock()
+
+	go c.drain(dest, d)
+}
+
+// drain closes the drained queue once distribution
+// can no longer reference it, waits for the writer to
+// finish with it (or the drain to time out), then
+// unregisters the destination.
+func (c *Cluster) drain(dest Destination, d *Drain) {
+	time.Sleep(retireGrace)
+	d.queue.close()
+
+	select {
+	case <-d.done:
+	case <-time.After(time.Until(d.Deadline)):
+	}
+
+	state := DrainDone
+	if d.queue.Len() > 0 {
+		state = DrainTimedOut
+		log.Printf("Drain of destination %s timed out with %d messages remaining%s\n", dest.Name, d.queue.Len(), c.LogSuffix())
+	}
+	c.flush(dest.Name, d.queue)
+
+	c.Lock()
+	d.state = state
+	c.Unlock()
+
+	log.Printf("Drained destination %s (%d messages written)%s\n", dest.Name, atomic.LoadInt64(&d.written), c.LogSuffix())
+	c.Unregister(dest)
+}
+
+// Draining returns the named destination's
+// drain, or nil if it's not being drained.
+func (c *Cluster) Draining(name string) *Drain {
+	c.RLock()
+	defer c.RUnlock()
+
+	if d := c.Drains[name]; d != nil && d.state == DrainActive {
+		return d
+	}
+
+	return nil
+}
+
+// DrainStatus returns the progress of each
+// drain since the destination was last added.
+func (c *Cluster) DrainStatus() map[string]DrainStatus {
+	c.RLock()
+	defer c.RUnlock()
+
+	status := make(map[string]DrainStatus, len(c.Drains))
+	for name, d := range c.Drains {
+		status[name] = DrainStatus{
+			State:     d.state,
+			Started:   d.Started,
+			Deadline:  d.Deadline,
+			Queued:    d.Queued,
+			Written:   atomic.LoadInt64(&d.written),
+			Remaining: d.queue.Len(),
+		}
+	}
+
+	return status
+}
@@ -0,0 +1,153 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+func TestDrainTwice(t *testing.T) {
+	c := NewCluster("drain-twice")
+	c.QueueCap = 10
+
+	dest, _ := ParseDestination("127.0.0.1:2003")
+	c.Register(dest)
+	c.AddConn(dest)
+
+	q := c.Queue(dest.Name)
+	for i := 0; i < 3; i++ {
+		if !q.put(batch.New("a.b 1 1500000000")) {
+			t.Fatal("put failed")
+		}
+	}
+
+	c.Drain(dest, time.Minute)
+	// A repeated drain is left to the active drain
+	// rather than unregistering the destination.
+	c.Drain(dest, time.Minute)
+
+	c.RLock()
+	_, registered := c.Registered[dest.Name]
+	c.RUnlock()
+	if !registered {
+		t.Fatal("destination unregistered by the second drain")
+	}
+
+	d := c.Draining(dest.Name)
+	if d == nil {
+		t.Fatal("expected an active drain")
+	}
+
+	// Write the drained queue as a writer would.
+	for qb := range d.Queue().C {
+		d.Queue().Done(qb)
+		d.Written(qb.Len())
+		qb.Release()
+	}
+	d.Finish()
+
+	deadline := time.Now().Add(time.Second)
+	for c.Draining(dest.Name) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	status := c.DrainStatus()[dest.Name]
+	if status.State != DrainDone || status.Written != 3 {
+		t.Errorf("got drain %s with %d written, want %s with 3", status.State, status.Written, DrainDone)
+	}
+}
+
+func TestDrainConnections(t *testing.T) {
+	c := NewCluster("drain-connections")
+	c.QueueCap = 100
+
+	dest, _ := ParseDestination("127.0.0.1:2003?connections=3")
+	c.Register(dest)
+	c.AddConn(dest)
+
+	q := c.Queue(dest.Name)
+	for i := 0; i < 30; i++ {
+		if !q.put(batch.New("a.b 1 1500000000")) {
+			t.Fatal("put failed")
+		}
+	}
+
+	c.Drain(dest, time.Minute)
+	d := c.Draining(dest.Name)
+	if d == nil {
+		t.Fatal("expected an active drain")
+	}
+
+	// Each connection's writer reads the shared
+	// queue until it's closed. Writers wait for
+	// each other to read a batch, so each takes
+	// part, and the last is held before finishing.
+	read := make(chan struct{}, dest.Connections)
+	start := make(chan struct{})
+	last := make(chan struct{})
+	written := make(chan int, dest.Connections)
+
+	for i := 0; i < dest.Connections; i++ {
+		go func(i int) {
+			n := 0
+			for qb := range d.Queue().C {
+				d.Queue().Done(qb)
+				d.Written(qb.Len())
+				qb.Release()
+
+				if n++; n == 1 {
+					read <- struct{}{}
+					<-start
+				}
+			}
+
+			written <- n
+			if i == 0 {
+				<-last
+			}
+			d.Finish()
+		}(i)
+	}
+
+	for i := 0; i < dest.Connections; i++ {
+		<-read
+	}
+	close(start)
+
+	total := 0
+	for i := 0; i < dest.Connections; i++ {
+		n := <-written
+		if n == 0 {
+			t.Error("a writer didn't read from the queue")
+		}
+		total += n
+	}
+	if total != 30 {
+		t.Errorf("got %d batches read, want 30", total)
+	}
+
+	// The drain waits for the last writer.
+	time.Sleep(20 * time.Millisecond)
+	if c.Draining(dest.Name) == nil {
+		t.Fatal("drain finished before all writers")
+	}
+	if registered, _ := c.ConnState(dest.Name); !registered {
+		t.Fatal("destination unregistered before all writers finished")
+	}
+
+	close(last)
+
+	deadline := time.Now().Add(time.Second)
+	for c.Draining(dest.Name) != nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	status := c.DrainStatus()[dest.Name]
+	if status.State != DrainDone || status.Written != 30 {
+		t.Errorf("got drain %s with %d written, want %s with 30", status.State, status.Written, DrainDone)
+	}
+	if registered, _ := c.ConnState(dest.Name); registered {
+		t.Error("destination not unregistered after draining")
+	}
+}
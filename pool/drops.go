@@ -0,0 +1,171 @@
+// Package pool drops.go implements
+// accounting for dropped datapoints.
+package pool
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// Drop reasons.
+const (
+	// DropQueueFull: the destination queue
+	// (and spill queue, if enabled) was full.
+	DropQueueFull = "queue-full"
+	// DropNoDestinations: no destination
+	// was available to route to.
+	DropNoDestinations = "no-destinations"
+	// DropRetryQueueFull: the retry queue was full.
+	DropRetryQueueFull = "retry-queue-full"
+	// DropRetryExpired: the retry TTL was exceeded.
+	DropRetryExpired = "retry-expired"
+	// DropRetryExhausted: the max retry
+	// attempts were exceeded.
+	DropRetryExhausted = "retry-exhausted"
+	// DropHintsFull: the hint store for
+	// a failed destination was full.
+	DropHintsFull = "hints-full"
+	// DropDestinationRemoved: in-flight messages were
+	// discarded when a broadcast destination was removed.
+	DropDestinationRemoved = "destination-removed"
+	// DropWriteError: a batch couldn't
+	// be written to its destination.
+	DropWriteError = "write-error"
+	// DropMemoryBudget: the global queue
+	// memory budget was exhausted.
+	DropMemoryBudget = "memory-budget"
+	// DropConversion: a datapoint couldn't be
+	// converted to its destination's format.
+	DropConversion = "conversion-error"
+	// DropSpillExpired: spilled or hinted datapoints
+	// on disk exceeded the spill max age.
+	DropSpillExpired = "spill-expired"
+)
+
+// Drops is the process-wide dropped
+// datapoint accounting facility.
+var Drops = NewDropCounter()
+
+// DropCounter counts dropped datapoints by
+// reason, cluster and destination. A rate-limited
+// sample of dropped datapoints can optionally be logged.
+type DropCounter struct {
+	sync.Mutex
+	counts map[DropKey]int64
+
+	// Sampling settings and state.
+	sampleMax      int
+	sampleInterval time.Duration
+	sampleWindow   time.Time
+	sampled        int
+}
+
+// DropKey classifies dropped datapoints.
+// Cluster and Destination are empty if
+// not applicable to the drop reason.
+type DropKey struct {
+	Reason      string
+	Cluster     string
+	Destination string
+}
+
+// DropCount is a dropped datapoint count.
+type DropCount struct {
+	DropKey
+	Count int64
+}
+
+// NewDropCounter initializes a *DropCounter.
+func NewDropCounter() *DropCounter {
+	return &DropCounter{
+		counts: make(map[DropKey]int64),
+	}
+}
+
+// SetSampling enables logging up to max dropped
+// datapoints per interval. A max of 0 disables sampling.
+func (d *DropCounter) SetSampling(max int, interval time.Duration) {
+	d.Lock()
+	d.sampleMax, d.sampleInterval = max, interval
+	d.Unlock()
+}
+
+// Add counts n dropped datapoints. m, if
+// not nil, is a dropped datapoint to sample.
+func (d *DropCounter) Add(reason, cluster, dest string, n int64, m []byte) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.counts[DropKey{Reason: reason, Cluster: cluster, Destination: dest}] += n
+
+	if d.sampleMax == 0 || m == nil {
+		return
+	}
+
+	if time.Since(d.sampleWindow) > d.sampleInterval {
+		if d.sampled > d.sampleMax {
+			log.Printf("Dropped datapoint sampling suppressed %d datapoints\n", d.sampled-d.sampleMax)
+		}
+		d.sampleWindow, d.sampled = time.Now(), 0
+	}
+
+	d.sampled++
+	if d.sampled <= d.sampleMax {
+		log.Printf("Dropped datapoint [%s] cluster=%s destination=%s: %s\n", reason, cluster, dest, m)
+	}
+}
+
+// Counts returns all drop counts, sorted
+// by reason, cluster and destination.
+func (d *DropCounter) Counts() []DropCount {
+	d.Lock()
+	counts := make([]DropCount, 0, len(d.counts))
+	for k, v := range d.counts {
+		counts = append(counts, DropCount{DropKey: k, Count: v})
+	}
+	d.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		a, b := counts[i], counts[j]
+		if a.Reason != b.Reason {
+			return a.Reason < b.Reason
+		}
+		if a.Cluster != b.Cluster {
+			return a.Cluster < b.Cluster
+		}
+		return a.Destination < b.Destination
+	})
+
+	return counts
+}
+
+// Total returns the total dropped datapoints.
+func (d *DropCounter) Total() int64 {
+	d.Lock()
+	defer d.Unlock()
+
+	var total int64
+	for _, v := range d.counts {
+		total += v
+	}
+
+	return total
+}
+
+// drop counts n datapoints dropped by
+// the cluster; m is one of them, to sample.
+func (c *Cluster) drop(reason, dest string, n int, m []byte) {
+	Drops.Add(reason, c.Name, dest, int64(n), m)
+}
+
+// dropBatch counts a batch of datapoints
+// dropped by the cluster.
+func (c *Cluster) dropBatch(reason string, b *batch.Batch) {
+	if b.Len() > 0 {
+		c.drop(reason, "", b.Len(), b.Point(0))
+	}
+}
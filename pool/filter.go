@@ -0,0 +1,49 @@
+// Package pool filter.go implements
+// per-destination mirror filters.
+package pool
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/consistenthash"
+)
+
+// Filter selects the subset of metrics
+// that a broadcast destination receives.
+// Pattern, if set, must match the metric name.
+// Sample is the percentage of series (0-100)
+// included. Sampling is by a hash of the series
+// name so that a given series is either always
+// or never included.
+type Filter struct {
+	Pattern *regexp.Regexp
+	Sample  float64
+}
+
+// Match returns whether the message m
+// passes the filter.
+func (f *Filter) Match(m []byte) bool {
+	key := batch.Name(m)
+
+	if f.Pattern != nil && !f.Pattern.Match(key) {
+		return false
+	}
+
+	if f.Sample >= 100 {
+		return true
+	}
+
+	return float64(consistenthash.FNV1a32(key)%10000) < f.Sample*100
+}
+
+// String returns a description of the filter.
+func (f *Filter) String() string {
+	pattern := ""
+	if f.Pattern != nil {
+		pattern = f.Pattern.String()
+	}
+
+	return fmt.Sprintf("filter=%s sample=%g%%", pattern, f.Sample)
+}
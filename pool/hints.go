@@ -0,0 +1,239 @@
+// Package pool hints.go implements hinted
+// handoff for failed hash-route destinations.
+package pool
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/jamiealquiza/polymur/diskqueue"
+)
+
+// Destination failover policies.
+const (
+	// FailoverRedistribute removes a failed destination
+	// from the hash ring and redistributes its messages
+	// to the remaining destinations.
+	FailoverRedistribute = "redistribute"
+	// FailoverHintedHandoff keeps a failed destination on
+	// the hash ring and stores its messages as hints that
+	// are replayed when the destination returns.
+	FailoverHintedHandoff = "hinted-handoff"
+)
+
+// hints holds messages for a failed destination.
+// Messages are held in memory, overflowing
+// to disk if a spill directory is configured.
+type hints struct {
+	sync.Mutex
+	mem    chan *string
+	disk   *diskqueue.Queue
+	closed bool
+}
+
+// put stores a hint. Returns false if the
+// hint store is full or has been closed.
+func (h *hints) put(m *string) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.closed {
+		return false
+	}
+
+	select {
+	case h.mem <- m:
+		return true
+	default:
+	}
+
+	if h.disk == nil {
+		return false
+	}
+
+	return h.disk.Put(*m) == nil
+}
+
+// get pops a hint. Returns nil
+// if there are no hints.
+func (h *hints) get() *string {
+	h.Lock()
+	defer h.Unlock()
+
+	select {
+	case m := <-h.mem:
+		return m
+	default:
+	}
+
+	if h.disk == nil {
+		return nil
+	}
+
+	if m, ok, _ := h.disk.Get(); ok {
+		return &m
+	}
+
+	return nil
+}
+
+// close closes the hint store, discarding
+// any hints stored on disk.
+func (h *hints) close() {
+	h.Lock()
+	defer h.Unlock()
+
+	h.closed = true
+	if h.disk != nil {
+		h.disk.Purge()
+	}
+}
+
+// FailConn handles a destination that has exceeded
+// its reconnect attempts according to the cluster's
+// failover policy. With hinted handoff in hash-route mode,
+// the destination is held on the ring and messages routed
+// to it are stored as hints until it reconnects.
+// Otherwise, the destination is removed from the pool
+// and its messages redistributed.
+func (c *Cluster) FailConn(dest Destination) {
+	if c.Failover != FailoverHintedHandoff || c.Distribution != "hash-route" {
+		c.RemoveConn(dest)
+		return
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.Down[dest.Name] {
+		return
+	}
+
+	log.Printf("Storing hints for failed destination %s%s\n", dest.Name, c.LogSuffix())
+
+	c.Down[dest.Name] = true
+	if _, exists := c.Hints[dest.Name]; !exists {
+		c.Hints[dest.Name] = c.openHints(dest.Name)
+	}
+
+	c.publish()
+}
+
+// RestoreConn marks a previously failed destination
+// as healthy. Any stored hints are replayed by the
+// destination's writer via NextHint.
+func (c *Cluster) RestoreConn(dest Destination) {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.Down[dest.Name] {
+		return
+	}
+
+	delete(c.Down, dest.Name)
+	c.publish()
+	log.Printf("Replaying hints for destination %s%s\n", dest.Name, c.LogSuffix())
+}
+
+// NextHint returns the next stored hint to
+// replay for a healthy destination, or nil if
+// there are none.
+func (c *Cluster) NextHint(name string) *string {
+	c.Lock()
+	defer c.Unlock()
+
+	h, exists := c.Hints[name]
+	if !exists || c.Down[name] {
+		return nil
+	}
+
+	if m := h.get(); m != nil {
+		return m
+	}
+
+	// Replay is complete.
+	h.close()
+	delete(c.Hints, name)
+	c.publish()
+
+	return nil
+}
+
+// hint stores m as a hint for the failed destination.
+func (c *Cluster) hint(r *routes, name string, m []byte) bool {
+	h, exists := r.hints[name]
+	if !exists {
+		return false
+	}
+
+	s := string(m)
+	return h.put(&s)
+}
+
+// openHints initializes a hint store for a destination,
+// loading any hints stored on disk prior to a restart.
+// Callers must hold the lock.
+func (c *Cluster) openHints(name string) *hints {
+	h := &hints{mem: make(chan *string, c.QueueCap)}
+
+	if c.Spill.Dir == "" {
+		return h
+	}
+
+	config := c.Spill
+	config.Dir = c.hintsDir(name)
+	config.Expired = c.spillExpired(name)
+
+	disk, err := diskqueue.Open(config)
+	if err != nil {
+		log.Printf("Destination %s%s hints error: %s\n", name, c.LogSuffix(), err)
+		return h
+	}
+
+	h.disk = disk
+
+	return h
+}
+
+// loadHints loads hints stored on disk prior
+// to a restart for replay. Callers must hold the lock.
+func (c *Cluster) loadHints(name string) {
+	if c.Spill.Dir == "" {
+		return
+	}
+
+	if _, exists := c.Hints[name]; exists {
+		return
+	}
+
+	if _, err := os.Stat(c.hintsDir(name)); err != nil {
+		return
+	}
+
+	c.Hints[name] = c.openHints(name)
+}
+
+// dropHints discards any hints for a destination.
+// Callers must hold the lock.
+func (c *Cluster) dropHints(name string) {
+	delete(c.Down, name)
+
+	if h, exists := c.Hints[name]; exists {
+		h.close()
+		delete(c.Hints, name)
+	}
+
+	if c.Spill.Dir != "" {
+		os.RemoveAll(c.hintsDir(name))
+	}
+
+	c.publish()
+}
+
+// hintsDir returns the hints disk
+// queue directory for a destination.
+func (c *Cluster) hintsDir(name string) string {
+	return filepath.Join(c.Spill.Dir, c.Name, "hints", spillName(name))
+}
@@ -0,0 +1,236 @@
+package pool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/diskqueue"
+)
+
+// hintedCluster returns a hash-route cluster using
+// hinted handoff with the destinations a and b.
+func hintedCluster(name string, queueCap int, spill diskqueue.Config) (*Cluster, Destination, Destination) {
+	c := NewCluster(name)
+	c.Distribution = "hash-route"
+	c.Failover = FailoverHintedHandoff
+	c.QueueCap = queueCap
+	c.Spill = spill
+
+	a, _ := ParseDestination("127.0.0.1:2003")
+	b, _ := ParseDestination("127.0.0.1:2004")
+	for _, dest := range []Destination{a, b} {
+		c.Register(dest)
+		c.AddConn(dest)
+	}
+
+	return c, a, b
+}
+
+// routedTo returns n datapoints that
+// the ring of c routes to name.
+func routedTo(c *Cluster, name string, n int) []string {
+	var points []string
+	for i := 0; len(points) < n; i++ {
+		m := fmt.Sprintf("metric.%d 1 1500000000", i)
+		if node, _ := c.routes().ring.GetNode(batch.Name([]byte(m))); node == name {
+			points = append(points, m)
+		}
+	}
+
+	return points
+}
+
+// replayHints returns the hints replayed for name.
+func replayHints(c *Cluster, name string) []string {
+	var got []string
+	for m := c.NextHint(name); m != nil; m = c.NextHint(name) {
+		got = append(got, *m)
+	}
+
+	return got
+}
+
+func TestHintsStore(t *testing.T) {
+	c, a, b := hintedCluster("hints-store", 10, diskqueue.Config{})
+	toA, toB := routedTo(c, a.Name, 3), routedTo(c, b.Name, 2)
+
+	c.FailConn(a)
+
+	// The failed destination is held on the
+	// ring; its datapoints are stored as hints
+	// rather than redistributed.
+	c.Distribute(batch.New(append(toA, toB...)...))
+
+	if n := c.Queue(a.Name).Len(); n != 0 {
+		t.Errorf("got %d datapoints queued for the failed destination", n)
+	}
+	if n := c.Queue(b.Name).Len(); n != 2 {
+		t.Errorf("got %d datapoints queued for %s, want 2", n, b.Name)
+	}
+	if n := len(c.Hints[a.Name].mem); n != 3 {
+		t.Errorf("got %d hints, want 3", n)
+	}
+
+	// Hints aren't replayed while the
+	// destination is down.
+	if m := c.NextHint(a.Name); m != nil {
+		t.Errorf("replayed %q while down", *m)
+	}
+}
+
+func TestHintsReplay(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Hints beyond the queue capacity
+	// overflow to disk.
+	c, a, _ := hintedCluster("hints-replay", 2, diskqueue.Config{Dir: dir})
+	toA := routedTo(c, a.Name, 5)
+
+	c.FailConn(a)
+	for _, m := range toA {
+		c.Distribute(batch.New(m))
+	}
+
+	if size := c.Hints[a.Name].disk.Size(); size == 0 {
+		t.Fatal("expected hints on disk")
+	}
+
+	c.RestoreConn(a)
+
+	// Hints are replayed in the order stored,
+	// from memory and then disk.
+	if got := replayHints(c, a.Name); fmt.Sprint(got) != fmt.Sprint(toA) {
+		t.Errorf("got %v, want %v", got, toA)
+	}
+
+	// The hint store is closed once replayed
+	// and datapoints are routed to the
+	// destination again.
+	if _, exists := c.Hints[a.Name]; exists {
+		t.Error("hint store wasn't closed after replay")
+	}
+
+	c.Distribute(batch.New(toA[0]))
+	if n := c.Queue(a.Name).Len(); n != 1 {
+		t.Errorf("got %d datapoints queued after recovery, want 1", n)
+	}
+}
+
+func TestHintsFull(t *testing.T) {
+	c, a, _ := hintedCluster("hints-full", 2, diskqueue.Config{})
+	toA := routedTo(c, a.Name, 5)
+
+	c.FailConn(a)
+	c.Distribute(batch.New(toA...))
+
+	// Without a spill directory, hints are
+	// capped at the queue capacity.
+	if n := dropCount(c.Name, DropHintsFull); n != 3 {
+		t.Errorf("got %d %s drops, want 3", n, DropHintsFull)
+	}
+
+	c.RestoreConn(a)
+	if got := replayHints(c, a.Name); fmt.Sprint(got) != fmt.Sprint(toA[:2]) {
+		t.Errorf("got %v, want %v", got, toA[:2])
+	}
+}
+
+func TestHintsSpillFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, a, _ := hintedCluster("hints-spill-full", 1, diskqueue.Config{Dir: dir})
+	toA := routedTo(c, a.Name, 4)
+
+	// Room on disk for two datapoints.
+	c.Spill.MaxSize = int64(2 * (len(toA[0]) + 1))
+
+	c.FailConn(a)
+	c.Distribute(batch.New(toA...))
+
+	if n := dropCount(c.Name, DropHintsFull); n != 1 {
+		t.Errorf("got %d %s drops, want 1", n, DropHintsFull)
+	}
+
+	c.RestoreConn(a)
+	if got := replayHints(c, a.Name); fmt.Sprint(got) != fmt.Sprint(toA[:3]) {
+		t.Errorf("got %v, want %v", got, toA[:3])
+	}
+}
+
+func TestHintsExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, a, _ := hintedCluster("hints-expired", 1, diskqueue.Config{Dir: dir, MaxAge: 50 * time.Millisecond})
+	toA := routedTo(c, a.Name, 3)
+
+	c.FailConn(a)
+	c.Distribute(batch.New(toA...))
+
+	time.Sleep(100 * time.Millisecond)
+	c.RestoreConn(a)
+
+	// Hints on disk older than MaxAge are
+	// dropped rather than replayed.
+	if got := replayHints(c, a.Name); fmt.Sprint(got) != fmt.Sprint(toA[:1]) {
+		t.Errorf("got %v, want %v", got, toA[:1])
+	}
+	if n := dropCount(c.Name, DropSpillExpired); n != 2 {
+		t.Errorf("got %d %s drops, want 2", n, DropSpillExpired)
+	}
+}
+
+func TestHintsUnregister(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hints")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, a, _ := hintedCluster("hints-unregister", 1, diskqueue.Config{Dir: dir})
+	toA := routedTo(c, a.Name, 3)
+
+	c.FailConn(a)
+	c.Distribute(batch.New(toA...))
+
+	if _, err := os.Stat(c.hintsDir(a.Name)); err != nil {
+		t.Fatalf("expected hints on disk: %s", err)
+	}
+
+	// Unregistering purges the
+	// destination's hints.
+	c.Unregister(a)
+
+	if _, exists := c.Hints[a.Name]; exists {
+		t.Error("hint store wasn't closed")
+	}
+	if c.Down[a.Name] {
+		t.Error("destination still marked down")
+	}
+	if _, err := os.Stat(c.hintsDir(a.Name)); !os.IsNotExist(err) {
+		t.Errorf("hints directory wasn't removed: %v", err)
+	}
+
+	// Re-adding the destination doesn't
+	// replay the purged hints.
+	c.Register(a)
+	c.AddConn(a)
+	if m := c.NextHint(a.Name); m != nil {
+		t.Errorf("replayed %q after unregistering", *m)
+	}
+}
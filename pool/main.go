@@ -5,209 +5,259 @@
 package pool
 
 import (
+	"errors"
 	"fmt"
-	"log"
+	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/jamiealquiza/polymur/consistenthash"
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/diskqueue"
 )
 
-// Destination is an output destination.
-type Destination struct {
-	IP   string
-	Port string
-	ID   string
-	Addr string
-	Name string
-}
+// DefaultCluster is the name of the cluster
+// that destinations belong to if no cluster
+// is specified.
+const DefaultCluster = "default"
 
-// Pool holds destination connections, queues
-// and routing functions.
+// Pool holds named destination clusters.
+// The incoming stream is broadcast across
+// all clusters; each cluster then distributes
+// it among its own destinations.
 type Pool struct {
 	sync.RWMutex
-	Ring               *consistenthash.HashRing
-	Conns              map[string]chan *string
-	Registered         map[string]time.Time
-	DistributionMethod map[string]func(*Pool, []*string)
-	Distribution       string
-	QueueCap           int
-	RetryQueue         chan []*string
+	Clusters map[string]*Cluster
+	// clusters is an immutable, sorted
+	// snapshot of Clusters.
+	clusters atomic.Value
+	// state, if set, is the destination state
+	// file for clusters added to the pool.
+	state *State
+	// writer creates destination writers for
+	// clusters added to the pool.
+	writer WriterFunc
+}
+
+// ClusterConfig holds cluster configuration.
+type ClusterConfig struct {
+	Name          string
+	Destinations  string
+	Distribution  string
+	HashAlgorithm string
+	QueueCap      int
+	// Spill configures destination overflow disk queues;
+	// Spill.Dir is the base directory for the pool.
+	Spill diskqueue.Config
+	// Failover is the failed destination policy.
+	Failover string
+	// DrainTimeout is the max time to drain a
+	// destination; see Cluster.Drain.
+	DrainTimeout time.Duration
+	// Retry configures retry handling; the
+	// zero value uses DefaultRetryConfig.
+	Retry RetryConfig
+	// Health configures destination health checks;
+	// the zero value uses DefaultHealthConfig.
+	Health HealthConfig
+	// Reconnect is the default destination reconnect
+	// policy; the zero value uses DefaultReconnectConfig.
+	Reconnect ReconnectConfig
 }
 
 // NewPool initializes a *Pool.
 func NewPool() *Pool {
 	pool := &Pool{
-		Ring:       &consistenthash.HashRing{Vnodes: 100},
-		Conns:      make(map[string]chan *string),
-		Registered: make(map[string]time.Time),
-		DistributionMethod: map[string]func(*Pool, []*string){
-			"broadcast":  (*Pool).broadcast,
-			"hash-route": (*Pool).hashRoute,
-		},
-		RetryQueue: make(chan []*string, 4096),
+		Clusters: make(map[string]*Cluster),
 	}
 
+	pool.clusters.Store([]*Cluster{})
+
 	return pool
 }
 
-// Distribution functions.
+// AddCluster initializes a cluster from config
+// and adds it to the pool.
+func (p *Pool) AddCluster(config ClusterConfig) (*Cluster, error) {
+	c := NewCluster(config.Name)
 
-// broadcast takes a batch of messages and
-// sends a copy of each to all destinations outbound queue.
-func (p *Pool) broadcast(messages []*string) {
-	p.RLock()
-	defer p.RUnlock()
-	// For each message in the batch,
-	for _, m := range messages {
-		if m == nil {
-			break
-		}
-		// enqueue into each available destination queue.
-		for _, q := range p.Conns {
-			select {
-			case q <- m:
-				continue
-			default:
-				// Skip if it's full.
-				continue
-			}
-		}
+	if _, valid := c.DistributionMethod[config.Distribution]; !valid {
+		return nil, fmt.Errorf("Cluster %s: unknown distribution method %s", config.Name, config.Distribution)
 	}
-}
 
-// hashRoute takes a batch of messages and
-// distributes them to the destination outbound
-// queue according to the CH algo.
-func (p *Pool) hashRoute(messages []*string) {
-	p.RLock()
-	defer p.RUnlock()
-	for _, m := range messages {
-		if m == nil {
-			break
-		}
+	if err := c.SetHashAlgorithm(config.HashAlgorithm); err != nil {
+		return nil, fmt.Errorf("Cluster %s: %s", config.Name, err)
+	}
 
-		key := strings.Fields(*m)[0]
-		node, err := p.Ring.GetNode(key)
-		// Current failure mode if
-		// the hash ring is empty.
-		if err != nil {
-			continue
-		}
+	switch config.Failover {
+	case FailoverRedistribute, FailoverHintedHandoff:
+		c.Failover = config.Failover
+	case "":
+	default:
+		return nil, fmt.Errorf("Cluster %s: unknown failover policy %s", config.Name, config.Failover)
+	}
 
-		select {
-		case p.Conns[node] <- m:
-			continue
-		default:
-			break
-		}
+	c.Distribution = config.Distribution
+	c.QueueCap = config.QueueCap
+	if config.DrainTimeout > 0 {
+		c.DrainTimeout = config.DrainTimeout
+	}
+	c.state = p.state
+	c.writer = p.writer
+	c.Spill = config.Spill
 
-		// If unavailable, load into failed messages for retry.
-		failed := []*string{m}
-		select {
-		case p.RetryQueue <- failed:
-			continue
-		// If retryQueue is full, don't block message Distribution.
-		default:
-			continue
-		}
+	if config.Health != (HealthConfig{}) {
+		c.Health = config.Health
+	}
 
+	if config.Reconnect != (ReconnectConfig{}) {
+		if err := config.Reconnect.validate(); err != nil {
+			return nil, fmt.Errorf("Cluster %s: %s", config.Name, err)
+		}
+		c.Reconnect = config.Reconnect
 	}
-}
 
-// Pool state update methods.
+	if config.Retry != (RetryConfig{}) {
+		c.Retry = config.Retry
+		c.RetryQueue = make(chan *Retry, c.Retry.QueueCap)
+	}
 
-// Register adds a timestamped connection
-// to the pool's registered connection list.
-// A registered destination is not necessarily active.
-func (p *Pool) Register(dest Destination) {
 	p.Lock()
 	defer p.Unlock()
 
-	log.Printf("Registered destination %s\n", dest.Name)
-	p.Registered[dest.Name] = time.Now()
+	if _, exists := p.Clusters[config.Name]; exists {
+		return nil, fmt.Errorf("Cluster %s already exists", config.Name)
+	}
+
+	p.Clusters[config.Name] = c
+
+	clusters := make([]*Cluster, 0, len(p.Clusters))
+	for _, c := range p.Clusters {
+		clusters = append(clusters, c)
+	}
+
+	sort.Slice(clusters, func(i, j int) bool {
+		return clusters[i].Name < clusters[j].Name
+	})
+
+	p.clusters.Store(clusters)
+
+	return c, nil
 }
 
-// Unregister removes a connection from the
-// pool and additionally drops the connection queue.
-func (p *Pool) Unregister(dest Destination) {
-	p.Lock()
-	delete(p.Registered, dest.Name)
-	p.Unlock()
+// Cluster returns the named cluster. An empty
+// name references the default cluster.
+func (p *Pool) Cluster(name string) (*Cluster, error) {
+	if name == "" {
+		name = DefaultCluster
+	}
+
+	p.RLock()
+	defer p.RUnlock()
 
-	log.Printf("Unregistered destination %s\n", dest.Name)
-	p.RemoveConn(dest)
+	c, exists := p.Clusters[name]
+	if !exists {
+		return nil, fmt.Errorf("Cluster %s does not exist", name)
+	}
+
+	return c, nil
+}
+
+// ClusterList returns all clusters sorted
+// by name. The slice must not be modified.
+func (p *Pool) ClusterList() []*Cluster {
+	return p.clusters.Load().([]*Cluster)
 }
 
-// AddConn adds a connection's outbound queue
-// to the pool's active list.
-func (p *Pool) AddConn(dest Destination) {
+// SetWriter sets the function that creates the writer
+// of each destination added to clusters subsequently
+// added to the pool; see Cluster.AddDestination.
+func (p *Pool) SetWriter(writer WriterFunc) {
 	p.Lock()
-	p.Conns[dest.Name] = make(chan *string, p.QueueCap)
+	p.writer = writer
 	p.Unlock()
-
-	// This replicates the destination key setup in
-	// the carbon-cache implementation. It's a string composed of the
-	// (destination IP, instance) tuple. E.g. "('127.0.0.1', 'a')"
-	destString := fmt.Sprintf("('%s', '%s')", dest.IP, dest.ID)
-	p.Ring.AddNode(destString, dest.Name)
 }
 
-// RemoveConn removes a connection's outbound queue
-// from the pool's active lists.
-// Additionally, it will redistribute any in-flight messages.
-func (p *Pool) RemoveConn(dest Destination) {
-	p.Lock()
-	// Check if it exists, first.
-	if _, connectionIsInPool := p.Conns[dest.Name]; !connectionIsInPool {
-		p.Unlock()
-		return
+// Distribute takes a batch of messages and
+// passes it to every cluster in the pool.
+// It's safe for concurrent use. The caller's
+// reference to b is unaffected.
+func (p *Pool) Distribute(b *batch.Batch) {
+	for _, c := range p.ClusterList() {
+		c.Distribute(b)
 	}
+}
+
+// ParseClusters takes a cluster list string and
+// returns a []ClusterConfig. Clusters are semicolon
+// delimited and take the form
+// "name[?option=value&...]@destination,destination".
+// Cluster options not specified are taken
+// from the defaults ClusterConfig.
+// Supported options:
+// - distribution: distribution method.
+// - hash-algorithm: hash-route algorithm.
+// - queue-cap: per destination queue capacity.
+// - failover: failed destination policy.
+func ParseClusters(s string, defaults ClusterConfig) ([]ClusterConfig, error) {
+	configs := []ClusterConfig{}
 
-	log.Printf("Removing destination %s from connection pool\n", dest.Name)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
 
-	// Grab the queue to redistribute any message it's holding.
-	q := p.Conns[dest.Name]
+		config := defaults
 
-	// Remove.
-	delete(p.Conns, dest.Name)
-	p.Unlock()
+		parts := strings.SplitN(spec, "@", 2)
+		if len(parts) == 2 {
+			config.Destinations = parts[1]
+		} else {
+			config.Destinations = ""
+		}
 
-	p.Ring.RemoveNode(dest.Name)
+		name, opts := parts[0], ""
+		if i := strings.Index(name, "?"); i >= 0 {
+			name, opts = name[:i], name[i+1:]
+		}
 
-	close(q)
+		if name == "" {
+			return nil, errors.New("Cluster name must be specified")
+		}
+		config.Name = name
 
-	// Don't need to redistribute in-flight for broadcast.
-	if p.Distribution == "broadcast" {
-		return
-	}
-	// If the queue had any in-flight messages, redistribute them.
-	if len(q) > 0 {
-		log.Printf("Redistributing in-flight messages for %s", dest.Name)
-		for m := range q {
-			failed := []*string{m}
-			p.RetryQueue <- failed
+		params, err := url.ParseQuery(opts)
+		if err != nil {
+			return nil, fmt.Errorf("Cluster %s options not valid: %s", name, err)
 		}
-	}
-}
 
-// ParseDestination takes a destination string
-// and returns a Destination{}.
-func ParseDestination(s string) (Destination, error) {
-	d := Destination{Name: s}
-	parts := strings.Split(s, ":")
-
-	switch len(parts) {
-	case 2:
-		d.IP, d.Port = parts[0], parts[1]
-	case 3:
-		d.IP, d.Port, d.ID = parts[0], parts[1], parts[2]
-	default:
-		return d, fmt.Errorf("Destination %s not valid\n", s)
-	}
+		for k, v := range params {
+			val := v[len(v)-1]
+
+			switch k {
+			case "distribution":
+				config.Distribution = val
+			case "hash-algorithm":
+				config.HashAlgorithm = val
+			case "failover":
+				config.Failover = val
+			case "queue-cap":
+				qc, err := strconv.Atoi(val)
+				if err != nil || qc < 1 {
+					return nil, fmt.Errorf("Cluster %s: queue-cap must be a positive integer", name)
+				}
+				config.QueueCap = qc
+			default:
+				return nil, fmt.Errorf("Cluster %s: unknown option %s", name, k)
+			}
+		}
 
-	d.Addr = d.IP + ":" + d.Port
+		configs = append(configs, config)
+	}
 
-	return d, nil
+	return configs, nil
 }
@@ -0,0 +1,201 @@
+// Package pool memory.go implements
+// the global queue memory budget.
+package pool
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// Memory budget policies.
+const (
+	// BudgetDrop drops incoming batches while the budget
+	// is exhausted, and treats destination and retry
+	// queues as full.
+	BudgetDrop = "drop"
+	// BudgetBackpressure blocks listeners while the budget
+	// is exhausted, which stops reading from clients.
+	BudgetBackpressure = "backpressure"
+)
+
+// MemoryComponent is a queue
+// type tracked by the budget.
+type MemoryComponent int
+
+// Memory components.
+const (
+	// MemoryIncoming is the incoming queue.
+	MemoryIncoming MemoryComponent = iota
+	// MemoryOutgoing is all destination queues.
+	MemoryOutgoing
+	// MemoryRetry is all cluster retry queues.
+	MemoryRetry
+	memoryComponents
+)
+
+// String returns the component name.
+func (c MemoryComponent) String() string {
+	switch c {
+	case MemoryIncoming:
+		return "incoming"
+	case MemoryOutgoing:
+		return "outgoing"
+	case MemoryRetry:
+		return "retry"
+	}
+
+	return "unknown"
+}
+
+// Memory is the process-wide queue memory budget.
+var Memory = NewBudget()
+
+// Budget tracks the datapoint bytes held in the incoming,
+// destination and retry queues against a global limit.
+// A batch shared by several destination queues is counted
+// once per queue. With no limit set, usage is tracked but
+// nothing is limited.
+type Budget struct {
+	limit  int64
+	policy string
+	used   int64
+	usage  [memoryComponents]int64
+	// blocked is the number of times a
+	// listener blocked on the budget.
+	blocked int64
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	waiting int32
+}
+
+// BudgetUsage is a snapshot of budget usage.
+type BudgetUsage struct {
+	Limit      int64            `json:"limit"`
+	Policy     string           `json:"policy"`
+	Used       int64            `json:"used"`
+	Blocked    int64            `json:"blocked"`
+	Components map[string]int64 `json:"components"`
+}
+
+// NewBudget initializes an unlimited *Budget.
+func NewBudget() *Budget {
+	b := &Budget{policy: BudgetDrop}
+	b.cond = sync.NewCond(&b.mu)
+
+	return b
+}
+
+// SetLimit sets the budget limit in bytes
+// (0 is unlimited) and the policy applied
+// once it's reached. It must be called
+// before the budget is in use.
+func (m *Budget) SetLimit(limit int64, policy string) error {
+	switch policy {
+	case BudgetDrop, BudgetBackpressure:
+	default:
+		return fmt.Errorf("unknown memory budget policy %s", policy)
+	}
+
+	m.limit, m.policy = limit, policy
+
+	return nil
+}
+
+// Admit accounts a batch of datapoints entering the
+// incoming queue. If the budget is exhausted, Admit blocks
+// until it isn't with the backpressure policy; with the drop
+// policy, the batch is counted as dropped and Admit returns
+// false. Callers must release a batch that isn't admitted,
+// and the reader of the incoming queue must Free each batch.
+func (m *Budget) Admit(b *batch.Batch) bool {
+	n := int64(b.Size())
+
+	if m.reserve(MemoryIncoming, n) {
+		return true
+	}
+
+	if m.policy == BudgetDrop {
+		if b.Len() > 0 {
+			Drops.Add(DropMemoryBudget, "", "", int64(b.Len()), b.Point(0))
+		}
+		return false
+	}
+
+	m.mu.Lock()
+	atomic.AddInt32(&m.waiting, 1)
+	atomic.AddInt64(&m.blocked, 1)
+	for !m.reserve(MemoryIncoming, n) {
+		m.cond.Wait()
+	}
+	atomic.AddInt32(&m.waiting, -1)
+	m.mu.Unlock()
+
+	return true
+}
+
+// take accounts n bytes loaded into a destination or
+// retry queue. Returns false if the budget is exhausted
+// and the policy is drop. With the backpressure policy,
+// queued data is always accepted; listeners block instead.
+func (m *Budget) take(c MemoryComponent, n int64) bool {
+	if m.policy == BudgetBackpressure {
+		m.add(c, n)
+		return true
+	}
+
+	return m.reserve(c, n)
+}
+
+// reserve accounts n bytes for component c if within
+// the limit. An allocation larger than the limit is
+// accepted if nothing else is held.
+func (m *Budget) reserve(c MemoryComponent, n int64) bool {
+	if used := atomic.AddInt64(&m.used, n); m.limit > 0 && used > m.limit && used != n {
+		atomic.AddInt64(&m.used, -n)
+		return false
+	}
+	atomic.AddInt64(&m.usage[c], n)
+
+	return true
+}
+
+// add accounts n bytes for component
+// c regardless of the limit.
+func (m *Budget) add(c MemoryComponent, n int64) {
+	atomic.AddInt64(&m.used, n)
+	atomic.AddInt64(&m.usage[c], n)
+}
+
+// Free releases n bytes held by component c,
+// waking any listeners blocked on the budget.
+func (m *Budget) Free(c MemoryComponent, n int) {
+	atomic.AddInt64(&m.usage[c], -int64(n))
+	used := atomic.AddInt64(&m.used, -int64(n))
+
+	if used < m.limit && atomic.LoadInt32(&m.waiting) > 0 {
+		m.mu.Lock()
+		m.cond.Broadcast()
+		m.mu.Unlock()
+	}
+}
+
+// Usage returns the current budget usage.
+func (m *Budget) Usage() BudgetUsage {
+	u := BudgetUsage{
+		Limit:      m.limit,
+		Policy:     m.policy,
+		Used:       atomic.LoadInt64(&m.used),
+		Blocked:    atomic.LoadInt64(&m.blocked),
+		Components: make(map[string]int64, memoryComponents),
+	}
+
+	for c := MemoryComponent(0); c < memoryComponents; c++ {
+		u.Components[c.String()] = atomic.LoadInt64(&m.usage[c])
+	}
+
+	return u
+}
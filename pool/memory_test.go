@@ -0,0 +1,125 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// newBudget returns a *Budget with the
+// given limit and policy.
+func newBudget(t *testing.T, limit int64, policy string) *Budget {
+	m := NewBudget()
+	if err := m.SetLimit(limit, policy); err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestBudgetAccounting(t *testing.T) {
+	m := newBudget(t, 1000, BudgetDrop)
+	b := batch.New("a.b 1 1500000000", "c.d 2 1500000000")
+
+	if !m.Admit(b) {
+		t.Fatal("batch not admitted")
+	}
+	m.take(MemoryOutgoing, 100)
+	m.take(MemoryRetry, 10)
+
+	u := m.Usage()
+	if u.Components["incoming"] != int64(b.Size()) || u.Components["outgoing"] != 100 || u.Components["retry"] != 10 {
+		t.Errorf("got components %v", u.Components)
+	}
+	if u.Used != int64(b.Size())+110 {
+		t.Errorf("got %d bytes used, want %d", u.Used, b.Size()+110)
+	}
+
+	m.Free(MemoryIncoming, b.Size())
+	m.Free(MemoryOutgoing, 100)
+	m.Free(MemoryRetry, 10)
+
+	u = m.Usage()
+	for k, v := range u.Components {
+		if v != 0 {
+			t.Errorf("%s: got %d bytes after freeing", k, v)
+		}
+	}
+	if u.Used != 0 {
+		t.Errorf("got %d bytes used after freeing", u.Used)
+	}
+}
+
+func TestBudgetDrop(t *testing.T) {
+	m := newBudget(t, 100, BudgetDrop)
+	b := batch.New("a.b 1 1500000000", "c.d 2 1500000000")
+	dropped := dropCount("", DropMemoryBudget)
+
+	// The limit is shared by all components.
+	if !m.take(MemoryOutgoing, 80) {
+		t.Fatal("take failed under the limit")
+	}
+	if m.take(MemoryRetry, 30) {
+		t.Error("retry queue accepted beyond the limit")
+	}
+	if m.Admit(b) {
+		t.Error("batch admitted beyond the limit")
+	}
+	if n := dropCount("", DropMemoryBudget) - dropped; n != 2 {
+		t.Errorf("got %d %s drops, want 2", n, DropMemoryBudget)
+	}
+
+	m.Free(MemoryOutgoing, 80)
+	if !m.Admit(b) {
+		t.Error("batch not admitted after freeing")
+	}
+	m.Free(MemoryIncoming, b.Size())
+
+	// An allocation larger than the limit is
+	// accepted if nothing else is held.
+	if !m.take(MemoryOutgoing, 200) {
+		t.Error("oversized allocation not accepted with the budget empty")
+	}
+}
+
+func TestBudgetBackpressure(t *testing.T) {
+	m := newBudget(t, 100, BudgetBackpressure)
+	b := batch.New("a.b 1 1500000000", "c.d 2 1500000000")
+
+	// Queued data is accepted beyond the limit
+	// so that datapoints in flight aren't dropped.
+	if !m.take(MemoryOutgoing, 80) || !m.take(MemoryRetry, 30) {
+		t.Fatal("take failed with the backpressure policy")
+	}
+
+	// Listeners block until the
+	// budget is freed.
+	admitted := make(chan bool)
+	go func() { admitted <- m.Admit(b) }()
+
+	select {
+	case <-admitted:
+		t.Fatal("batch admitted beyond the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if u := m.Usage(); u.Blocked != 1 {
+		t.Errorf("got %d blocked, want 1", u.Blocked)
+	}
+
+	m.Free(MemoryRetry, 30)
+	m.Free(MemoryOutgoing, 80)
+
+	select {
+	case ok := <-admitted:
+		if !ok {
+			t.Error("batch not admitted")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("batch not admitted after freeing")
+	}
+
+	if u := m.Usage(); u.Used != int64(b.Size()) || u.Components["incoming"] != int64(b.Size()) {
+		t.Errorf("got %d bytes used, %v", u.Used, u.Components)
+	}
+}
@@ -0,0 +1,103 @@
+// Package pool queue.go implements
+// destination outbound queues.
+package pool
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// Queue is a destination outbound queue of
+// message batches. Capacity and length are in
+// messages rather than batches. Batches received
+// from C must be marked with Done, and released once
+// written. C is closed once the queue is retired;
+// puts to a closed queue fail.
+type Queue struct {
+	C   chan *batch.Batch
+	len int64
+	cap int64
+	// mu guards closing C against puts
+	// from distribution calls using a prior
+	// routes snapshot.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newQueue initializes a *Queue with
+// a capacity of cap messages.
+func newQueue(cap int) *Queue {
+	if cap < 1 {
+		cap = 1
+	}
+
+	return &Queue{
+		C:   make(chan *batch.Batch, cap),
+		cap: int64(cap),
+	}
+}
+
+// put loads a reference to b into the queue without
+// blocking. Returns false if the queue doesn't have
+// capacity for the batch, the memory budget is exhausted
+// or the queue is closed. A batch larger than the queue
+// capacity is accepted if the queue is empty.
+func (q *Queue) put(b *batch.Batch) bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return false
+	}
+
+	n := int64(b.Len())
+	if l := atomic.AddInt64(&q.len, n); l > q.cap && l != n {
+		atomic.AddInt64(&q.len, -n)
+		return false
+	}
+
+	if !Memory.take(MemoryOutgoing, int64(b.Size())) {
+		atomic.AddInt64(&q.len, -n)
+		return false
+	}
+
+	select {
+	case q.C <- b.Retain():
+		return true
+	default:
+		b.Release()
+		Memory.Free(MemoryOutgoing, b.Size())
+		atomic.AddInt64(&q.len, -n)
+		return false
+	}
+}
+
+// close closes C. Subsequent puts fail.
+func (q *Queue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if !q.closed {
+		q.closed = true
+		close(q.C)
+	}
+}
+
+// Done marks a batch received from C
+// as removed from the queue.
+func (q *Queue) Done(b *batch.Batch) {
+	atomic.AddInt64(&q.len, -int64(b.Len()))
+	Memory.Free(MemoryOutgoing, b.Size())
+}
+
+// Len returns the number of queued messages.
+func (q *Queue) Len() int {
+	return int(atomic.LoadInt64(&q.len))
+}
+
+// Cap returns the queue capacity in messages.
+func (q *Queue) Cap() int {
+	return int(q.cap)
+}
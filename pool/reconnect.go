@@ -0,0 +1,223 @@
+// Package pool reconnect.go implements
+// destination reconnect policy and status.
+package pool
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// ReconnectConfig holds destination reconnect
+// policy. Connection attempts time out after
+// DialTimeout. Failed attempts are retried with
+// exponential backoff from MinBackoff to MaxBackoff,
+// with jitter; after MaxFailures consecutive failures,
+// a connected destination's circuit breaker is opened
+// (see OpenBreaker), evicting it from routing.
+type ReconnectConfig struct {
+	DialTimeout time.Duration
+	MinBackoff  time.Duration
+	MaxBackoff  time.Duration
+	MaxFailures int
+}
+
+// DefaultReconnectConfig returns
+// the default ReconnectConfig.
+func DefaultReconnectConfig() ReconnectConfig {
+	return ReconnectConfig{
+		DialTimeout: 3 * time.Second,
+		MinBackoff:  time.Second,
+		MaxBackoff:  30 * time.Second,
+		MaxFailures: 3,
+	}
+}
+
+// Backoff returns the wait following the
+// given number of consecutive failures: a random
+// duration between half and all of the exponential
+// backoff, so that destinations failing together
+// don't reconnect in lockstep.
+func (r ReconnectConfig) Backoff(failures int) time.Duration {
+	d := r.MinBackoff
+	for i := 1; i < failures && d < r.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > r.MaxBackoff {
+		d = r.MaxBackoff
+	}
+
+	if d < 2 {
+		return d
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)))
+}
+
+// validate returns an error if r has a non-positive
+// value; a zero backoff would retry in a tight loop.
+func (r ReconnectConfig) validate() error {
+	switch {
+	case r.DialTimeout <= 0:
+		return errors.New("reconnect dial timeout must be positive")
+	case r.MinBackoff <= 0:
+		return errors.New("reconnect min backoff must be positive")
+	case r.MaxBackoff <= 0:
+		return errors.New("reconnect max backoff must be positive")
+	case r.MaxFailures <= 0:
+		return errors.New("reconnect max failures must be positive")
+	}
+
+	return nil
+}
+
+// merge returns r with any zero
+// values taken from defaults.
+func (r ReconnectConfig) merge(defaults ReconnectConfig) ReconnectConfig {
+	if r.DialTimeout == 0 {
+		r.DialTimeout = defaults.DialTimeout
+	}
+	if r.MinBackoff == 0 {
+		r.MinBackoff = defaults.MinBackoff
+	}
+	if r.MaxBackoff == 0 {
+		r.MaxBackoff = defaults.MaxBackoff
+	}
+	if r.MaxFailures == 0 {
+		r.MaxFailures = defaults.MaxFailures
+	}
+
+	return r
+}
+
+// ConnStatus holds a destination's
+// connection history.
+type ConnStatus struct {
+	// Connected is when the current (or
+	// last) connection was established.
+	Connected time.Time `json:"connected"`
+	// Connections is the number of
+	// connections to the destination.
+	Connections int `json:"connections"`
+	// TLS is set if connections use TLS.
+	TLS bool `json:"tls"`
+	// Reconnects is the number of connections
+	// reestablished after a failure.
+	Reconnects int64 `json:"reconnects"`
+	// Failures is the number of consecutive
+	// failed connection attempts.
+	Failures    int       `json:"failures"`
+	LastError   string    `json:"last-error,omitempty"`
+	LastErrorAt time.Time `json:"last-error-at"`
+	// PacketsSent and SendErrors count
+	// datagrams sent to UDP destinations.
+	PacketsSent int64 `json:"packets-sent,omitempty"`
+	SendErrors  int64 `json:"send-errors,omitempty"`
+}
+
+// ReconnectPolicy returns dest's reconnect policy:
+// the cluster's, overridden by any destination options.
+func (c *Cluster) ReconnectPolicy(dest Destination) ReconnectConfig {
+	return dest.Reconnect.merge(c.Reconnect)
+}
+
+// ConnState returns whether the named destination
+// is registered, and whether it's active (its queue
+// is in the pool).
+func (c *Cluster) ConnState(name string) (registered, active bool) {
+	c.RLock()
+	defer c.RUnlock()
+
+	_, registered = c.Registered[name]
+	_, active = c.Conns[name]
+
+	return registered, active
+}
+
+// Connected records a connection to dest; reconnect
+// is set if the connection replaces a previous one.
+func (c *Cluster) Connected(dest Destination, reconnect bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.ConnStats[dest.Name]
+	if s == nil {
+		return
+	}
+
+	if reconnect {
+		s.Reconnects++
+	}
+	s.Connected = time.Now()
+	s.Failures = 0
+}
+
+// ConnFailed records a failed connection attempt
+// to dest and returns the consecutive failures,
+// or 0 if dest isn't registered.
+func (c *Cluster) ConnFailed(dest Destination, err error) int {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.ConnStats[dest.Name]
+	if s == nil {
+		return 0
+	}
+
+	s.Failures++
+	s.setError(err)
+
+	return s.Failures
+}
+
+// PacketsSent adds to dest's sent and failed datagram
+// counts, recording err as its last error if set.
+func (c *Cluster) PacketsSent(dest Destination, sent, errors int64, err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	s := c.ConnStats[dest.Name]
+	if s == nil {
+		return
+	}
+
+	s.PacketsSent += sent
+	s.SendErrors += errors
+	if err != nil {
+		s.setError(err)
+	}
+}
+
+// setError records err as the last error.
+func (s *ConnStatus) setError(err error) {
+	s.LastError = err.Error()
+	s.LastErrorAt = time.Now()
+}
+
+// ConnStatus returns the connection
+// status of each registered destination.
+func (c *Cluster) ConnStatus() map[string]ConnStatus {
+	c.RLock()
+	defer c.RUnlock()
+
+	status := make(map[string]ConnStatus, len(c.ConnStats))
+	for name, s := range c.ConnStats {
+		status[name] = *s
+	}
+
+	return status
+}
+
+// DestinationStats returns the named destination's
+// connection status. The zero value is returned if
+// the destination isn't registered.
+func (c *Cluster) DestinationStats(name string) ConnStatus {
+	c.RLock()
+	defer c.RUnlock()
+
+	if s := c.ConnStats[name]; s != nil {
+		return *s
+	}
+
+	return ConnStatus{}
+}
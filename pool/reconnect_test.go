@@ -0,0 +1,64 @@
+package pool
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	r := ReconnectConfig{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	// The backoff doubles from MinBackoff
+	// up to MaxBackoff, jittered to between
+	// half and all of it.
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{1, 100 * time.Millisecond},
+		{2, 200 * time.Millisecond},
+		{3, 400 * time.Millisecond},
+		{4, 800 * time.Millisecond},
+		{5, time.Second},
+		{50, time.Second},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if d := r.Backoff(tt.failures); d < tt.want/2 || d >= tt.want {
+				t.Fatalf("Backoff(%d) = %s, want [%s, %s)", tt.failures, d, tt.want/2, tt.want)
+			}
+		}
+	}
+}
+
+func TestAddClusterReconnect(t *testing.T) {
+	p := NewPool()
+	config := ClusterConfig{Distribution: "broadcast", HashAlgorithm: "carbon_ch"}
+
+	// The zero value uses the defaults.
+	config.Name = "reconnect-default"
+	c, err := p.AddCluster(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Reconnect != DefaultReconnectConfig() {
+		t.Errorf("got %+v, want the defaults", c.Reconnect)
+	}
+
+	valid := DefaultReconnectConfig()
+	invalid := []ReconnectConfig{valid, valid, valid, valid}
+	invalid[0].DialTimeout = 0
+	invalid[1].MinBackoff = 0
+	invalid[2].MaxBackoff = -time.Second
+	invalid[3].MaxFailures = 0
+
+	for i, r := range invalid {
+		config.Name = fmt.Sprintf("reconnect-invalid-%d", i)
+		config.Reconnect = r
+		if _, err := p.AddCluster(config); err == nil {
+			t.Errorf("%d: %+v: expected an error", i, r)
+		}
+	}
+}
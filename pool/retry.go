@@ -0,0 +1,274 @@
+// Package pool retry.go implements
+// failed message retry handling.
+package pool
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// Retry is a message pending redistribution.
+type Retry struct {
+	Message  *string
+	Attempts int
+	// Failed is when the message
+	// first failed delivery.
+	Failed time.Time
+}
+
+// RetryConfig holds retry handling configuration.
+// Messages are retried in batches of up to BatchSize,
+// flushed at least every FlushInterval. A message is
+// retried up to MaxAttempts times within TTL of its
+// first failure; messages exhausting either are written
+// to the DeadLetter file, if set, and counted.
+// If no destinations are available or none can take
+// messages, retries back off exponentially from
+// MinBackoff to MaxBackoff.
+type RetryConfig struct {
+	QueueCap      int
+	BatchSize     int
+	FlushInterval time.Duration
+	MaxAttempts   int
+	TTL           time.Duration
+	MinBackoff    time.Duration
+	MaxBackoff    time.Duration
+	DeadLetter    string
+}
+
+// DefaultRetryConfig returns
+// the default RetryConfig.
+func DefaultRetryConfig() RetryConfig {
+	return RetryConfig{
+		QueueCap:      4096,
+		BatchSize:     100,
+		FlushInterval: time.Second,
+		MaxAttempts:   10,
+		TTL:           5 * time.Minute,
+		MinBackoff:    100 * time.Millisecond,
+		MaxBackoff:    30 * time.Second,
+	}
+}
+
+// RetryStats holds retry handling counters.
+type RetryStats struct {
+	// Retried is the number of retry attempts.
+	Retried int64 `json:"retried"`
+	// Delivered is the number of messages
+	// delivered on retry.
+	Delivered int64 `json:"delivered"`
+	// Expired is the number of messages
+	// that exceeded the retry TTL.
+	Expired int64 `json:"expired"`
+	// Exhausted is the number of messages
+	// that exceeded the max retry attempts.
+	Exhausted int64 `json:"exhausted"`
+	// Dropped is the number of messages dropped
+	// because the retry queue was full or the
+	// memory budget was exhausted.
+	Dropped int64 `json:"dropped"`
+}
+
+// retry loads m into the retry queue
+// without blocking message distribution.
+func (c *Cluster) retry(m string) {
+	c.requeue(&Retry{Message: &m, Failed: time.Now()})
+}
+
+// RetryStats returns the cluster's retry counters.
+func (c *Cluster) RetryStats() RetryStats {
+	return RetryStats{
+		Retried:   atomic.LoadInt64(&c.retryStats.Retried),
+		Delivered: atomic.LoadInt64(&c.retryStats.Delivered),
+		Expired:   atomic.LoadInt64(&c.retryStats.Expired),
+		Exhausted: atomic.LoadInt64(&c.retryStats.Exhausted),
+		Dropped:   atomic.LoadInt64(&c.retryStats.Dropped),
+	}
+}
+
+// RetryHandler reads batches of failed messages from
+// the retry queue and redistributes them to the cluster's
+// destinations, backing off while no destinations are
+// available. Messages exceeding the retry attempts or TTL
+// are dead-lettered.
+func (c *Cluster) RetryHandler() {
+	config := c.Retry
+	backoff := config.MinBackoff
+
+	flush := time.NewTicker(config.FlushInterval)
+	defer flush.Stop()
+
+	batch := []*Retry{}
+
+	for {
+		select {
+		case r := <-c.RetryQueue:
+			Memory.Free(MemoryRetry, len(*r.Message))
+			batch = append(batch, r)
+			if len(batch) < config.BatchSize {
+				continue
+			}
+		case <-flush.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		// Dead-letter messages that have
+		// exceeded the retry TTL.
+		pending := batch[:0]
+		for _, r := range batch {
+			if config.TTL > 0 && time.Since(r.Failed) > config.TTL {
+				c.deadLetter(r.Message, DropRetryExpired, &c.retryStats.Expired)
+				continue
+			}
+			pending = append(pending, r)
+		}
+		batch = pending
+
+		// If there are no available destinations,
+		// hold the batch and back off.
+		if !c.available() {
+			for _, r := range batch {
+				c.requeue(r)
+			}
+			batch = batch[:0]
+
+			backoff = c.backoff(backoff)
+			continue
+		}
+
+		delivered := 0
+		for _, r := range batch {
+			r.Attempts++
+			atomic.AddInt64(&c.retryStats.Retried, 1)
+
+			if c.redeliver(r.Message) {
+				atomic.AddInt64(&c.retryStats.Delivered, 1)
+				delivered++
+				continue
+			}
+
+			if config.MaxAttempts > 0 && r.Attempts >= config.MaxAttempts {
+				c.deadLetter(r.Message, DropRetryExhausted, &c.retryStats.Exhausted)
+				continue
+			}
+
+			c.requeue(r)
+		}
+
+		batch = batch[:0]
+
+		// Also back off if destinations are
+		// available but none could take messages.
+		if delivered == 0 {
+			backoff = c.backoff(backoff)
+		} else {
+			backoff = config.MinBackoff
+		}
+	}
+}
+
+// backoff sleeps for d and returns the
+// next backoff duration.
+func (c *Cluster) backoff(d time.Duration) time.Duration {
+	time.Sleep(d)
+
+	if d *= 2; d > c.Retry.MaxBackoff {
+		d = c.Retry.MaxBackoff
+	}
+
+	return d
+}
+
+// available returns whether the cluster
+// has any destinations to retry to.
+func (c *Cluster) available() bool {
+	r := c.routes()
+
+	return len(r.conns) > len(r.down)
+}
+
+// redeliver attempts to enqueue a single failed
+// message according to the cluster's distribution
+// method, without loading it into the retry queue
+// on failure. Broadcast messages aren't retried.
+func (c *Cluster) redeliver(m *string) bool {
+	r := c.routes()
+
+	b := batch.New(*m)
+	defer b.Release()
+
+	switch c.Distribution {
+	case "hash-route":
+		node, err := r.ring.GetNode(batch.Name(b.Point(0)))
+		if err != nil {
+			return false
+		}
+
+		if r.down[node] {
+			return c.hint(r, node, b.Point(0))
+		}
+
+		return c.enqueue(r, node, b) == 1
+	case "round-robin", "least-queue":
+		for _, name := range r.names {
+			if r.down[name] {
+				continue
+			}
+			if c.enqueue(r, name, b) == 1 {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// requeue loads a retry into the retry queue,
+// dead-lettering it if the queue is full or the
+// memory budget is exhausted.
+func (c *Cluster) requeue(r *Retry) {
+	n := len(*r.Message)
+	if !Memory.take(MemoryRetry, int64(n)) {
+		c.deadLetter(r.Message, DropMemoryBudget, &c.retryStats.Dropped)
+		return
+	}
+
+	select {
+	case c.RetryQueue <- r:
+	default:
+		Memory.Free(MemoryRetry, n)
+		c.deadLetter(r.Message, DropRetryQueueFull, &c.retryStats.Dropped)
+	}
+}
+
+// deadLetter counts a message that couldn't be
+// delivered as dropped for reason and writes it to
+// the dead letter file if configured.
+func (c *Cluster) deadLetter(m *string, reason string, counter *int64) {
+	atomic.AddInt64(counter, 1)
+	c.drop(reason, "", 1, []byte(*m))
+
+	if c.Retry.DeadLetter == "" {
+		return
+	}
+
+	c.deadLetterMu.Lock()
+	defer c.deadLetterMu.Unlock()
+
+	if c.deadLetterFile == nil {
+		f, err := os.OpenFile(c.Retry.DeadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			log.Printf("Dead letter file error%s: %s\n", c.LogSuffix(), err)
+			return
+		}
+		c.deadLetterFile = f
+	}
+
+	c.deadLetterFile.WriteString(*m + "\n")
+}
@@ -0,0 +1,164 @@
+// Package pool routes.go implements
+// lock-free cluster routing state.
+package pool
+
+import (
+	"sort"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/consistenthash"
+	"github.com/jamiealquiza/polymur/diskqueue"
+)
+
+// retireGrace is how long a removed destination
+// queue is held open for distribution calls still
+// using a prior routes snapshot (see Queue.close).
+var retireGrace = 5 * time.Second
+
+// routes is an immutable snapshot of the
+// cluster state used to distribute messages.
+// Distribution reads the current snapshot without
+// locking; cluster state updates publish a new one.
+type routes struct {
+	ring    consistenthash.Ring
+	conns   map[string]*Queue
+	names   []string
+	filters map[string]*Filter
+	spills  map[string]*diskqueue.Queue
+	down    map[string]bool
+	hints   map[string]*hints
+}
+
+// routes returns the current routes snapshot.
+func (c *Cluster) routes() *routes {
+	return c.snapshot.Load().(*routes)
+}
+
+// publish swaps in a routes snapshot of the
+// current cluster state. Callers must hold the lock.
+func (c *Cluster) publish() {
+	r := &routes{
+		ring:    c.Ring,
+		conns:   make(map[string]*Queue, len(c.Conns)),
+		names:   make([]string, 0, len(c.Conns)),
+		filters: make(map[string]*Filter, len(c.Filters)),
+		spills:  make(map[string]*diskqueue.Queue, len(c.Spills)),
+		down:    make(map[string]bool, len(c.Down)),
+		hints:   make(map[string]*hints, len(c.Hints)),
+	}
+
+	for k, v := range c.Conns {
+		r.conns[k] = v
+		r.names = append(r.names, k)
+	}
+	sort.Strings(r.names)
+
+	for k, v := range c.Filters {
+		r.filters[k] = v
+	}
+	for k, v := range c.Spills {
+		r.spills[k] = v
+	}
+	for k, v := range c.Down {
+		r.down[k] = v
+	}
+	for k, v := range c.Hints {
+		r.hints[k] = v
+	}
+
+	c.snapshot.Store(r)
+}
+
+// buildRing replaces the cluster's hash ring with
+// a new ring of all active destinations, in the order
+// they were added. Rings are never modified once
+// published. Callers must hold the lock.
+func (c *Cluster) buildRing() {
+	ring, err := consistenthash.New(c.hashAlgorithm, 100)
+	if err != nil {
+		return
+	}
+
+	for _, n := range c.nodes {
+		ring.AddNode(n)
+	}
+
+	c.Ring = ring
+}
+
+// retire closes a removed destination queue once
+// distribution calls are unlikely to hold a snapshot
+// referencing it, then redistributes any messages left
+// in it. Puts from snapshots held longer fail, as with
+// a full queue.
+func (c *Cluster) retire(name string, q *Queue) {
+	time.Sleep(retireGrace)
+
+	q.close()
+	c.flush(name, q)
+}
+
+// flush redistributes the messages in a removed
+// destination queue through the retry queue (see
+// requeue). Broadcast messages are dropped.
+func (c *Cluster) flush(name string, q *Queue) {
+	for {
+		select {
+		case b, ok := <-q.C:
+			if !ok {
+				return
+			}
+			q.Done(b)
+			c.Redistribute(name, b)
+			b.Release()
+		default:
+			return
+		}
+	}
+}
+
+// Redistribute loads the messages in b, taken from
+// the named removed destination, into the retry queue
+// (see requeue). Broadcast messages are dropped. The
+// caller's reference to b is unaffected.
+func (c *Cluster) Redistribute(name string, b *batch.Batch) {
+	if c.Distribution == "broadcast" {
+		if b.Len() > 0 {
+			c.drop(DropDestinationRemoved, name, b.Len(), b.Point(0))
+		}
+		return
+	}
+
+	for i := 0; i < b.Len(); i++ {
+		c.retry(string(b.Point(i)))
+	}
+}
+
+// Queue returns the named destination's outbound
+// queue, or nil if the destination isn't active.
+func (c *Cluster) Queue(name string) *Queue {
+	return c.routes().conns[name]
+}
+
+// QueueState returns the named destination's outbound
+// queue (nil if it isn't active) and its circuit breaker
+// state ("" if it isn't registered), read together
+// so that they're consistent with each other.
+func (c *Cluster) QueueState(name string) (*Queue, string) {
+	c.RLock()
+	defer c.RUnlock()
+
+	var state string
+	if b := c.Breakers[name]; b != nil {
+		state = b.state
+	}
+
+	return c.Conns[name], state
+}
+
+// RingShares returns the key space
+// share of each active destination.
+func (c *Cluster) RingShares() map[string]float64 {
+	return c.routes().ring.Shares()
+}
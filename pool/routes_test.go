@@ -0,0 +1,95 @@
+package pool
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// dropCount returns the drops counted
+// for reason in the named cluster.
+func dropCount(cluster, reason string) int64 {
+	var n int64
+	for _, d := range Drops.Counts() {
+		if d.Cluster == cluster && d.Reason == reason {
+			n += d.Count
+		}
+	}
+
+	return n
+}
+
+func TestFlushRetryQueueFull(t *testing.T) {
+	c := NewCluster("flush-retry-full")
+	c.Distribution = "hash-route"
+	c.RetryQueue = make(chan *Retry, 1)
+
+	q := newQueue(10)
+	q.put(batch.New("a 1 1500000000", "b 1 1500000000", "c 1 1500000000"))
+
+	done := make(chan struct{})
+	go func() {
+		c.flush("127.0.0.1:2003", q)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("flush blocked on a full retry queue")
+	}
+
+	if len(c.RetryQueue) != 1 {
+		t.Errorf("expected 1 retried message, got %d", len(c.RetryQueue))
+	}
+	if n := dropCount(c.Name, DropRetryQueueFull); n != 2 {
+		t.Errorf("expected 2 %s drops, got %d", DropRetryQueueFull, n)
+	}
+}
+
+func TestRedistribute(t *testing.T) {
+	b := batch.New("a 1 1500000000", "b 1 1500000000")
+
+	c := NewCluster("redistribute-broadcast")
+	c.Distribution = "broadcast"
+	c.Redistribute("127.0.0.1:2003", b)
+	if n := dropCount(c.Name, DropDestinationRemoved); n != 2 {
+		t.Errorf("expected 2 %s drops, got %d", DropDestinationRemoved, n)
+	}
+
+	c = NewCluster("redistribute-hash-route")
+	c.Distribution = "hash-route"
+	c.Redistribute("127.0.0.1:2003", b)
+	if len(c.RetryQueue) != 2 {
+		t.Errorf("expected 2 retried messages, got %d", len(c.RetryQueue))
+	}
+}
+
+func TestDropCounts(t *testing.T) {
+	points := []string{}
+	for i := 0; i < 10; i++ {
+		points = append(points, "a.b 1 1500000000")
+	}
+	b := batch.New(points...)
+
+	c := NewCluster("drops-broadcast")
+	c.Distribution = "broadcast"
+	c.QueueCap = 10
+	dest, _ := ParseDestination("127.0.0.1:2003")
+	c.Register(dest)
+	c.AddConn(dest)
+
+	c.Distribute(b)
+	c.Distribute(b)
+	if n := dropCount(c.Name, DropQueueFull); n != 10 {
+		t.Errorf("expected 10 %s drops, got %d", DropQueueFull, n)
+	}
+
+	c = NewCluster("drops-hash-route")
+	c.Distribution = "hash-route"
+	c.Distribute(b)
+	if n := dropCount(c.Name, DropNoDestinations); n != 10 {
+		t.Errorf("expected 10 %s drops, got %d", DropNoDestinations, n)
+	}
+}
@@ -0,0 +1,149 @@
+// Package pool spill.go implements
+// disk-backed destination queue overflow.
+package pool
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/diskqueue"
+)
+
+// enqueue loads a batch into the named destination's
+// outbound queue. If the queue is full, the batch is spilled
+// to the destination's disk queue (if enabled). While
+// a destination has spilled messages pending replay,
+// new messages are spilled as well to preserve ordering.
+// Returns the number of messages queued; the remainder
+// couldn't be queued.
+func (c *Cluster) enqueue(r *routes, name string, b *batch.Batch) int {
+	spill, spilling := r.spills[name]
+	if !spilling || spill.Empty() {
+		if r.conns[name].put(b) {
+			return b.Len()
+		}
+	}
+
+	return c.spill(r, name, b)
+}
+
+// spill writes a batch to the named destination's
+// disk queue. Returns the number of messages spilled;
+// the remainder couldn't be spilled because spilling
+// isn't enabled or the disk queue is full.
+func (c *Cluster) spill(r *routes, name string, b *batch.Batch) int {
+	spill, spilling := r.spills[name]
+	if !spilling {
+		return 0
+	}
+
+	n, _ := spill.PutBatch(b.Bytes())
+
+	return n
+}
+
+// Replay returns a batch of up to max messages spilled
+// to disk or stored as hints for the named destination,
+// to be written once its outbound queue is drained.
+// Spilled messages are replayed first. Returns nil if
+// there are no messages to replay.
+func (c *Cluster) Replay(name string, max int) *batch.Batch {
+	var b *batch.Batch
+
+	if spill := c.routes().spills[name]; spill != nil {
+		for b == nil || b.Len() < max {
+			m, ok, _ := spill.Get()
+			if !ok {
+				break
+			}
+			if b == nil {
+				b = batch.Get()
+			}
+			b.AppendString(m)
+		}
+	}
+
+	for b == nil || b.Len() < max {
+		m := c.NextHint(name)
+		if m == nil {
+			break
+		}
+		if b == nil {
+			b = batch.Get()
+		}
+		b.AppendString(*m)
+	}
+
+	return b
+}
+
+// openSpill opens the disk queue for a destination
+// if spilling is enabled. Any datapoints spilled prior
+// to a restart are loaded for replay.
+// Callers must hold the lock.
+func (c *Cluster) openSpill(dest Destination) {
+	if c.Spill.Dir == "" {
+		return
+	}
+
+	config := c.Spill
+	config.Dir = c.spillDir(dest.Name)
+	config.Expired = c.spillExpired(dest.Name)
+
+	spill, err := diskqueue.Open(config)
+	if err != nil {
+		log.Printf("Destination %s%s spill queue error: %s\n", dest.Name, c.LogSuffix(), err)
+		return
+	}
+
+	if size := spill.Size(); size > 0 {
+		log.Printf("Destination %s%s has %d bytes of spilled messages to replay\n", dest.Name, c.LogSuffix(), size)
+	}
+
+	c.Spills[dest.Name] = spill
+}
+
+// closeSpill closes the disk queue for a destination.
+// Spilled datapoints are retained for replay when
+// the destination returns. Callers must hold the lock.
+func (c *Cluster) closeSpill(name string) {
+	if spill, spilling := c.Spills[name]; spilling {
+		spill.Close()
+		delete(c.Spills, name)
+	}
+}
+
+// purgeSpill removes any spilled datapoints
+// for a destination.
+func (c *Cluster) purgeSpill(name string) {
+	if c.Spill.Dir == "" {
+		return
+	}
+
+	if err := os.RemoveAll(c.spillDir(name)); err != nil {
+		log.Printf("Destination %s%s spill purge error: %s\n", name, c.LogSuffix(), err)
+	}
+}
+
+// spillExpired returns a disk queue callback counting
+// datapoints expired for a destination as dropped.
+func (c *Cluster) spillExpired(name string) func(int) {
+	return func(n int) {
+		c.drop(DropSpillExpired, name, n, nil)
+	}
+}
+
+// spillDir returns the disk queue
+// directory for a destination.
+func (c *Cluster) spillDir(name string) string {
+	return filepath.Join(c.Spill.Dir, c.Name, spillName(name))
+}
+
+// spillName returns a destination
+// name usable as a directory name.
+func spillName(name string) string {
+	return strings.NewReplacer(":", "_", "/", "_").Replace(name)
+}
@@ -0,0 +1,48 @@
+package pool
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/diskqueue"
+)
+
+func TestSpillExpired(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c := NewCluster("spill-expired")
+	c.QueueCap = 1
+	c.Spill = diskqueue.Config{Dir: dir, MaxAge: 50 * time.Millisecond}
+
+	dest, _ := ParseDestination("127.0.0.1:2003")
+	c.Register(dest)
+	c.AddConn(dest)
+
+	// The second batch overflows to disk.
+	if !c.Enqueue(dest.Name, batch.New("a 1 1500000000")) {
+		t.Fatal("enqueue failed")
+	}
+	if !c.Enqueue(dest.Name, batch.New("b 1 1500000000", "c 1 1500000000", "d 1 1500000000")) {
+		t.Fatal("spill failed")
+	}
+
+	if size := c.routes().spills[dest.Name].Size(); size != 45 {
+		t.Fatalf("got %d spilled bytes, want 45", size)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if b := c.Replay(dest.Name, 10); b != nil {
+		t.Errorf("replayed %d expired datapoints", b.Len())
+	}
+	if n := dropCount(c.Name, DropSpillExpired); n != 3 {
+		t.Errorf("got %d %s drops, want 3", n, DropSpillExpired)
+	}
+}
@@ -0,0 +1,192 @@
+// Package pool state.go implements
+// persistence of runtime destination changes.
+package pool
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State persists destinations registered and
+// unregistered with the API across restarts. At startup,
+// the state of each cluster takes precedence over the
+// destinations flags: destinations added at runtime are
+// restored (with the options they were added with), and
+// flag destinations removed at runtime stay removed.
+// Destinations newly added to the flags are registered.
+type State struct {
+	sync.Mutex
+	path     string
+	Clusters map[string]*ClusterState `json:"clusters"`
+}
+
+// ClusterState holds a cluster's runtime
+// destination changes.
+type ClusterState struct {
+	// Added holds the destination string of
+	// each destination registered at runtime.
+	Added map[string]string `json:"added"`
+	// Removed holds when each flag destination
+	// was unregistered at runtime.
+	Removed map[string]time.Time `json:"removed"`
+}
+
+// LoadState loads the state file at path. A
+// missing state file is treated as empty.
+func LoadState(path string) (*State, error) {
+	s := &State{
+		path:     path,
+		Clusters: make(map[string]*ClusterState),
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, s); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// SetState sets the state file for clusters
+// subsequently added to the pool.
+func (p *Pool) SetState(s *State) {
+	p.Lock()
+	p.state = s
+	p.Unlock()
+}
+
+// Destinations merges a cluster's flag destinations
+// with its state and returns the destinations to register.
+func (s *State) Destinations(cluster string, flags []Destination) []Destination {
+	s.Lock()
+	defer s.Unlock()
+
+	cs := s.Clusters[cluster]
+	if cs == nil {
+		return flags
+	}
+
+	dests := []Destination{}
+	for _, dest := range flags {
+		if _, removed := cs.Removed[dest.Name]; removed {
+			log.Printf("Destination %s in cluster %s was removed at runtime; not registering\n", dest.Name, cluster)
+			continue
+		}
+		if _, added := cs.Added[dest.Name]; added {
+			continue
+		}
+		dests = append(dests, dest)
+	}
+
+	names := make([]string, 0, len(cs.Added))
+	for name := range cs.Added {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		dest, err := ParseDestination(cs.Added[name])
+		if err != nil {
+			log.Printf("Destination %s in cluster %s not restored: %s\n", name, cluster, err)
+			continue
+		}
+		dest.Source = SourceState
+		dests = append(dests, dest)
+	}
+
+	return dests
+}
+
+// add records a destination registered at runtime.
+func (s *State) add(cluster string, dest Destination) {
+	s.Lock()
+	defer s.Unlock()
+
+	cs := s.cluster(cluster)
+	cs.Added[dest.Name] = dest.Spec
+	delete(cs.Removed, dest.Name)
+
+	s.save()
+}
+
+// remove records a destination unregistered at runtime.
+// Flag destinations are recorded as removed so that
+// they're not registered following a restart.
+func (s *State) remove(cluster, name, source string) {
+	s.Lock()
+	defer s.Unlock()
+
+	cs := s.cluster(cluster)
+	delete(cs.Added, name)
+	if source == SourceFlag {
+		cs.Removed[name] = time.Now()
+	}
+
+	s.save()
+}
+
+// cluster returns the named cluster's state,
+// initializing it if unset. Callers must hold
+// the lock.
+func (s *State) cluster(name string) *ClusterState {
+	cs := s.Clusters[name]
+	if cs == nil {
+		cs = &ClusterState{}
+		s.Clusters[name] = cs
+	}
+
+	if cs.Added == nil {
+		cs.Added = make(map[string]string)
+	}
+	if cs.Removed == nil {
+		cs.Removed = make(map[string]time.Time)
+	}
+
+	return cs
+}
+
+// save atomically replaces the state file by writing
+// to a temporary file and renaming it over the state
+// file. Callers must hold the lock.
+func (s *State) save() {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		log.Printf("State file error: %s\n", err)
+		return
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		log.Printf("State file error: %s\n", err)
+		return
+	}
+
+	_, err = tmp.Write(append(data, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		log.Printf("State file error: %s\n", err)
+	}
+}
@@ -0,0 +1,175 @@
+package pool
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// stateCluster loads the state file at path
+// and returns a cluster persisting to it.
+func stateCluster(t *testing.T, path string) (*State, *Cluster) {
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := NewPool()
+	p.SetState(s)
+	c, err := p.AddCluster(ClusterConfig{
+		Name:          DefaultCluster,
+		Distribution:  "broadcast",
+		HashAlgorithm: "carbon_ch",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, c
+}
+
+// destinations returns the name, spec
+// and source of each of dests.
+func destinations(dests []Destination) string {
+	var s []string
+	for _, d := range dests {
+		s = append(s, fmt.Sprintf("%s=%s(%s)", d.Name, d.Spec, d.Source))
+	}
+
+	return fmt.Sprint(s)
+}
+
+func TestStateRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	var flags []Destination
+	for _, spec := range []string{"127.0.0.1:2003", "127.0.0.1:2004"} {
+		dest, _ := ParseDestination(spec)
+		dest.Source = SourceFlag
+		flags = append(flags, dest)
+	}
+
+	s, c := stateCluster(t, path)
+	for _, dest := range s.Destinations(c.Name, flags) {
+		c.Register(dest)
+	}
+
+	// A destination added with the API keeps its
+	// options; a flag destination removed with the
+	// API isn't registered following a restart.
+	for _, spec := range []string{"127.0.0.1:2005?connections=2", "127.0.0.1:2006"} {
+		dest, _ := ParseDestination(spec)
+		dest.Source = SourceAPI
+		c.Register(dest)
+	}
+	c.Unregister(flags[0])
+
+	s, c = stateCluster(t, path)
+	restored := s.Destinations(c.Name, flags)
+
+	want := "[127.0.0.1:2004=127.0.0.1:2004(flag) " +
+		"127.0.0.1:2005=127.0.0.1:2005?connections=2(state) " +
+		"127.0.0.1:2006=127.0.0.1:2006(state)]"
+	if got := destinations(restored); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if restored[1].Connections != 2 {
+		t.Errorf("got %d connections, want 2", restored[1].Connections)
+	}
+
+	// A restored destination removed with
+	// the API is dropped from the state.
+	for _, dest := range restored {
+		c.Register(dest)
+	}
+	c.Unregister(restored[2])
+
+	s, c = stateCluster(t, path)
+	want = "[127.0.0.1:2004=127.0.0.1:2004(flag) " +
+		"127.0.0.1:2005=127.0.0.1:2005?connections=2(state)]"
+	if got := destinations(s.Destinations(c.Name, flags)); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestStateSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	_, c := stateCluster(t, path)
+
+	dest, _ := ParseDestination("127.0.0.1:2005")
+	dest.Source = SourceAPI
+	c.Register(dest)
+
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Unregister(dest)
+
+	// The state file is replaced by renaming
+	// a temporary file over it rather than
+	// rewritten in place.
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Error("state file was rewritten in place")
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("got %d files, want only the state file", len(files))
+	}
+
+	if _, err := LoadState(path); err != nil {
+		t.Errorf("state file not loaded: %s", err)
+	}
+}
+
+func TestLoadState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "state.json")
+
+	// A missing state file is empty, registering
+	// the flag destinations.
+	s, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dest, _ := ParseDestination("127.0.0.1:2003")
+	flags := []Destination{dest}
+	if got := s.Destinations(DefaultCluster, flags); len(got) != 1 || got[0].Name != dest.Name {
+		t.Errorf("got %s, want the flag destinations", destinations(got))
+	}
+
+	// A corrupt state file is an error.
+	if err := ioutil.WriteFile(path, []byte(`{"clusters": {"default": {"added": `), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadState(path); err == nil {
+		t.Error("expected an error loading a corrupt state file")
+	}
+}
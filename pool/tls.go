@@ -0,0 +1,67 @@
+// Package pool tls.go implements
+// TLS destination configuration.
+package pool
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSConfig holds a TLS destination's options.
+// CA is a PEM CA bundle used to verify the destination
+// in place of the system roots; Cert and Key are a PEM
+// client certificate and key. The destination certificate
+// is verified against ServerName, which defaults to the
+// destination IP (or host name).
+type TLSConfig struct {
+	CA         string
+	Cert       string
+	Key        string
+	ServerName string
+	config     *tls.Config
+}
+
+// Config returns the *tls.Config
+// for connecting to the destination.
+func (t *TLSConfig) Config() *tls.Config {
+	return t.config
+}
+
+// load reads the CA bundle and client certificate,
+// if set, and builds the *tls.Config.
+func (t *TLSConfig) load(host string) error {
+	t.config = &tls.Config{ServerName: t.ServerName}
+	if t.ServerName == "" {
+		t.config.ServerName = host
+	}
+
+	if t.CA != "" {
+		pem, err := ioutil.ReadFile(t.CA)
+		if err != nil {
+			return err
+		}
+
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", t.CA)
+		}
+		t.config.RootCAs = roots
+	}
+
+	if (t.Cert == "") != (t.Key == "") {
+		return errors.New("tls-cert and tls-key must be set together")
+	}
+
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return err
+		}
+		t.config.Certificates = []tls.Certificate{cert}
+	}
+
+	return nil
+}
@@ -0,0 +1,228 @@
+package pool
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert is a certificate and key
+// signed by a test CA.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert returns a certificate for the IP 127.0.0.1,
+// signed by parent or self-signed as a CA if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA, tmpl.BasicConstraintsValid = true, true
+		tmpl.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{
+		cert: cert,
+		key:  key,
+		tls:  tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+// writePEM writes the certificate, and the key
+// if withKey is set, to PEM files in dir,
+// returning their paths.
+func (c *testCert) writePEM(t *testing.T, dir string, withKey bool) (string, string) {
+	certPath := filepath.Join(dir, c.cert.Subject.CommonName+".pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw})
+	if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if !withKey {
+		return certPath, ""
+	}
+
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, c.cert.Subject.CommonName+"-key.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certPath, keyPath
+}
+
+// tlsServer starts a TLS listener with the given config
+// that completes the handshake with each connection.
+// It returns the listener address.
+func tlsServer(t *testing.T, config *tls.Config) (string, func()) {
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().String(), func() { l.Close() }
+}
+
+// dialTLS connects to the destination parsed
+// from spec and reads until the server closes the
+// connection. With TLS 1.3, a client certificate
+// rejected by the server is reported on read.
+func dialTLS(spec string) error {
+	dest, err := ParseDestination(spec)
+	if err != nil {
+		return err
+	}
+
+	conn, err := tls.Dial("tcp", dest.Addr, dest.TLS.Config())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+func TestTLSVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	other := newTestCert(t, "other-ca", nil)
+	server := newTestCert(t, "server", ca)
+
+	caPath, _ := ca.writePEM(t, dir, false)
+	otherPath, _ := other.writePEM(t, dir, false)
+
+	addr, stop := tlsServer(t, &tls.Config{Certificates: []tls.Certificate{server.tls}})
+	defer stop()
+
+	// The certificate is verified against
+	// the CA bundle and the destination IP.
+	if err := dialTLS("tcp://" + addr + "?tls-ca=" + caPath); err != nil {
+		t.Errorf("verification failed: %s", err)
+	}
+
+	rejected := []string{
+		// The system roots don't include the CA.
+		"tcp://" + addr + "?tls=true",
+		// Signed by a different CA.
+		"tcp://" + addr + "?tls-ca=" + otherPath,
+		// The certificate isn't valid for the name.
+		"tcp://" + addr + "?tls-ca=" + caPath + "&tls-server-name=carbon.example.com",
+	}
+
+	for _, spec := range rejected {
+		if err := dialTLS(spec); err == nil {
+			t.Errorf("%s: expected a verification error", spec)
+		}
+	}
+}
+
+func TestTLSClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "server", ca)
+	client := newTestCert(t, "client", ca)
+
+	caPath, _ := ca.writePEM(t, dir, false)
+	certPath, keyPath := client.writePEM(t, dir, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	addr, stop := tlsServer(t, &tls.Config{
+		Certificates: []tls.Certificate{server.tls},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    roots,
+	})
+	defer stop()
+
+	if err := dialTLS("tcp://" + addr + "?tls-ca=" + caPath + "&tls-cert=" + certPath + "&tls-key=" + keyPath); err != nil {
+		t.Errorf("client certificate rejected: %s", err)
+	}
+
+	// Without a client certificate, the server
+	// rejects the handshake.
+	if err := dialTLS("tcp://" + addr + "?tls-ca=" + caPath); err == nil {
+		t.Error("expected the server to reject the connection")
+	}
+
+	invalid := []string{
+		"tcp://" + addr + "?tls-cert=" + certPath,
+		"tcp://" + addr + "?tls-ca=" + keyPath,
+		"tcp://" + addr + "?tls-ca=" + filepath.Join(dir, "missing.pem"),
+	}
+
+	for _, spec := range invalid {
+		if _, err := ParseDestination(spec); err == nil {
+			t.Errorf("%s: expected an error", spec)
+		}
+	}
+}
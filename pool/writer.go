@@ -0,0 +1,145 @@
+// Package pool writer.go defines
+// destination writers.
+package pool
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// Writer writes a destination's queued messages to its
+// sink. The pool creates a Writer for each destination
+// added to a cluster with the pool's WriterFunc.
+type Writer interface {
+	// Start registers the destination and writes its
+	// queued messages until it's unregistered or the
+	// writer is shut down. It blocks.
+	Start()
+	// Enqueue queues b for the destination, bypassing
+	// routing. It returns false if b wasn't queued.
+	Enqueue(b *batch.Batch) bool
+	// Health returns the destination's
+	// circuit breaker status.
+	Health() BreakerStatus
+	// Stats returns the destination's
+	// connection status.
+	Stats() ConnStatus
+	// Shutdown stops the writer once any buffered
+	// messages are written, and waits for it to
+	// exit. The destination remains registered.
+	Shutdown()
+}
+
+// WriterFunc returns a Writer for dest in a cluster,
+// or an error if dest isn't valid for the writer.
+type WriterFunc func(*Cluster, Destination) (Writer, error)
+
+// AddDestination creates a writer for dest with the
+// cluster's WriterFunc and starts it; the writer registers
+// the destination and adds it to the cluster once connected.
+// Destinations that already have a writer, or are
+// being drained, aren't added.
+func (c *Cluster) AddDestination(dest Destination) error {
+	if c.writer == nil {
+		return fmt.Errorf("Cluster %s has no destination writer", c.Name)
+	}
+
+	w, err := c.writer(c, dest)
+	if err != nil {
+		return fmt.Errorf("Destination %s not added: %s", dest.Name, err)
+	}
+
+	c.Lock()
+	if d := c.Drains[dest.Name]; d != nil && d.state == DrainActive {
+		c.Unlock()
+		return fmt.Errorf("Destination %s not added: draining", dest.Name)
+	}
+	if _, exists := c.Writers[dest.Name]; exists {
+		prev := c.dests[dest.Name]
+		c.Unlock()
+		// Destinations differing only in options, such as
+		// InfluxDB databases, must be given an instance.
+		if prev.Spec != dest.Spec {
+			return fmt.Errorf("Destination %s not added: already exists as %s; add an instance to tell them apart", dest.Name, prev.Spec)
+		}
+		return fmt.Errorf("Destination %s not added: already exists", dest.Name)
+	}
+	c.Writers[dest.Name] = w
+	c.dests[dest.Name] = dest
+	c.Unlock()
+
+	go w.Start()
+
+	return nil
+}
+
+// Enqueue loads b into the named destination's outbound
+// queue (or disk queue, if it's full), bypassing routing.
+// It returns false if the destination isn't active or
+// b couldn't be queued in full.
+func (c *Cluster) Enqueue(name string, b *batch.Batch) bool {
+	r := c.routes()
+	if _, active := r.conns[name]; !active {
+		return false
+	}
+
+	return c.enqueue(r, name, b) == b.Len()
+}
+
+// Writer returns the named destination's
+// writer, or nil if it has none.
+func (c *Cluster) Writer(name string) Writer {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.Writers[name]
+}
+
+// WriterList returns a copy of the
+// cluster's destination writers.
+func (c *Cluster) WriterList() map[string]Writer {
+	c.RLock()
+	defer c.RUnlock()
+
+	writers := make(map[string]Writer, len(c.Writers))
+	for name, w := range c.Writers {
+		writers[name] = w
+	}
+
+	return writers
+}
+
+// Shutdown shuts down the writers of every
+// cluster in the pool, waiting up to timeout
+// for buffered messages to be written.
+func (p *Pool) Shutdown(timeout time.Duration) {
+	var wg sync.WaitGroup
+
+	for _, c := range p.ClusterList() {
+		c.RLock()
+		for _, w := range c.Writers {
+			wg.Add(1)
+			go func(w Writer) {
+				w.Shutdown()
+				wg.Done()
+			}(w)
+		}
+		c.RUnlock()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Printf("Timed out shutting down destination writers\n")
+	}
+}
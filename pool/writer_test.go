@@ -0,0 +1,130 @@
+package pool
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jamiealquiza/polymur/batch"
+)
+
+// nopWriter is a Writer that doesn't write; it
+// queues, and reports the destination's health
+// and stats, with the cluster.
+type nopWriter struct {
+	c    *Cluster
+	name string
+}
+
+func (nopWriter) Start()    {}
+func (nopWriter) Shutdown() {}
+
+func (w nopWriter) Enqueue(b *batch.Batch) bool { return w.c.Enqueue(w.name, b) }
+func (w nopWriter) Health() BreakerStatus       { return w.c.DestinationHealth(w.name) }
+func (w nopWriter) Stats() ConnStatus           { return w.c.DestinationStats(w.name) }
+
+func TestAddDestinationExists(t *testing.T) {
+	c := NewCluster(DefaultCluster)
+	c.writer = func(c *Cluster, dest Destination) (Writer, error) {
+		return nopWriter{c: c, name: dest.Name}, nil
+	}
+
+	dest, _ := ParseDestination("127.0.0.1:2003")
+	if err := c.AddDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddDestination(dest); err == nil {
+		t.Error("expected an error adding an existing destination")
+	}
+
+	// Destinations with the same address and different
+	// options collide unless given an instance.
+	db1, _ := ParseDestination("influx://127.0.0.1:8086?db=a")
+	db2, _ := ParseDestination("influx://127.0.0.1:8086?db=b")
+	if err := c.AddDestination(db1); err != nil {
+		t.Fatal(err)
+	}
+	err := c.AddDestination(db2)
+	if err == nil || !strings.Contains(err.Error(), "already exists as influx://127.0.0.1:8086?db=a") {
+		t.Errorf("expected an existing destination error, got %v", err)
+	}
+
+	db2, _ = ParseDestination("influx://127.0.0.1:8086:b?db=b")
+	if err := c.AddDestination(db2); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestAddDestinationDraining(t *testing.T) {
+	c := NewCluster(DefaultCluster)
+	c.writer = func(c *Cluster, dest Destination) (Writer, error) {
+		return nopWriter{c: c, name: dest.Name}, nil
+	}
+
+	dest, _ := ParseDestination("127.0.0.1:2003")
+	c.Drains[dest.Name] = &Drain{state: DrainActive}
+
+	err := c.AddDestination(dest)
+	if err == nil || !strings.Contains(err.Error(), "draining") {
+		t.Errorf("expected a draining error, got %v", err)
+	}
+
+	c.Drains[dest.Name].state = DrainDone
+	if err := c.AddDestination(dest); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestWriterEnqueueHealthStats(t *testing.T) {
+	c := NewCluster(DefaultCluster)
+	c.QueueCap = 2
+	c.writer = func(c *Cluster, dest Destination) (Writer, error) {
+		return nopWriter{c: c, name: dest.Name}, nil
+	}
+
+	dest, _ := ParseDestination("127.0.0.1:2003?connections=2")
+	if err := c.AddDestination(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	w := c.Writer(dest.Name)
+	if w == nil || len(c.WriterList()) != 1 {
+		t.Fatal("expected the destination's writer")
+	}
+
+	// Not registered.
+	if s := w.Health(); s.State != "" {
+		t.Errorf("got state %q for an unregistered destination", s.State)
+	}
+
+	c.Register(dest)
+	if s := w.Health(); s.State != BreakerClosed {
+		t.Errorf("got state %q, want %q", s.State, BreakerClosed)
+	}
+	if s := w.Stats(); s.Connections != 2 {
+		t.Errorf("got %d connections, want 2", s.Connections)
+	}
+
+	// Registered but not active.
+	if w.Enqueue(batch.New("a.b 1 1500000000")) {
+		t.Error("enqueued to an inactive destination")
+	}
+
+	c.AddConn(dest)
+	if !w.Enqueue(batch.New("a.b 1 1500000000")) {
+		t.Error("enqueue to an active destination failed")
+	}
+	if n := c.Queue(dest.Name).Len(); n != 1 {
+		t.Errorf("got queue length %d, want 1", n)
+	}
+
+	// The queue is full.
+	w.Enqueue(batch.New("a.b 1 1500000000"))
+	if w.Enqueue(batch.New("a.b 1 1500000000")) {
+		t.Error("enqueued to a full queue")
+	}
+
+	c.OpenBreaker(dest, BreakerWriteFailures)
+	if s := w.Health(); s.State != BreakerOpen || s.Reason != BreakerWriteFailures {
+		t.Errorf("got state %q (%s), want %q (%s)", s.State, s.Reason, BreakerOpen, BreakerWriteFailures)
+	}
+}
@@ -0,0 +1,141 @@
+// Package statstracker graphite.go writes
+// runtime metrics to the incoming queue.
+package statstracker
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/polymur/batch"
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+// WriteGraphite loads runtime, drop and memory budget
+// metrics into the incoming queue every i seconds.
+func WriteGraphite(c chan *batch.Batch, i int, s *Stats) {
+	interval := time.Tick(time.Duration(i) * time.Second)
+	hostname, _ := os.Hostname()
+
+	for {
+		<-interval
+		ts := time.Now().Unix()
+		metrics := batch.Get()
+
+		runtimeMetrics(metrics, hostname, ts, s)
+		dropMetrics(metrics, hostname, ts)
+		memoryMetrics(metrics, hostname, ts)
+
+		enqueue(c, metrics)
+	}
+}
+
+// WriteGraphiteWithBackendMetrics loads the WriteGraphite
+// metrics, along with incoming (with the capacity ic),
+// destination and retry queue metrics for each cluster
+// of p, into the incoming queue every i seconds.
+func WriteGraphiteWithBackendMetrics(p *pool.Pool, c chan *batch.Batch, ic int, i int, s *Stats) {
+	interval := time.Tick(time.Duration(i) * time.Second)
+	hostname, _ := os.Hostname()
+
+	for {
+		<-interval
+		ts := time.Now().Unix()
+		metrics := batch.Get()
+
+		runtimeMetrics(metrics, hostname, ts, s)
+
+		metrics.AppendString(fmt.Sprintf("%s.polymur.incoming-queue.current-size %d %d", hostname, len(c), ts))
+		metrics.AppendString(fmt.Sprintf("%s.polymur.incoming-queue.limit %d %d", hostname, ic, ts))
+
+		for _, c := range p.ClusterList() {
+			// Destinations in the default cluster
+			// aren't prefixed with the cluster name.
+			prefix := ""
+			if c.Name != pool.DefaultCluster {
+				prefix = strings.Replace(c.Name, ".", "_", -1) + "."
+			}
+
+			c.Lock()
+			for dest, destQueue := range c.Conns {
+				dest = strings.Replace(dest, ".", "_", -1)
+				metrics.AppendString(fmt.Sprintf("%s.polymur.outgoing-queue.%s%s.current-size %d %d", hostname, prefix, dest, destQueue.Len(), ts))
+				metrics.AppendString(fmt.Sprintf("%s.polymur.outgoing-queue.%s%s.limit %d %d", hostname, prefix, dest, c.QueueCap, ts))
+			}
+			c.Unlock()
+
+			retries := c.RetryStats()
+			for k, v := range map[string]int64{
+				"current-size": int64(len(c.RetryQueue)),
+				"retried":      retries.Retried,
+				"delivered":    retries.Delivered,
+				"expired":      retries.Expired,
+				"exhausted":    retries.Exhausted,
+				"dropped":      retries.Dropped,
+			} {
+				metrics.AppendString(fmt.Sprintf("%s.polymur.retry-queue.%s%s %d %d", hostname, prefix, k, v, ts))
+			}
+		}
+
+		dropMetrics(metrics, hostname, ts)
+		memoryMetrics(metrics, hostname, ts)
+
+		enqueue(c, metrics)
+	}
+}
+
+// enqueue loads metrics into the incoming
+// queue if the memory budget admits them.
+func enqueue(c chan *batch.Batch, metrics *batch.Batch) {
+	if !pool.Memory.Admit(metrics) {
+		metrics.Release()
+		return
+	}
+
+	c <- metrics
+}
+
+// runtimeMetrics appends Go runtime memory
+// stats and the inbound rate to metrics.
+func runtimeMetrics(metrics *batch.Batch, hostname string, ts int64, s *Stats) {
+	for k, v := range memStats() {
+		metrics.AppendString(fmt.Sprintf("%s.polymur.runtime.%s %d %d", hostname, k, v, ts))
+	}
+
+	metrics.AppendString(fmt.Sprintf("%s.polymur.rate %.2f %d", hostname, s.GetRate(), ts))
+}
+
+// dropMetrics appends dropped datapoint counts by
+// reason, cluster and destination to metrics.
+func dropMetrics(metrics *batch.Batch, hostname string, ts int64) {
+	for _, d := range pool.Drops.Counts() {
+		prefix := ""
+		if d.Cluster != "" && d.Cluster != pool.DefaultCluster {
+			prefix = strings.Replace(d.Cluster, ".", "_", -1) + "."
+		}
+
+		dest := d.Destination
+		if dest == "" {
+			dest = "unrouted"
+		}
+
+		metrics.AppendString(fmt.Sprintf("%s.polymur.drops.%s%s.%s %d %d", hostname, prefix, d.Reason, strings.Replace(dest, ".", "_", -1), d.Count, ts))
+	}
+
+	metrics.AppendString(fmt.Sprintf("%s.polymur.drops.total %d %d", hostname, pool.Drops.Total(), ts))
+}
+
+// memoryMetrics appends queue memory
+// budget usage by component to metrics.
+func memoryMetrics(metrics *batch.Batch, hostname string, ts int64) {
+	usage := pool.Memory.Usage()
+
+	for k, v := range usage.Components {
+		metrics.AppendString(fmt.Sprintf("%s.polymur.memory.%s %d %d", hostname, k, v, ts))
+	}
+
+	metrics.AppendString(fmt.Sprintf("%s.polymur.memory.used %d %d", hostname, usage.Used, ts))
+	metrics.AppendString(fmt.Sprintf("%s.polymur.memory.limit %d %d", hostname, usage.Limit, ts))
+	metrics.AppendString(fmt.Sprintf("%s.polymur.memory.blocked %d %d", hostname, usage.Blocked, ts))
+}
@@ -73,22 +73,39 @@ func StatsTracker(pool *pool.Pool, s *Stats) {
 		if pool == nil {
 			continue
 		}
-		// Outbound queues.
-		pool.Lock()
-		for dest, outboundQueue := range pool.Conns {
-			currLen := len(outboundQueue)
-			switch {
-			case currLen == pool.QueueCap:
-				log.Printf("Destination %s queue is at capacity (%d) - further messages will be dropped", dest, currLen)
-			case currLen > 0:
-				log.Printf("Destination %s queue length: %d\n", dest, currLen)
+		for _, c := range pool.ClusterList() {
+			name := c.LogSuffix()
+
+			// Outbound queues.
+			c.Lock()
+			for dest, outboundQueue := range c.Conns {
+				currLen := outboundQueue.Len()
+				switch {
+				case currLen >= outboundQueue.Cap():
+					log.Printf("Destination %s%s queue is at capacity (%d) - further messages will be dropped", dest, name, currLen)
+				case currLen > 0:
+					log.Printf("Destination %s%s queue length: %d\n", dest, name, currLen)
+				}
 			}
-		}
-		pool.Unlock()
 
-		// Misc. internal queues.
-		if l := len(pool.RetryQueue); l > 0 {
-			log.Printf("Retry message queue length: %d\n", l)
+			// Disk spill queues.
+			for dest, spill := range c.Spills {
+				if size := spill.Size(); size > 0 {
+					log.Printf("Destination %s%s spill queue size: %d bytes\n", dest, name, size)
+				}
+			}
+			c.Unlock()
+
+			// Misc. internal queues.
+			if l := len(c.RetryQueue); l > 0 {
+				log.Printf("Retry message queue%s length: %d\n", name, l)
+			}
+
+			retries := c.RetryStats()
+			if dead := retries.Expired + retries.Exhausted + retries.Dropped; dead > 0 {
+				log.Printf("Retry dead-lettered%s: %d expired, %d exhausted, %d dropped (queue full)\n",
+					name, retries.Expired, retries.Exhausted, retries.Dropped)
+			}
 		}
 
 	}
@@ -0,0 +1,146 @@
+// Package statstracker runstats.go serves
+// runtime, drop and memory budget stats.
+package statstracker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/jamiealquiza/polymur/pool"
+)
+
+var startTime = time.Now()
+
+// Start serves stats on address. A connection
+// sending "stats" is answered with the stats
+// as JSON (see buildStats).
+func Start(address string) {
+	log.Printf("Runstats started: %s\n", address)
+
+	server, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatalf("Runstats error: %s\n", err)
+	}
+	defer server.Close()
+
+	for {
+		conn, err := server.Accept()
+		if err != nil {
+			log.Printf("Runstats listener error: %s\n", err)
+			continue
+		}
+		reqHandler(conn)
+	}
+}
+
+// reqHandler answers a stats request.
+func reqHandler(conn net.Conn) {
+	defer conn.Close()
+
+	reqBuf := make([]byte, 8)
+	mlen, err := conn.Read(reqBuf)
+	if err != nil && err != io.EOF {
+		log.Printf("Runstats request error: %s\n", err)
+	}
+
+	req := strings.TrimSpace(string(reqBuf[:mlen]))
+	switch req {
+	case "stats":
+		response, err := json.MarshalIndent(buildStats(), "", "  ")
+		if err != nil {
+			log.Printf("Error parsing: %s", err)
+		}
+		// Append LF.
+		response = append(response, 10)
+
+		conn.Write(response)
+	default:
+		conn.Write([]byte(fmt.Sprintf("Not a command: %s\n", req)))
+	}
+}
+
+// buildStats returns service uptime, Go runtime memory
+// stats, dropped datapoints and memory budget usage.
+func buildStats() map[string]map[string]interface{} {
+	stats := make(map[string]map[string]interface{})
+
+	stats["service"] = map[string]interface{}{
+		"start-time":     startTime.Format(time.RFC3339),
+		"uptime-seconds": int64(time.Since(startTime).Seconds()),
+	}
+
+	stats["runtime-meminfo"] = make(map[string]interface{})
+	for k, v := range memStats() {
+		stats["runtime-meminfo"][k] = v
+	}
+
+	// Dropped datapoints by reason, then
+	// "cluster/destination".
+	stats["drops"] = make(map[string]interface{})
+	stats["drops"]["total"] = pool.Drops.Total()
+	for _, d := range pool.Drops.Counts() {
+		if _, exists := stats["drops"][d.Reason]; !exists {
+			stats["drops"][d.Reason] = make(map[string]int64)
+		}
+
+		key := d.Destination
+		if d.Cluster != "" {
+			key = d.Cluster + "/" + d.Destination
+		}
+		stats["drops"][d.Reason].(map[string]int64)[key] = d.Count
+	}
+
+	// Queue memory budget usage.
+	usage := pool.Memory.Usage()
+	stats["memory"] = map[string]interface{}{
+		"limit":      usage.Limit,
+		"policy":     usage.Policy,
+		"used":       usage.Used,
+		"blocked":    usage.Blocked,
+		"components": usage.Components,
+	}
+
+	return stats
+}
+
+// memStats returns the reported
+// Go runtime memory stats.
+// Reference: http://golang.org/pkg/runtime/#ReadMemStats
+func memStats() map[string]uint64 {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	return map[string]uint64{
+		"Alloc":        mem.Alloc,
+		"TotalAlloc":   mem.TotalAlloc,
+		"Sys":          mem.Sys,
+		"Lookups":      mem.Lookups,
+		"Mallocs":      mem.Mallocs,
+		"Frees":        mem.Frees,
+		"HeapAlloc":    mem.HeapAlloc,
+		"HeapSys":      mem.HeapSys,
+		"HeapIdle":     mem.HeapIdle,
+		"HeapInuse":    mem.HeapInuse,
+		"HeapReleased": mem.HeapReleased,
+		"HeapObjects":  mem.HeapObjects,
+		"StackInuse":   mem.StackInuse,
+		"StackSys":     mem.StackSys,
+		"MSpanInuse":   mem.MSpanInuse,
+		"MSpanSys":     mem.MSpanSys,
+		"MCacheInuse":  mem.MCacheInuse,
+		"MCacheSys":    mem.MCacheSys,
+		"BuckHashSys":  mem.BuckHashSys,
+		"GCSys":        mem.GCSys,
+		"OtherSys":     mem.OtherSys,
+		"NextGC":       mem.NextGC,
+		"LastGC":       mem.LastGC,
+		"PauseTotalNs": mem.PauseTotalNs,
+		"NumGC":        uint64(mem.NumGC),
+	}
+}